@@ -0,0 +1,71 @@
+//! Record information about the build so it can be shown by
+//! `wasmer-borealis version`.
+
+use std::{path::PathBuf, process::Command, time::SystemTime};
+
+use time::{format_description::well_known::Rfc3339, OffsetDateTime};
+
+fn main() {
+    if let Some(commit) = run("git", &["rev-parse", "HEAD"]) {
+        println!("cargo:rustc-env=BOREALIS_GIT_COMMIT={commit}");
+    }
+    rerun_on_new_commits();
+
+    let rustc = std::env::var("RUSTC").unwrap_or_else(|_| "rustc".to_string());
+    let rustc_version = run(&rustc, &["--version"]).unwrap_or_default();
+    println!("cargo:rustc-env=BOREALIS_RUSTC_VERSION={rustc_version}");
+
+    println!("cargo:rustc-env=BOREALIS_BUILD_DATE={}", build_date());
+    println!("cargo:rerun-if-env-changed=SOURCE_DATE_EPOCH");
+
+    let mut features: Vec<String> = std::env::vars()
+        .filter_map(|(key, _)| {
+            key.strip_prefix("CARGO_FEATURE_")
+                .map(|f| f.to_lowercase().replace('_', "-"))
+        })
+        .collect();
+    features.sort();
+    println!("cargo:rustc-env=BOREALIS_FEATURES={}", features.join(","));
+}
+
+/// Make sure the commit is updated when `HEAD` moves, including when a commit
+/// is made on the current branch or its ref gets packed.
+fn rerun_on_new_commits() {
+    let git_dir = run("git", &["rev-parse", "--git-dir"])
+        .map(PathBuf::from)
+        .unwrap_or_else(|| PathBuf::from("../../.git"));
+
+    let mut watched = vec![git_dir.join("HEAD"), git_dir.join("packed-refs")];
+    if let Some(branch) = run("git", &["symbolic-ref", "-q", "HEAD"]) {
+        // e.g. "refs/heads/main"
+        watched.push(git_dir.join(branch));
+    }
+
+    // Cargo always reruns the build script if a watched file doesn't exist
+    for path in watched.iter().filter(|p| p.exists()) {
+        println!("cargo:rerun-if-changed={}", path.display());
+    }
+}
+
+/// The time this build was made, respecting `$SOURCE_DATE_EPOCH` for
+/// reproducible builds.
+fn build_date() -> String {
+    let timestamp = std::env::var("SOURCE_DATE_EPOCH")
+        .ok()
+        .and_then(|s| s.parse::<i64>().ok())
+        .and_then(|secs| OffsetDateTime::from_unix_timestamp(secs).ok())
+        .unwrap_or_else(|| OffsetDateTime::from(SystemTime::now()));
+
+    timestamp.format(&Rfc3339).unwrap()
+}
+
+fn run(program: &str, args: &[&str]) -> Option<String> {
+    let output = Command::new(program).args(args).output().ok()?;
+
+    if output.status.success() {
+        let stdout = String::from_utf8(output.stdout).ok()?;
+        Some(stdout.trim().to_string())
+    } else {
+        None
+    }
+}
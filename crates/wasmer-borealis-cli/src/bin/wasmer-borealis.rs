@@ -1,22 +1,56 @@
 use anyhow::Error;
-use clap::Parser;
+use clap::{CommandFactory, Parser};
 use directories::ProjectDirs;
 use once_cell::sync::Lazy;
+use tracing::level_filters::LevelFilter;
 use tracing_subscriber::EnvFilter;
-use wasmer_borealis_cli::{New, Report, Run};
+use wasmer_borealis_cli::{
+    Cache, Cancel, Config, Coverage, Doctor, Import, New, Prune, Registry, Report, Run, Triage,
+    Version,
+};
 
 pub static DIRS: Lazy<ProjectDirs> =
     Lazy::new(|| ProjectDirs::from("io", "wasmer", "borealis").unwrap());
 
 fn main() -> Result<(), Error> {
-    let Args { verbosity, cmd } = Args::parse();
+    if let Err(e) = wasmer_borealis_cli::apply_active_profile() {
+        // Don't bail, otherwise a broken config file can't be fixed with
+        // "wasmer-borealis config"
+        eprintln!("Warning: unable to load the active profile: {e:#}");
+    }
+
+    let Args {
+        verbosity,
+        log_level,
+        log_format,
+        cmd,
+    } = Args::parse();
 
-    initialize_logging(verbosity.log_level_filter());
+    initialize_logging(verbosity.log_level_filter(), log_level, log_format);
 
     match cmd {
         Cmd::Run(r) => r.execute(),
+        Cmd::Cancel(c) => c.execute(),
+        Cmd::Import(i) => i.execute(),
         Cmd::New(n) => n.execute(),
         Cmd::Report(r) => r.execute(),
+        Cmd::Coverage(c) => c.execute(),
+        Cmd::Registry(r) => r.execute(),
+        Cmd::Cache(c) => c.execute(),
+        Cmd::Triage(t) => t.execute(),
+        Cmd::Prune(p) => p.execute(),
+        Cmd::Config(c) => c.execute(),
+        Cmd::Doctor(d) => d.execute(),
+        Cmd::Version(v) => v.execute(),
+        Cmd::Completions { shell } => {
+            clap_complete::generate(
+                shell,
+                &mut Args::command(),
+                "wasmer-borealis",
+                &mut std::io::stdout(),
+            );
+            Ok(())
+        }
     }
 }
 
@@ -25,20 +59,168 @@ fn main() -> Result<(), Error> {
 struct Args {
     #[clap(flatten)]
     verbosity: clap_verbosity_flag::Verbosity<clap_verbosity_flag::InfoLevel>,
+    /// Set the default log level explicitly, ignoring any `-v` or `-q` flags.
+    #[clap(long, global = true, env = "BOREALIS_LOG_LEVEL")]
+    log_level: Option<LevelFilter>,
+    /// How log messages should be formatted.
+    #[clap(
+        long,
+        global = true,
+        value_enum,
+        env = "BOREALIS_LOG_FORMAT",
+        default_value_t = LogFormat::Console
+    )]
+    log_format: LogFormat,
     #[clap(subcommand)]
     cmd: Cmd,
 }
 
+#[derive(Debug, Copy, Clone, PartialEq, Eq, clap::ValueEnum)]
+enum LogFormat {
+    /// Human-readable output for interactive use.
+    Console,
+    /// One JSON object per log message, for machine consumption.
+    Json,
+}
+
 #[derive(Parser, Debug)]
 enum Cmd {
     /// Create a new experiment.
+    #[clap(after_help = NEW_EXAMPLES)]
     New(New),
     /// Run an experiment.
+    #[clap(after_help = RUN_EXAMPLES)]
     Run(Run),
+    /// Stop a running experiment, keeping the results so far.
+    #[clap(after_help = CANCEL_EXAMPLES)]
+    Cancel(Cancel),
+    /// Save the outcomes of test cases that were run outside Borealis as an
+    /// experiment's results.
+    #[clap(after_help = IMPORT_EXAMPLES)]
+    Import(Import),
     /// Generate a report from an experiment's results.
+    #[clap(after_help = REPORT_EXAMPLES)]
     Report(Report),
+    /// Show which parts of the registry recent experiments have (and
+    /// haven't) tested.
+    #[clap(after_help = COVERAGE_EXAMPLES)]
+    Coverage(Coverage),
+    /// Interact with a Wasmer registry.
+    #[clap(after_help = REGISTRY_EXAMPLES)]
+    Registry(Registry),
+    /// Inspect the package cache.
+    #[clap(after_help = CACHE_EXAMPLES)]
+    Cache(Cache),
+    /// Record the triage status of test cases in an experiment's results.
+    #[clap(after_help = TRIAGE_EXAMPLES)]
+    Triage(Triage),
+    /// Truncate old logs according to each experiment's retention rules.
+    #[clap(after_help = PRUNE_EXAMPLES)]
+    Prune(Prune),
+    /// Manage the defaults stored in each profile.
+    #[clap(after_help = CONFIG_EXAMPLES)]
+    Config(Config),
+    /// Check that everything needed to run experiments is set up correctly.
+    #[clap(after_help = DOCTOR_EXAMPLES)]
+    Doctor(Doctor),
+    /// Print detailed information about this build.
+    #[clap(after_help = VERSION_EXAMPLES)]
+    Version(Version),
+    /// Generate shell completions.
+    #[clap(after_help = COMPLETIONS_EXAMPLES)]
+    Completions {
+        /// The shell to generate completions for.
+        #[clap(value_enum)]
+        shell: clap_complete::Shell,
+    },
 }
 
+const NEW_EXAMPLES: &str = "\
+Examples:
+  wasmer-borealis new wasmer/python -o ./python.experiment.json
+";
+
+const RUN_EXAMPLES: &str = "\
+Examples:
+  wasmer-borealis run ./my.experiment.json -o ./experiment
+  wasmer-borealis run ./my.experiment.json --output-format=json-lines --token=$WASMER_TOKEN
+  wasmer-borealis run ./my.experiment.json --dry-run
+";
+
+const CANCEL_EXAMPLES: &str = "\
+Examples:
+  wasmer-borealis cancel ./experiment
+  wasmer-borealis cancel 0b6f9c1e-5d0a-4c8e-9a57-3f1b2d4e6a7c
+";
+
+const IMPORT_EXAMPLES: &str = "\
+Examples:
+  wasmer-borealis import ./outcomes.ndjson --experiment ./my.experiment.json -o ./experiment
+";
+
+const REPORT_EXAMPLES: &str = "\
+Examples:
+  wasmer-borealis report ./experiment/results.json
+  wasmer-borealis report ./experiment/results.json --embed-logs --html ./site/index.html
+  wasmer-borealis report ./experiment/results.json --search 'panicked at'
+  wasmer-borealis report ./v4.0/results.json ./v4.1/results.json --matrix
+";
+
+const COVERAGE_EXAMPLES: &str = "\
+Examples:
+  wasmer-borealis coverage ./experiments/*/results.json
+  wasmer-borealis coverage ./experiments/*/results.json --since 30days --registry wasmer.wtf
+";
+
+const REGISTRY_EXAMPLES: &str = "\
+Examples:
+  wasmer-borealis registry check --registry wasmer.wtf
+";
+
+const CACHE_EXAMPLES: &str = "\
+Examples:
+  wasmer-borealis cache stats
+  wasmer-borealis cache stats --json
+";
+
+const TRIAGE_EXAMPLES: &str = "\
+Examples:
+  wasmer-borealis triage ./experiment/results.json 'syrusakbary/*' --state expected
+  wasmer-borealis triage ./experiment/results.json --category bug --state bug-filed --assignee me
+";
+
+const PRUNE_EXAMPLES: &str = "\
+Examples:
+  wasmer-borealis prune ./experiments/*/results.json
+";
+
+const CONFIG_EXAMPLES: &str = "\
+Examples:
+  wasmer-borealis config set registry wasmer.wtf
+  wasmer-borealis config get cache-dir --profile ci
+  wasmer-borealis config use ci
+";
+
+const DOCTOR_EXAMPLES: &str = "\
+Examples:
+  wasmer-borealis doctor
+  wasmer-borealis doctor --registry wasmer.wtf --cache-dir /mnt/scratch/borealis
+";
+
+const VERSION_EXAMPLES: &str = "\
+Examples:
+  wasmer-borealis version
+  wasmer-borealis version --format json
+";
+
+const COMPLETIONS_EXAMPLES: &str = "\
+Examples:
+  wasmer-borealis completions bash > ~/.local/share/bash-completion/completions/wasmer-borealis
+  wasmer-borealis completions zsh > ~/.zfunc/_wasmer-borealis
+  wasmer-borealis completions fish > ~/.config/fish/completions/wasmer-borealis.fish
+  wasmer-borealis completions powershell >> $PROFILE
+";
+
 /// Initialize logging.
 ///
 /// This will prefer the `$RUST_LOG` environment variable, with the `-v` and
@@ -48,7 +230,14 @@ enum Cmd {
 /// log everything at the `error` level (`-q` means to be one level more quiet
 /// than the default `warn`), but anything from the `wasmer_registry` crate will
 /// be logged at the `debug` level.
-fn initialize_logging(default_level: tracing::log::LevelFilter) {
+///
+/// The `--log-level` flag replaces the default level derived from `-v` and
+/// `-q`, but `$RUST_LOG` still takes precedence.
+fn initialize_logging(
+    default_level: tracing::log::LevelFilter,
+    level_override: Option<LevelFilter>,
+    format: LogFormat,
+) {
     let default_level = match default_level {
         tracing::log::LevelFilter::Off => tracing::level_filters::LevelFilter::OFF,
         tracing::log::LevelFilter::Error => tracing::level_filters::LevelFilter::ERROR,
@@ -57,16 +246,21 @@ fn initialize_logging(default_level: tracing::log::LevelFilter) {
         tracing::log::LevelFilter::Debug => tracing::level_filters::LevelFilter::DEBUG,
         tracing::log::LevelFilter::Trace => tracing::level_filters::LevelFilter::TRACE,
     };
+    let default_level = level_override.unwrap_or(default_level);
 
     let env = EnvFilter::builder()
         .with_default_directive(default_level.into())
         .from_env_lossy()
         .add_directive("hyper=warn".parse().unwrap());
 
-    tracing_subscriber::fmt()
+    let builder = tracing_subscriber::fmt()
         .with_target(true)
         .with_span_events(tracing_subscriber::fmt::format::FmtSpan::CLOSE)
         .with_writer(std::io::stderr)
-        .with_env_filter(env)
-        .init();
+        .with_env_filter(env);
+
+    match format {
+        LogFormat::Console => builder.init(),
+        LogFormat::Json => builder.json().init(),
+    }
 }
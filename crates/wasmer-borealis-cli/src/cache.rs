@@ -0,0 +1,59 @@
+use std::path::PathBuf;
+
+use anyhow::Error;
+use clap::{Parser, ValueHint};
+
+#[derive(Parser, Debug)]
+pub struct Cache {
+    #[clap(subcommand)]
+    cmd: CacheCommand,
+}
+
+impl Cache {
+    pub fn execute(self) -> Result<(), Error> {
+        match self.cmd {
+            CacheCommand::Stats(s) => s.execute(),
+        }
+    }
+}
+
+#[derive(Parser, Debug)]
+enum CacheCommand {
+    /// Show what is currently stored in the package cache.
+    Stats(Stats),
+}
+
+#[derive(Parser, Debug)]
+struct Stats {
+    /// The cache directory to inspect.
+    #[clap(long, env = "BOREALIS_CACHE_DIR", value_hint = ValueHint::DirPath)]
+    cache_dir: Option<PathBuf>,
+    /// Print the statistics as JSON.
+    #[clap(long)]
+    json: bool,
+}
+
+impl Stats {
+    #[tracing::instrument(level = "debug", skip_all)]
+    fn execute(self) -> Result<(), Error> {
+        let cache_dir = self
+            .cache_dir
+            .unwrap_or_else(|| wasmer_borealis::DIRS.cache_dir().to_path_buf());
+        let usage = wasmer_borealis::experiment::disk_usage(&cache_dir)?;
+
+        if self.json {
+            println!("{}", serde_json::to_string_pretty(&usage)?);
+            return Ok(());
+        }
+
+        println!("Cache dir: {}", cache_dir.display());
+
+        for (registry, count) in &usage.package_versions {
+            println!("{registry}: {count} package versions");
+        }
+
+        println!("Total size: {} bytes", usage.total_size);
+
+        Ok(())
+    }
+}
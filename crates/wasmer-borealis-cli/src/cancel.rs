@@ -0,0 +1,34 @@
+use std::path::PathBuf;
+
+use anyhow::Error;
+use clap::{Parser, ValueHint};
+
+#[derive(Parser, Debug)]
+pub struct Cancel {
+    /// The experiment's directory, or its ID if it is being saved to the
+    /// default location.
+    #[clap(value_hint = ValueHint::DirPath)]
+    experiment: PathBuf,
+}
+
+impl Cancel {
+    #[tracing::instrument(level = "debug", skip_all)]
+    pub fn execute(self) -> Result<(), Error> {
+        let experiment_dir = if self.experiment.is_dir() {
+            self.experiment
+        } else {
+            wasmer_borealis::DIRS
+                .data_local_dir()
+                .join(&self.experiment)
+        };
+
+        wasmer_borealis::experiment::cancel(&experiment_dir)?;
+        println!(
+            "Asked the experiment in \"{}\" to stop. Its results will be saved once any \
+             running test cases have been terminated.",
+            experiment_dir.display()
+        );
+
+        Ok(())
+    }
+}
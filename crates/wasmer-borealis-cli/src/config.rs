@@ -0,0 +1,206 @@
+use std::{collections::BTreeMap, path::PathBuf};
+
+use anyhow::{Context, Error};
+use clap::Parser;
+
+/// Every setting that can be stored in a profile, and the environment variable
+/// its command-line flag falls back to.
+const SETTINGS: [(&str, &str); 13] = [
+    ("registry", "WASMER_REGISTRY"),
+    ("user-agent-suffix", "BOREALIS_USER_AGENT_SUFFIX"),
+    ("contact", "BOREALIS_CONTACT"),
+    ("cache-dir", "BOREALIS_CACHE_DIR"),
+    ("shared-cache-dir", "BOREALIS_SHARED_CACHE_DIR"),
+    ("cache-profile", "BOREALIS_CACHE_PROFILE"),
+    ("concurrency", "BOREALIS_CONCURRENCY"),
+    (
+        "max-concurrent-downloads",
+        "BOREALIS_MAX_CONCURRENT_DOWNLOADS",
+    ),
+    (
+        "max-requests-per-second",
+        "BOREALIS_MAX_REQUESTS_PER_SECOND",
+    ),
+    (
+        "max-concurrent-requests",
+        "BOREALIS_MAX_CONCURRENT_REQUESTS",
+    ),
+    ("output-format", "BOREALIS_OUTPUT_FORMAT"),
+    ("log-level", "BOREALIS_LOG_LEVEL"),
+    ("log-format", "BOREALIS_LOG_FORMAT"),
+];
+
+const DEFAULT_PROFILE: &str = "default";
+
+#[derive(Parser, Debug)]
+pub struct Config {
+    #[clap(subcommand)]
+    cmd: ConfigCommand,
+}
+
+impl Config {
+    pub fn execute(self) -> Result<(), Error> {
+        let mut config = ConfigFile::load()?;
+
+        match self.cmd {
+            ConfigCommand::Get { key, profile } => {
+                let profile = profile.unwrap_or_else(|| config.active_profile());
+                check_key(&key)?;
+                if let Some(value) = config.profiles.get(&profile).and_then(|p| p.get(&key)) {
+                    println!("{value}");
+                }
+                Ok(())
+            }
+            ConfigCommand::Set {
+                key,
+                value,
+                profile,
+            } => {
+                let profile = profile.unwrap_or_else(|| config.active_profile());
+                check_key(&key)?;
+                config
+                    .profiles
+                    .entry(profile)
+                    .or_default()
+                    .insert(key, value);
+                config.save()
+            }
+            ConfigCommand::Unset { key, profile } => {
+                let profile = profile.unwrap_or_else(|| config.active_profile());
+                check_key(&key)?;
+                if let Some(p) = config.profiles.get_mut(&profile) {
+                    p.remove(&key);
+                }
+                config.save()
+            }
+            ConfigCommand::List => {
+                let active = config.active_profile();
+
+                for (name, settings) in &config.profiles {
+                    let marker = if *name == active { " (active)" } else { "" };
+                    println!("[{name}]{marker}");
+                    for (key, value) in settings {
+                        println!("{key} = {value}");
+                    }
+                }
+
+                Ok(())
+            }
+            ConfigCommand::Use { profile } => {
+                config.active_profile = Some(profile);
+                config.save()
+            }
+        }
+    }
+}
+
+#[derive(Parser, Debug)]
+enum ConfigCommand {
+    /// Print a setting's value.
+    Get {
+        key: String,
+        /// The profile to read from (defaults to the active profile).
+        #[clap(long)]
+        profile: Option<String>,
+    },
+    /// Save a setting.
+    Set {
+        key: String,
+        value: String,
+        /// The profile to update (defaults to the active profile).
+        #[clap(long)]
+        profile: Option<String>,
+    },
+    /// Remove a setting.
+    Unset {
+        key: String,
+        /// The profile to update (defaults to the active profile).
+        #[clap(long)]
+        profile: Option<String>,
+    },
+    /// Show every profile and its settings.
+    List,
+    /// Switch to a different profile.
+    Use { profile: String },
+}
+
+fn check_key(key: &str) -> Result<(), Error> {
+    anyhow::ensure!(
+        SETTINGS.iter().any(|(name, _)| *name == key),
+        "Unknown setting, \"{key}\". Expected one of {}",
+        SETTINGS.map(|(name, _)| name).join(", "),
+    );
+    Ok(())
+}
+
+/// Use the active profile's settings as defaults for any command-line flags.
+///
+/// Settings are applied by setting the environment variable each flag falls
+/// back to, so explicit flags and environment variables still take
+/// precedence. The active profile can be overridden with `$BOREALIS_PROFILE`.
+pub fn apply_active_profile() -> Result<(), Error> {
+    let config = ConfigFile::load()?;
+    let name = std::env::var("BOREALIS_PROFILE").unwrap_or_else(|_| config.active_profile());
+
+    let Some(profile) = config.profiles.get(&name) else {
+        return Ok(());
+    };
+
+    for (key, var) in SETTINGS {
+        if let Some(value) = profile.get(key) {
+            if std::env::var_os(var).is_none() {
+                std::env::set_var(var, value);
+            }
+        }
+    }
+
+    Ok(())
+}
+
+/// The settings stored in `config.json`.
+#[derive(Debug, Default, serde::Serialize, serde::Deserialize)]
+#[serde(rename_all = "kebab-case")]
+struct ConfigFile {
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    active_profile: Option<String>,
+    #[serde(default)]
+    profiles: BTreeMap<String, BTreeMap<String, String>>,
+}
+
+impl ConfigFile {
+    fn path() -> PathBuf {
+        crate::DIRS.config_dir().join("config.json")
+    }
+
+    fn load() -> Result<Self, Error> {
+        let path = ConfigFile::path();
+
+        match std::fs::read_to_string(&path) {
+            Ok(raw) => serde_json::from_str(&raw)
+                .with_context(|| format!("Unable to parse \"{}\"", path.display())),
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(ConfigFile::default()),
+            Err(e) => Err(Error::new(e).context(format!("Unable to read \"{}\"", path.display()))),
+        }
+    }
+
+    fn save(&self) -> Result<(), Error> {
+        let path = ConfigFile::path();
+
+        if let Some(parent) = path.parent() {
+            std::fs::create_dir_all(parent)
+                .with_context(|| format!("Unable to create \"{}\"", parent.display()))?;
+        }
+
+        let json = serde_json::to_string_pretty(self)?;
+        std::fs::write(&path, json)
+            .with_context(|| format!("Unable to save to \"{}\"", path.display()))?;
+
+        Ok(())
+    }
+
+    fn active_profile(&self) -> String {
+        self.active_profile
+            .clone()
+            .unwrap_or_else(|| DEFAULT_PROFILE.to_string())
+    }
+}
@@ -0,0 +1,94 @@
+use std::{
+    fmt::Debug,
+    path::PathBuf,
+    time::{Duration, SystemTime},
+};
+
+use anyhow::{Context, Error};
+use clap::{Parser, ValueHint};
+use wasmer_borealis::{
+    experiment::Results, registry::queries::Package, render::Coverage as RegistryCoverage,
+};
+
+use crate::{run::format_graphql, HttpOptions};
+
+#[derive(Parser)]
+pub struct Coverage {
+    /// The Wasmer registry to compare against.
+    #[clap(long, default_value = "wasmer.io", env = "WASMER_REGISTRY")]
+    registry: String,
+    #[clap(long, short, env = "WASMER_TOKEN")]
+    token: Option<String>,
+    #[clap(flatten)]
+    http: HttpOptions,
+    /// Ignore results which are older than this (e.g. "30days").
+    #[clap(long)]
+    since: Option<humantime::Duration>,
+    /// The results.json files from each experiment.
+    #[clap(required = true, value_hint = ValueHint::FilePath)]
+    json: Vec<PathBuf>,
+}
+
+impl Coverage {
+    #[tracing::instrument(level = "debug", skip_all)]
+    pub fn execute(self) -> Result<(), Error> {
+        let cutoff = self
+            .since
+            .map(|since| SystemTime::now() - Duration::from(since));
+
+        let mut results: Vec<Results> = Vec::new();
+        for path in &self.json {
+            let raw = std::fs::read_to_string(path)
+                .with_context(|| format!("Unable to read \"{}\"", path.display()))?;
+            let r: Results = serde_json::from_str(&raw)
+                .with_context(|| format!("Unable to parse \"{}\"", path.display()))?;
+
+            if let Some(cutoff) = cutoff {
+                if r.finished(path)? < cutoff {
+                    tracing::debug!(path = %path.display(), "Skipping old results");
+                    continue;
+                }
+            }
+
+            results.push(r);
+        }
+
+        let endpoint = format_graphql(&self.registry);
+        let client = crate::http_client(self.token.as_deref(), &self.http)?;
+
+        let mut pages: Vec<Vec<Package>> = Vec::new();
+        tokio::runtime::Builder::new_current_thread()
+            .enable_all()
+            .build()?
+            .block_on(wasmer_borealis::registry::all_packages(
+                &client, &endpoint, &mut pages,
+            ))
+            .with_context(|| format!("Unable to list the packages on \"{endpoint}\""))?;
+        let packages: Vec<_> = pages.into_iter().flatten().collect();
+
+        let coverage = RegistryCoverage::new(&packages, &results);
+        wasmer_borealis::render::coverage(&coverage, std::io::stdout())?;
+
+        Ok(())
+    }
+}
+
+impl Debug for Coverage {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let Coverage {
+            registry,
+            token,
+            http,
+            since,
+            json,
+        } = self;
+
+        f.debug_struct("Coverage")
+            .field("registry", registry)
+            .field("token", &token.as_ref().map(|_| "[REDACTED]"))
+            .field("http", http)
+            .field("since", since)
+            .field("json", json)
+            .finish()
+    }
+}
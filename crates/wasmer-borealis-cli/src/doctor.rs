@@ -0,0 +1,249 @@
+use std::{
+    fmt::Debug,
+    path::{Path, PathBuf},
+    process::Command,
+    time::{Duration, SystemTime},
+};
+
+use anyhow::Error;
+use clap::{Parser, ValueHint};
+use reqwest::Client;
+
+use crate::{run::format_graphql, HttpOptions};
+
+/// How far the local clock can drift from the registry's before we complain.
+const MAX_CLOCK_SKEW: Duration = Duration::from_secs(60);
+
+#[derive(Parser)]
+pub struct Doctor {
+    /// The Wasmer registry to check.
+    #[clap(long, default_value = "wasmer.io", env = "WASMER_REGISTRY")]
+    registry: String,
+    #[clap(long, short, env = "WASMER_TOKEN")]
+    token: Option<String>,
+    #[clap(flatten)]
+    http: HttpOptions,
+    /// Where downloaded packages are cached.
+    #[clap(long, env = "BOREALIS_CACHE_DIR", value_hint = ValueHint::DirPath)]
+    cache_dir: Option<PathBuf>,
+}
+
+impl Doctor {
+    #[tracing::instrument(level = "debug", skip_all)]
+    pub fn execute(self) -> Result<(), Error> {
+        let cache_dir = self
+            .cache_dir
+            .clone()
+            .unwrap_or_else(|| wasmer_borealis::DIRS.cache_dir().to_path_buf());
+        let endpoint = format_graphql(&self.registry);
+        let client = crate::http_client(self.token.as_deref(), &self.http)?;
+
+        let rt = tokio::runtime::Builder::new_current_thread()
+            .enable_all()
+            .build()?;
+
+        let diagnostics = [
+            check_wasmer(),
+            check_cache_dir(&cache_dir),
+            rt.block_on(check_registry(&client, &endpoint, self.token.is_some())),
+            rt.block_on(check_clock(&client, &endpoint)),
+        ];
+
+        let mut problems = 0;
+
+        for diagnostic in &diagnostics {
+            let marker = match diagnostic.status {
+                Status::Ok => "ok",
+                Status::Warning => "warning",
+                Status::Error => {
+                    problems += 1;
+                    "error"
+                }
+            };
+            println!("[{marker}] {}: {}", diagnostic.name, diagnostic.message);
+
+            if let Some(fix) = &diagnostic.fix {
+                println!("    fix: {fix}");
+            }
+        }
+
+        anyhow::ensure!(problems == 0, "Found {problems} problem(s)");
+
+        Ok(())
+    }
+}
+
+impl Debug for Doctor {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let Doctor {
+            registry,
+            token,
+            http,
+            cache_dir,
+        } = self;
+
+        f.debug_struct("Doctor")
+            .field("registry", registry)
+            .field("token", &token.as_ref().map(|_| "[REDACTED]"))
+            .field("http", http)
+            .field("cache_dir", cache_dir)
+            .finish()
+    }
+}
+
+#[derive(Debug, Copy, Clone, PartialEq, Eq)]
+enum Status {
+    Ok,
+    Warning,
+    Error,
+}
+
+/// The outcome of a single check.
+#[derive(Debug)]
+struct Diagnostic {
+    name: &'static str,
+    status: Status,
+    message: String,
+    /// What the user can do to resolve the problem.
+    fix: Option<String>,
+}
+
+impl Diagnostic {
+    fn ok(name: &'static str, message: impl Into<String>) -> Self {
+        Diagnostic {
+            name,
+            status: Status::Ok,
+            message: message.into(),
+            fix: None,
+        }
+    }
+
+    fn warning(name: &'static str, message: impl Into<String>, fix: impl Into<String>) -> Self {
+        Diagnostic {
+            name,
+            status: Status::Warning,
+            message: message.into(),
+            fix: Some(fix.into()),
+        }
+    }
+
+    fn error(name: &'static str, message: impl Into<String>, fix: impl Into<String>) -> Self {
+        Diagnostic {
+            name,
+            status: Status::Error,
+            message: message.into(),
+            fix: Some(fix.into()),
+        }
+    }
+}
+
+fn check_wasmer() -> Diagnostic {
+    const NAME: &str = "wasmer";
+
+    match Command::new("wasmer").arg("--version").output() {
+        Ok(output) if output.status.success() => {
+            Diagnostic::ok(NAME, String::from_utf8_lossy(&output.stdout).trim())
+        }
+        Ok(output) => Diagnostic::error(
+            NAME,
+            format!("\"wasmer --version\" failed with {}", output.status),
+            "Reinstall wasmer from https://wasmer.io/",
+        ),
+        Err(e) => Diagnostic::error(
+            NAME,
+            format!("Unable to run \"wasmer\": {e}"),
+            "Install wasmer from https://wasmer.io/ and make sure it is on your $PATH",
+        ),
+    }
+}
+
+fn check_cache_dir(cache_dir: &Path) -> Diagnostic {
+    const NAME: &str = "cache";
+
+    let writable =
+        std::fs::create_dir_all(cache_dir).and_then(|_| tempfile::tempfile_in(cache_dir).map(drop));
+
+    if let Err(e) = writable {
+        return Diagnostic::error(
+            NAME,
+            format!("\"{}\" isn't writable: {e}", cache_dir.display()),
+            "Fix the directory's permissions or pick another one with --cache-dir",
+        );
+    }
+
+    match wasmer_borealis::experiment::disk_usage(cache_dir) {
+        Ok(usage) => Diagnostic::ok(
+            NAME,
+            format!(
+                "\"{}\" is writable and uses {} bytes",
+                cache_dir.display(),
+                usage.total_size
+            ),
+        ),
+        Err(e) => Diagnostic::warning(
+            NAME,
+            format!("Unable to inspect \"{}\": {e}", cache_dir.display()),
+            "Delete the cache directory so it can be recreated",
+        ),
+    }
+}
+
+async fn check_registry(client: &Client, endpoint: &str, has_token: bool) -> Diagnostic {
+    const NAME: &str = "registry";
+
+    match wasmer_borealis::registry::whoami(client, endpoint).await {
+        Ok(Some(username)) => Diagnostic::ok(
+            NAME,
+            format!("\"{endpoint}\" is reachable (authenticated as {username})"),
+        ),
+        Ok(None) if has_token => Diagnostic::error(
+            NAME,
+            format!("\"{endpoint}\" didn't accept the provided token"),
+            "Generate a new token and pass it with --token or $WASMER_TOKEN",
+        ),
+        Ok(None) => Diagnostic::ok(NAME, format!("\"{endpoint}\" is reachable (anonymous)")),
+        Err(e) => Diagnostic::error(
+            NAME,
+            format!("Unable to query \"{endpoint}\": {e}"),
+            "Check your network connection and the --registry flag",
+        ),
+    }
+}
+
+/// Compare the local clock with the `Date` header sent by the registry.
+async fn check_clock(client: &Client, endpoint: &str) -> Diagnostic {
+    const NAME: &str = "clock";
+
+    let date = match client.head(endpoint).send().await {
+        Ok(response) => response
+            .headers()
+            .get(reqwest::header::DATE)
+            .and_then(|v| v.to_str().ok())
+            .and_then(|v| httpdate::parse_http_date(v).ok()),
+        Err(_) => None,
+    };
+
+    let Some(date) = date else {
+        return Diagnostic::warning(
+            NAME,
+            "Unable to determine the registry's time",
+            "Make sure the registry is reachable",
+        );
+    };
+
+    let now = SystemTime::now();
+    let skew = now
+        .duration_since(date)
+        .or_else(|_| date.duration_since(now))
+        .unwrap_or_default();
+
+    if skew > MAX_CLOCK_SKEW {
+        Diagnostic::warning(
+            NAME,
+            format!("The local clock is {skew:.0?} out from the registry's"),
+            "Enable NTP or otherwise synchronise your system clock",
+        )
+    } else {
+        Diagnostic::ok(NAME, format!("Within {skew:.0?} of the registry"))
+    }
+}
@@ -0,0 +1,97 @@
+use std::{fmt::Debug, fs::File, io::BufReader, path::PathBuf};
+
+use anyhow::{Context, Error};
+use clap::{Parser, ValueHint};
+use reqwest::Url;
+use wasmer_borealis::{
+    config::Document,
+    experiment::{import_results, parse_external_outcomes, ExperimentBuilder},
+};
+
+use crate::{run::format_graphql, HttpOptions};
+
+#[derive(Parser)]
+pub struct Import {
+    /// The Wasmer registry the tested packages came from.
+    #[clap(long, default_value = "wasmer.io", env = "WASMER_REGISTRY")]
+    registry: String,
+    #[clap(long, short, env = "WASMER_TOKEN")]
+    token: Option<String>,
+    #[clap(flatten)]
+    http: HttpOptions,
+    /// The experiment the outcomes belong to.
+    #[clap(long, short, value_hint = ValueHint::FilePath)]
+    experiment: PathBuf,
+    /// The directory to save the imported results to.
+    #[clap(short, long, value_hint = ValueHint::DirPath)]
+    output: PathBuf,
+    /// Newline-delimited JSON with one object per test case, each with a
+    /// "package", "version", and "exit-code" (or "timed-out": true), and
+    /// optionally a "run-time-secs", "stdout", and "stderr".
+    #[clap(value_hint = ValueHint::FilePath)]
+    outcomes: PathBuf,
+}
+
+impl Import {
+    #[tracing::instrument(level = "debug", skip_all)]
+    pub fn execute(self) -> Result<(), Error> {
+        let experiment = std::fs::read_to_string(&self.experiment)
+            .with_context(|| format!("Unable to read \"{}\"", self.experiment.display()))?;
+        let Document { experiment, .. } = serde_json::from_str(&experiment)
+            .context("Unable to deserialize the experiment file")?;
+
+        let outcomes = File::open(&self.outcomes)
+            .map(BufReader::new)
+            .map_err(Error::from)
+            .and_then(parse_external_outcomes)
+            .with_context(|| format!("Unable to read \"{}\"", self.outcomes.display()))?;
+
+        // Outcomes are linked to the package versions the experiment would
+        // have run
+        let registry: Url = format_graphql(&self.registry).parse()?;
+        let client = crate::http_client(self.token.as_deref(), &self.http)?;
+        let test_cases = ExperimentBuilder::new(experiment.clone())
+            .with_endpoint(&registry)?
+            .with_client(client)
+            .dry_run()?;
+
+        let results = tokio::runtime::Builder::new_current_thread()
+            .enable_all()
+            .build()?
+            .block_on(import_results(
+                experiment,
+                &registry,
+                &test_cases,
+                outcomes,
+                &self.output,
+            ))?;
+
+        let stdout = std::io::stdout();
+        wasmer_borealis::render::text(&results, &mut stdout.lock())?;
+        println!("Experiment dir: {}", results.experiment_dir.display());
+
+        Ok(())
+    }
+}
+
+impl Debug for Import {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let Import {
+            registry,
+            token,
+            http,
+            experiment,
+            output,
+            outcomes,
+        } = self;
+
+        f.debug_struct("Import")
+            .field("registry", registry)
+            .field("token", &token.as_ref().map(|_| "[REDACTED]"))
+            .field("http", http)
+            .field("experiment", experiment)
+            .field("output", output)
+            .field("outcomes", outcomes)
+            .finish()
+    }
+}
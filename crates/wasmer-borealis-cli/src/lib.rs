@@ -1,13 +1,61 @@
+mod cache;
+mod cancel;
+mod config;
+mod coverage;
+mod doctor;
+mod import;
 mod new;
+mod progress;
+mod prune;
+mod registry;
 mod report;
 mod run;
+mod triage;
+mod version;
 
+use anyhow::Error;
 use directories::ProjectDirs;
 use once_cell::sync::Lazy;
+use reqwest::Client;
+use wasmer_borealis::registry::ClientOptions;
 
-pub use crate::{new::New, report::Report, run::Run};
+pub use crate::{
+    cache::Cache,
+    cancel::Cancel,
+    config::{apply_active_profile, Config},
+    coverage::Coverage,
+    doctor::Doctor,
+    import::Import,
+    new::New,
+    prune::Prune,
+    registry::Registry,
+    report::Report,
+    run::Run,
+    triage::Triage,
+    version::Version,
+};
 
 pub static DIRS: Lazy<ProjectDirs> =
     Lazy::new(|| ProjectDirs::from("io", "wasmer", "borealis").unwrap());
 
-pub const USER_AGENT: &str = concat!(env!("CARGO_PKG_NAME"), "/", env!("CARGO_PKG_VERSION"));
+/// Flags which control how we identify ourselves to the registry.
+#[derive(Debug, Clone, clap::Args)]
+struct HttpOptions {
+    /// Extra text to append to the User-Agent header (e.g. "nightly-ci").
+    #[clap(long, env = "BOREALIS_USER_AGENT_SUFFIX")]
+    user_agent_suffix: Option<String>,
+    /// How the registry's operators can get in touch with you (e.g. an email
+    /// address).
+    #[clap(long, env = "BOREALIS_CONTACT")]
+    contact: Option<String>,
+}
+
+/// Create a HTTP client for talking to the registry, optionally
+/// authenticating with the provided token.
+fn http_client(token: Option<&str>, http: &HttpOptions) -> Result<Client, Error> {
+    wasmer_borealis::registry::http_client(&ClientOptions {
+        token: token.map(String::from),
+        user_agent_suffix: http.user_agent_suffix.clone(),
+        contact: http.contact.clone(),
+    })
+}
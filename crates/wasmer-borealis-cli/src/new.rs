@@ -1,14 +1,18 @@
 use std::{path::PathBuf, str::FromStr};
 
 use anyhow::{Context, Error};
-use clap::Parser;
+use clap::{Parser, ValueHint};
+use indexmap::IndexMap;
 
-use wasmer_borealis::config::{Document, Experiment, Filters, TemplatedString, WasmerConfig};
+use wasmer_borealis::config::{
+    Artifacts, Document, Expectations, Experiment, Filters, Hooks, Limits, Retention,
+    TemplatedString, WasmerConfig,
+};
 
 #[derive(Parser, Debug)]
 pub struct New {
     /// Where to save the experiment file.
-    #[clap(short, long)]
+    #[clap(short, long, value_hint = ValueHint::FilePath)]
     output: Option<PathBuf>,
     /// Extra environment variables to set for the spawned program.
     #[clap(short, long)]
@@ -34,10 +38,24 @@ impl New {
             command: None,
             env: env
                 .into_iter()
-                .map(|EnvironmentVariable { name, value }| (name, value))
+                .map(|EnvironmentVariable { name, value }| (name, value.into()))
                 .collect(),
             wasmer: WasmerConfig::default(),
             filters: Filters::default(),
+            metrics: IndexMap::new(),
+            classifier: None,
+            expect: Expectations::default(),
+            hooks: Hooks::default(),
+            limits: Limits::default(),
+            docker: None,
+            artifacts: Artifacts::default(),
+            unpack_tarball: false,
+            run_unpacked: false,
+            concurrency: None,
+            timeout: None,
+            overrides: IndexMap::new(),
+            max_output_size: None,
+            retention: Retention::default(),
         };
 
         let doc = Document::new(experiment);
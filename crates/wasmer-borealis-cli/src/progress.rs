@@ -0,0 +1,251 @@
+use std::{io::Write, path::Path, time::Duration};
+
+use wasmer_borealis::experiment::{
+    CacheStats, Category, Outcome, Progress, Report, Results, TestCase,
+};
+
+/// How progress should be reported while an experiment is running.
+#[derive(Debug, Default, Copy, Clone, PartialEq, Eq, clap::ValueEnum)]
+pub enum ProgressFormat {
+    /// Don't report progress.
+    #[default]
+    None,
+    /// Emit one JSON object per line to stdout.
+    JsonLines,
+}
+
+/// A [`Progress`] implementation which writes newline-delimited JSON events
+/// to stdout.
+#[derive(Debug, Default)]
+pub struct JsonLines {
+    phase: Phase,
+    counts: Counts,
+}
+
+impl JsonLines {
+    /// Emit the final event once an experiment has finished.
+    pub fn experiment_finished(results: &Results) {
+        let mut counts = Counts::default();
+
+        for report in &results.reports {
+            counts.discovered += 1;
+            counts.record(&report.outcome);
+        }
+
+        emit(&Event::ExperimentFinished {
+            phase: Phase::Finished,
+            counts,
+            total_time_secs: results.total_time.as_secs_f64(),
+            experiment_dir: &results.experiment_dir,
+            cache: results.cache,
+        });
+    }
+}
+
+impl Progress for JsonLines {
+    fn test_case_discovered(&mut self, test_case: TestCase) {
+        self.counts.discovered += 1;
+        emit(&Event::Discovered {
+            phase: self.phase,
+            package: &test_case.display_name(),
+            version: test_case.version(),
+            counts: self.counts,
+        });
+    }
+
+    fn discovery_complete(&mut self) {
+        self.phase = Phase::Running;
+        emit(&Event::DiscoveryComplete {
+            phase: self.phase,
+            counts: self.counts,
+        });
+    }
+
+    fn downloading(&mut self, test_case: TestCase) {
+        emit(&Event::Downloading {
+            phase: self.phase,
+            package: &test_case.display_name(),
+            version: test_case.version(),
+        });
+    }
+
+    fn cache_hit(&mut self, test_case: TestCase) {
+        emit(&Event::CacheHit {
+            phase: self.phase,
+            package: &test_case.display_name(),
+            version: test_case.version(),
+        });
+    }
+
+    fn cache_miss(&mut self, test_case: TestCase, duration: Duration, bytes_downloaded: u64) {
+        emit(&Event::Downloaded {
+            phase: self.phase,
+            package: &test_case.display_name(),
+            version: test_case.version(),
+            duration_secs: duration.as_secs_f64(),
+            bytes_downloaded,
+        });
+    }
+
+    fn test_case_finished(&mut self, report: Report) {
+        self.counts.record(&report.outcome);
+        emit(&Event::Finished {
+            phase: self.phase,
+            package: &report.display_name,
+            version: &report.package_version.version,
+            wasmer: report.wasmer.as_deref(),
+            outcome: &report.outcome,
+            counts: self.counts,
+        });
+    }
+}
+
+#[derive(Debug, Default, Copy, Clone, PartialEq, Eq, serde::Serialize)]
+#[cfg_attr(test, derive(schemars::JsonSchema))]
+#[serde(rename_all = "kebab-case")]
+enum Phase {
+    /// Test cases are still being retrieved from the registry.
+    #[default]
+    Discovering,
+    /// Every test case has been discovered and we are waiting for the
+    /// remaining ones to finish.
+    Running,
+    Finished,
+}
+
+#[derive(Debug, Default, Copy, Clone, PartialEq, Eq, serde::Serialize)]
+#[cfg_attr(test, derive(schemars::JsonSchema))]
+struct Counts {
+    discovered: usize,
+    completed: usize,
+    success: usize,
+    failures: usize,
+    bugs: usize,
+}
+
+impl Counts {
+    fn record(&mut self, outcome: &Outcome) {
+        self.completed += 1;
+
+        match outcome.category() {
+            Category::Success => self.success += 1,
+            Category::Failure => self.failures += 1,
+            Category::Bug => self.bugs += 1,
+        }
+    }
+}
+
+/// The current version of the progress event format.
+///
+/// This only changes when a field is removed or changes meaning. New fields
+/// and events may be added at any time, so consumers should ignore anything
+/// they don't recognise.
+const SCHEMA_VERSION: u32 = 1;
+
+/// The JSON object written for each [`Event`].
+#[derive(Debug, serde::Serialize)]
+#[cfg_attr(test, derive(schemars::JsonSchema))]
+#[serde(rename_all = "kebab-case")]
+struct Envelope<'a> {
+    schema_version: u32,
+    #[serde(flatten)]
+    event: &'a Event<'a>,
+}
+
+#[derive(Debug, serde::Serialize)]
+#[cfg_attr(test, derive(schemars::JsonSchema))]
+#[serde(tag = "event", rename_all = "kebab-case")]
+enum Event<'a> {
+    Discovered {
+        phase: Phase,
+        package: &'a str,
+        version: &'a str,
+        counts: Counts,
+    },
+    DiscoveryComplete {
+        phase: Phase,
+        counts: Counts,
+    },
+    Downloading {
+        phase: Phase,
+        package: &'a str,
+        version: &'a str,
+    },
+    CacheHit {
+        phase: Phase,
+        package: &'a str,
+        version: &'a str,
+    },
+    Downloaded {
+        phase: Phase,
+        package: &'a str,
+        version: &'a str,
+        duration_secs: f64,
+        bytes_downloaded: u64,
+    },
+    Finished {
+        phase: Phase,
+        package: &'a str,
+        version: &'a str,
+        /// The entry from the experiment's `wasmer.matrix` the test case was
+        /// run with.
+        #[serde(skip_serializing_if = "Option::is_none")]
+        wasmer: Option<&'a str>,
+        outcome: &'a Outcome,
+        counts: Counts,
+    },
+    ExperimentFinished {
+        phase: Phase,
+        counts: Counts,
+        total_time_secs: f64,
+        experiment_dir: &'a Path,
+        cache: CacheStats,
+    },
+}
+
+fn emit(event: &Event<'_>) {
+    let stdout = std::io::stdout();
+    let mut stdout = stdout.lock();
+
+    let envelope = Envelope {
+        schema_version: SCHEMA_VERSION,
+        event,
+    };
+
+    let result = serde_json::to_writer(&mut stdout, &envelope)
+        .map_err(std::io::Error::from)
+        .and_then(|_| writeln!(stdout))
+        .and_then(|_| stdout.flush());
+
+    if let Err(e) = result {
+        tracing::warn!(
+            error = &e as &dyn std::error::Error,
+            "Unable to emit a progress event"
+        );
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn progress_schema_is_up_to_date() {
+        let project_root = Path::new(env!("CARGO_MANIFEST_DIR"))
+            .ancestors()
+            .nth(2)
+            .unwrap();
+        let dest = project_root.join("progress.schema.json");
+        let schema = schemars::schema_for!(Envelope<'static>);
+        let schema = serde_json::to_string_pretty(&schema).unwrap();
+
+        let old_schema = std::fs::read_to_string(&dest).unwrap_or_default();
+        if old_schema.replace("\r\n", "\n") != schema {
+            std::fs::write(&dest, schema).unwrap();
+            panic!(
+                "\"{}\" was not up-to-date and has been updated. Please re-run the tests.",
+                dest.display()
+            );
+        }
+    }
+}
@@ -0,0 +1,47 @@
+use std::path::PathBuf;
+
+use anyhow::{Context, Error};
+use clap::ValueHint;
+use wasmer_borealis::experiment::{Pruned, Results};
+
+#[derive(Debug, clap::Parser)]
+pub struct Prune {
+    /// Print what was cleaned up as JSON.
+    #[clap(long)]
+    json: bool,
+    /// The results.json files for each experiment run to clean up.
+    #[clap(required = true, value_hint = ValueHint::FilePath)]
+    results: Vec<PathBuf>,
+}
+
+impl Prune {
+    pub fn execute(self) -> Result<(), Error> {
+        let mut total = Pruned::default();
+
+        for path in &self.results {
+            let raw = std::fs::read_to_string(path)
+                .with_context(|| format!("Unable to read \"{}\"", path.display()))?;
+            let results: Results = serde_json::from_str(&raw)
+                .with_context(|| format!("Unable to parse \"{}\"", path.display()))?;
+
+            let age = results.finished(path)?.elapsed().unwrap_or_default();
+
+            let pruned = wasmer_borealis::experiment::apply_retention(&results, age)?;
+            tracing::debug!(path=%path.display(), ?pruned, "Applied retention rules");
+
+            total.files += pruned.files;
+            total.bytes_freed += pruned.bytes_freed;
+        }
+
+        if self.json {
+            println!("{}", serde_json::to_string_pretty(&total)?);
+        } else {
+            println!(
+                "Truncated {} log files, freeing {} bytes",
+                total.files, total.bytes_freed
+            );
+        }
+
+        Ok(())
+    }
+}
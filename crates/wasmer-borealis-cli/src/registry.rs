@@ -0,0 +1,83 @@
+use std::{fmt::Debug, time::Instant};
+
+use anyhow::{Context, Error};
+use clap::Parser;
+
+use crate::{run::format_graphql, HttpOptions};
+
+#[derive(Parser, Debug)]
+pub struct Registry {
+    #[clap(subcommand)]
+    cmd: RegistryCommand,
+}
+
+impl Registry {
+    pub fn execute(self) -> Result<(), Error> {
+        match self.cmd {
+            RegistryCommand::Check(c) => c.execute(),
+        }
+    }
+}
+
+#[derive(Parser, Debug)]
+enum RegistryCommand {
+    /// Make sure the registry is reachable and the token is valid.
+    Check(Check),
+}
+
+#[derive(Parser)]
+struct Check {
+    /// The Wasmer registry to check.
+    #[clap(long, default_value = "wasmer.io", env = "WASMER_REGISTRY")]
+    registry: String,
+    #[clap(long, short, env = "WASMER_TOKEN")]
+    token: Option<String>,
+    #[clap(flatten)]
+    http: HttpOptions,
+}
+
+impl Check {
+    #[tracing::instrument(level = "debug", skip_all)]
+    fn execute(self) -> Result<(), Error> {
+        let endpoint = format_graphql(&self.registry);
+        let client = crate::http_client(self.token.as_deref(), &self.http)?;
+
+        let start = Instant::now();
+        let username = tokio::runtime::Builder::new_current_thread()
+            .enable_all()
+            .build()?
+            .block_on(wasmer_borealis::registry::whoami(&client, &endpoint))
+            .with_context(|| format!("Unable to query \"{endpoint}\""))?;
+
+        println!(
+            "Endpoint: {endpoint} (responded in {:.1?})",
+            start.elapsed()
+        );
+
+        match username {
+            Some(username) => println!("Authenticated as: {username}"),
+            None if self.token.is_some() => {
+                anyhow::bail!("The registry didn't accept the provided token");
+            }
+            None => println!("Not authenticated (no token provided)"),
+        }
+
+        Ok(())
+    }
+}
+
+impl Debug for Check {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let Check {
+            registry,
+            token,
+            http,
+        } = self;
+
+        f.debug_struct("Check")
+            .field("registry", registry)
+            .field("token", &token.as_ref().map(|_| "[REDACTED]"))
+            .field("http", http)
+            .finish()
+    }
+}
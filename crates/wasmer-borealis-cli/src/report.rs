@@ -1,6 +1,12 @@
-use std::path::PathBuf;
+use std::{
+    path::{Path, PathBuf},
+    time::SystemTime,
+};
 
 use anyhow::{Context, Error};
+use clap::ValueHint;
+use regex::Regex;
+use wasmer_borealis::experiment::{Report as TestCaseReport, Results};
 
 #[derive(Debug, clap::Parser)]
 pub struct Report {
@@ -10,28 +16,91 @@ pub struct Report {
     /// Open the report in the browser (implies --html)
     #[clap(long)]
     open: bool,
-    /// The results.json file generated during an experiment run
-    json: PathBuf,
+    /// Embed each test case's stdout and stderr in the HTML report so it can
+    /// be viewed on another machine (implies --html)
+    #[clap(long)]
+    embed_logs: bool,
+    /// The maximum number of bytes of stdout or stderr to embed per test case
+    #[clap(long, default_value_t = 64 * 1024, requires = "embed_logs")]
+    max_log_size: usize,
+    /// Instead of printing a summary, list every line of stdout or stderr
+    /// matching this regular expression (e.g. "panicked at")
+    #[clap(long)]
+    search: Option<Regex>,
+    /// Compare several experiments, showing each package's outcome side by
+    /// side
+    #[clap(long, conflicts_with_all = ["html", "open", "embed_logs", "search"])]
+    matrix: bool,
+    /// Print an RSS feed of notable changes (new namespaces, packages which
+    /// started failing, etc.) across several experiments, oldest first
+    #[clap(long, conflicts_with_all = ["html", "open", "embed_logs", "search", "matrix"])]
+    feed: bool,
+    /// The registry website items in the feed should link to
+    #[clap(long, default_value = "https://wasmer.io", requires = "feed")]
+    feed_link: String,
+    /// Show the results as they were at a particular time (e.g.
+    /// "2023-09-01T12:00:00Z"), ignoring any triage done since
+    #[clap(long, value_parser = humantime::parse_rfc3339_weak)]
+    as_of: Option<SystemTime>,
+    /// The results.json file generated during an experiment run (or several,
+    /// when using --matrix or --feed)
+    #[clap(required = true, value_hint = ValueHint::FilePath)]
+    json: Vec<PathBuf>,
 }
 
 impl Report {
     pub fn execute(self) -> Result<(), Error> {
-        let raw = std::fs::read_to_string(&self.json)?;
-        let results: wasmer_borealis::experiment::Results = serde_json::from_str(&raw)?;
+        if self.matrix {
+            let results = self
+                .json
+                .iter()
+                .map(|path| load(path, self.as_of))
+                .collect::<Result<Vec<_>, Error>>()?;
+            wasmer_borealis::render::matrix(&results, std::io::stdout())?;
+            return Ok(());
+        }
+
+        if self.feed {
+            let results = self
+                .json
+                .iter()
+                .map(|path| {
+                    let results = load(path, self.as_of)?;
+                    Ok((results.finished(path)?, results))
+                })
+                .collect::<Result<Vec<_>, Error>>()?;
+            wasmer_borealis::render::rss(&results, &self.feed_link, std::io::stdout())?;
+            return Ok(());
+        }
+
+        let json = match self.json.as_slice() {
+            [json] => json,
+            _ => anyhow::bail!(
+                "Only one results.json can be provided unless --matrix or --feed is used"
+            ),
+        };
+        let results = load(json, self.as_of)?;
 
-        wasmer_borealis::render::text(&results, std::io::stdout())?;
+        match &self.search {
+            Some(pattern) => search(&results, pattern)?,
+            None => wasmer_borealis::render::text(&results, std::io::stdout())?,
+        }
 
-        if self.open || self.html.is_some() {
+        if self.open || self.embed_logs || self.html.is_some() {
             let html = self
                 .html
-                .or_else(|| Some(self.json.parent()?.join("report.html")))
+                .or_else(|| Some(json.parent()?.join("report.html")))
                 .context("Unable to determine the html path")?;
 
             if let Some(parent) = html.parent() {
                 std::fs::create_dir_all(parent)?;
             }
 
-            let rendered = wasmer_borealis::render::html(&results)?;
+            let rendered = if self.embed_logs {
+                wasmer_borealis::render::standalone_html(&results, self.max_log_size)?
+            } else {
+                wasmer_borealis::render::html(&results)?
+            };
             std::fs::write(&html, rendered)?;
 
             if self.open {
@@ -42,3 +111,77 @@ impl Report {
         Ok(())
     }
 }
+
+fn load(path: &Path, as_of: Option<SystemTime>) -> Result<Results, Error> {
+    let raw = std::fs::read_to_string(path)
+        .with_context(|| format!("Unable to read \"{}\"", path.display()))?;
+    let mut results = serde_json::from_str(&raw)
+        .with_context(|| format!("Unable to parse \"{}\"", path.display()))?;
+
+    if let Some(as_of) = as_of {
+        wasmer_borealis::experiment::history::rewind(&mut results, path, as_of)?;
+    }
+
+    Ok(results)
+}
+
+/// Print every line of output from the experiment's test cases which matches
+/// a pattern.
+fn search(results: &Results, pattern: &Regex) -> Result<(), Error> {
+    let mut matching_test_cases = 0;
+
+    for report in &results.reports {
+        let matches = matching_lines(report, pattern)?;
+
+        for (filename, line_number, line) in &matches {
+            println!(
+                "{}@{} {filename}:{line_number}: {line}",
+                report.display_name, report.package_version.version,
+            );
+        }
+
+        if !matches.is_empty() {
+            matching_test_cases += 1;
+        }
+    }
+
+    println!(
+        "{matching_test_cases} of {} test cases matched",
+        results.reports.len()
+    );
+
+    Ok(())
+}
+
+/// Find every line in a test case's stdout or stderr which matches a pattern,
+/// returning the filename, line number, and line.
+pub(crate) fn matching_lines(
+    report: &TestCaseReport,
+    pattern: &Regex,
+) -> Result<Vec<(&'static str, usize, String)>, Error> {
+    let mut matches = Vec::new();
+
+    let Some(base_dir) = report.outcome.base_dir() else {
+        return Ok(matches);
+    };
+
+    for filename in ["stdout.txt", "stderr.txt"] {
+        let path = base_dir.join(filename);
+        let contents = match std::fs::read(&path) {
+            Ok(contents) => contents,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => continue,
+            Err(e) => {
+                return Err(Error::new(e).context(format!("Unable to read \"{}\"", path.display())))
+            }
+        };
+        let contents = String::from_utf8_lossy(&contents);
+
+        for (i, line) in contents.lines().enumerate() {
+            if pattern.is_match(line) {
+                matches.push((filename, i + 1, line.to_string()));
+            }
+        }
+    }
+
+    Ok(matches)
+}
@@ -1,21 +1,105 @@
-use std::path::PathBuf;
+use std::{fmt::Debug, num::NonZeroUsize, path::PathBuf, time::Duration};
 
 use anyhow::{Context, Error};
-use clap::Parser;
-use reqwest::{header::HeaderMap, Client, ClientBuilder, Url};
-use wasmer_borealis::{config::Document, experiment::ExperimentBuilder};
+use clap::{Parser, ValueHint};
+use reqwest::Url;
+use sha2::{Digest, Sha256};
+use wasmer_borealis::{
+    config::{Document, Experiment},
+    experiment::{
+        find_duplicates, matrix_builds, wasmer_build, ExperimentBuilder, Results, TestCase,
+    },
+    registry::{Faults, Politeness},
+};
 
-#[derive(Parser, Debug)]
+use crate::{
+    progress::{JsonLines, ProgressFormat},
+    HttpOptions,
+};
+
+#[derive(Parser)]
 pub struct Run {
     /// The Wasmer registry to query packages from.
     #[clap(long, default_value = "wasmer.io", env = "WASMER_REGISTRY")]
     registry: String,
     #[clap(long, short, env = "WASMER_TOKEN")]
     token: Option<String>,
+    #[clap(flatten)]
+    http: HttpOptions,
     /// A directory all experiment-related files will be written to.
     #[clap(short, long)]
     output: Option<PathBuf>,
+    /// How to report progress while the experiment is running.
+    // Note: `--output` is already taken by the experiment directory
+    #[clap(
+        long,
+        alias = "progress",
+        value_enum,
+        env = "BOREALIS_OUTPUT_FORMAT",
+        default_value_t = ProgressFormat::None
+    )]
+    output_format: ProgressFormat,
+    /// The maximum number of packages to download at the same time (defaults
+    /// to the number of CPUs).
+    #[clap(long, env = "BOREALIS_MAX_CONCURRENT_DOWNLOADS")]
+    max_concurrent_downloads: Option<NonZeroUsize>,
+    /// The maximum number of test cases to run at the same time (defaults to
+    /// the experiment's `concurrency` field, or the number of CPUs).
+    #[clap(long, env = "BOREALIS_CONCURRENCY")]
+    concurrency: Option<NonZeroUsize>,
+    /// Keep cached packages separate from other profiles' (defaults to a
+    /// hash of the token, if one was provided).
+    #[clap(long, env = "BOREALIS_CACHE_PROFILE")]
+    cache_profile: Option<String>,
+    /// The maximum number of requests per second to send to the registry.
+    #[clap(long, env = "BOREALIS_MAX_REQUESTS_PER_SECOND")]
+    max_requests_per_second: Option<f64>,
+    /// The maximum number of requests to the registry that can be in flight
+    /// at once.
+    #[clap(long, env = "BOREALIS_MAX_CONCURRENT_REQUESTS")]
+    max_concurrent_requests: Option<NonZeroUsize>,
+    /// Where downloaded packages are cached.
+    #[clap(long, env = "BOREALIS_CACHE_DIR", value_hint = ValueHint::DirPath)]
+    cache_dir: Option<PathBuf>,
+    /// A cache shared with other machines (e.g. on a network drive), which
+    /// is checked before downloading from the registry.
+    #[clap(long, env = "BOREALIS_SHARED_CACHE_DIR", value_hint = ValueHint::DirPath)]
+    shared_cache_dir: Option<PathBuf>,
+    /// Run test cases in a random order, using this seed so the order can be
+    /// reproduced.
+    #[clap(long)]
+    shuffle_seed: Option<u64>,
+    /// Save partial results after this many test cases complete.
+    #[clap(long)]
+    snapshot_every: Option<NonZeroUsize>,
+    /// (Testing only) Make this fraction of downloads fail, between 0 and 1.
+    #[clap(
+        long,
+        hide = true,
+        env = "BOREALIS_INJECT_DOWNLOAD_FAILURES",
+        value_parser = parse_rate
+    )]
+    inject_download_failures: Option<f64>,
+    /// (Testing only) Delay every request to the registry by this many
+    /// milliseconds.
+    #[clap(long, hide = true, env = "BOREALIS_INJECT_DELAY_MS")]
+    inject_delay_ms: Option<u64>,
+    /// If this experiment has already been run with the same `wasmer` CLI,
+    /// reuse the most recent results instead of running it again.
+    #[clap(long, conflicts_with = "allow_duplicates")]
+    reuse_results: bool,
+    /// Don't check whether this experiment has already been run.
+    #[clap(long, env = "BOREALIS_ALLOW_DUPLICATES")]
+    allow_duplicates: bool,
+    /// Print the package versions this experiment would run, without
+    /// downloading or running anything.
+    #[clap(long)]
+    dry_run: bool,
+    /// Print the dry run's package versions as JSON.
+    #[clap(long, requires = "dry_run")]
+    json: bool,
     /// The experiment to run.
+    #[clap(value_hint = ValueHint::FilePath)]
     experiment: PathBuf,
 }
 
@@ -27,9 +111,20 @@ impl Run {
         let Document { experiment, .. } = serde_json::from_str(&experiment)
             .context("Unable to deserialize the experiment file")?;
 
+        if !self.allow_duplicates && !self.dry_run {
+            if let Some(previous) = self.check_for_duplicates(&experiment)? {
+                let raw = std::fs::read_to_string(&previous)
+                    .with_context(|| format!("Unable to read \"{}\"", previous.display()))?;
+                let results: Results = serde_json::from_str(&raw)
+                    .with_context(|| format!("Unable to parse \"{}\"", previous.display()))?;
+                tracing::info!(path=%previous.display(), "Reusing previous results");
+                return print_results(self.output_format, &results);
+            }
+        }
+
         let url = format_graphql(&self.registry);
 
-        let client = self.client()?;
+        let client = crate::http_client(self.token.as_deref(), &self.http)?;
         let mut builder = ExperimentBuilder::new(experiment)
             .with_endpoint(url)?
             .with_client(client);
@@ -38,35 +133,233 @@ impl Run {
             builder = builder.with_experiment_dir(output);
         }
 
-        let results = builder.run()?;
+        if let Some(cache_dir) = self.cache_dir {
+            builder = builder.with_cache_dir(cache_dir);
+        }
+
+        if let Some(shared_cache_dir) = self.shared_cache_dir {
+            builder = builder.with_shared_cache_dir(shared_cache_dir);
+        }
+
+        if let Some(max_concurrent_downloads) = self.max_concurrent_downloads {
+            builder = builder.with_max_concurrent_downloads(max_concurrent_downloads);
+        }
+
+        if let Some(concurrency) = self.concurrency {
+            builder = builder.with_concurrency(concurrency);
+        }
+
+        if self.max_requests_per_second.is_some() || self.max_concurrent_requests.is_some() {
+            let defaults = Politeness::default();
+            builder = builder.with_politeness(Politeness {
+                max_requests_per_second: self
+                    .max_requests_per_second
+                    .unwrap_or(defaults.max_requests_per_second),
+                max_concurrent_requests: self
+                    .max_concurrent_requests
+                    .map_or(defaults.max_concurrent_requests, NonZeroUsize::get),
+                ..defaults
+            });
+        }
+
+        if self.dry_run {
+            let test_cases = builder.dry_run()?;
+            return print_test_cases(self.json, &test_cases);
+        }
+
+        if let Some(seed) = self.shuffle_seed {
+            builder = builder.with_shuffle_seed(seed);
+        }
+
+        if let Some(snapshot_every) = self.snapshot_every {
+            builder = builder.with_snapshot_every(snapshot_every);
+        }
+
+        if self.inject_download_failures.is_some() || self.inject_delay_ms.is_some() {
+            builder = builder.with_faults(Faults {
+                download_failure_rate: self.inject_download_failures.unwrap_or_default(),
+                delay: Duration::from_millis(self.inject_delay_ms.unwrap_or_default()),
+            });
+        }
+
+        let cache_profile = self
+            .cache_profile
+            .or_else(|| self.token.as_deref().map(token_profile));
+        if let Some(profile) = cache_profile {
+            builder = builder.with_cache_profile(profile);
+        }
+
+        if self.output_format == ProgressFormat::JsonLines {
+            builder = builder.with_progress(JsonLines::default());
+        }
 
-        let stdout = std::io::stdout();
-        wasmer_borealis::render::text(&results, &mut stdout.lock())?;
-        println!("Experiment dir: {}", results.experiment_dir.display());
+        let results = builder.run()?;
 
-        Ok(())
+        print_results(self.output_format, &results)
     }
 
-    fn client(&self) -> Result<Client, Error> {
-        let builder = ClientBuilder::new();
-        let mut headers = HeaderMap::new();
+    /// Look for previous runs of this experiment which used the same `wasmer`
+    /// CLIs, returning the most recent one's `results.json` if they should be
+    /// reused.
+    fn check_for_duplicates(&self, experiment: &Experiment) -> Result<Option<PathBuf>, Error> {
+        // Runs are normally saved next to each other
+        let runs_dir = match &self.output {
+            Some(output) => match output.parent() {
+                Some(parent) if !parent.as_os_str().is_empty() => parent.to_path_buf(),
+                _ => PathBuf::from("."),
+            },
+            None => wasmer_borealis::DIRS.data_local_dir().to_path_buf(),
+        };
 
-        headers.insert(
-            reqwest::header::USER_AGENT,
-            crate::USER_AGENT.parse().unwrap(),
+        let rt = tokio::runtime::Builder::new_current_thread()
+            .enable_all()
+            .build()?;
+        let cache_dir = self
+            .cache_dir
+            .clone()
+            .unwrap_or_else(|| wasmer_borealis::DIRS.cache_dir().to_path_buf());
+        // Only the wasmer CLIs we already have are checked, because it isn't
+        // worth downloading a release just to see whether it was used before
+        let builds = rt.block_on(async {
+            let wasmer = wasmer_build(experiment, &cache_dir).await?;
+            let matrix = matrix_builds(experiment, &cache_dir).await?;
+            Ok::<_, Error>(wasmer.zip(matrix))
+        });
+        let (wasmer, matrix) = match builds {
+            Ok(Some(builds)) => builds,
+            Ok(None) => {
+                tracing::debug!(
+                    "The experiment's wasmer CLIs haven't been downloaded yet, so it can't be a \
+                     duplicate",
+                );
+                return Ok(None);
+            }
+            Err(e) => {
+                tracing::debug!(
+                    error = &*e,
+                    "Unable to determine the wasmer CLI's version, so can't check for duplicates",
+                );
+                return Ok(None);
+            }
+        };
+
+        let registry: Url = format_graphql(&self.registry).parse()?;
+        let duplicates = find_duplicates(experiment, &wasmer, &matrix, &registry, &runs_dir)?;
+        let Some(latest) = duplicates.first() else {
+            return Ok(None);
+        };
+
+        if self.reuse_results {
+            return Ok(Some(latest.results.clone()));
+        }
+
+        tracing::warn!(
+            previous_runs = duplicates.len(),
+            latest = %latest.results.display(),
+            wasmer = %wasmer.version,
+            "This experiment has already been run with the same wasmer CLIs. Use \
+             --reuse-results to reuse those results or --allow-duplicates to silence this \
+             warning",
         );
 
-        if let Some(token) = self.token.as_deref() {
-            let auth_header = format!("bearer {token}").parse()?;
-            headers.append(reqwest::header::AUTHORIZATION, auth_header);
+        Ok(None)
+    }
+}
+
+fn print_results(output_format: ProgressFormat, results: &Results) -> Result<(), Error> {
+    match output_format {
+        ProgressFormat::JsonLines => JsonLines::experiment_finished(results),
+        ProgressFormat::None => {
+            let stdout = std::io::stdout();
+            wasmer_borealis::render::text(results, &mut stdout.lock())?;
+            println!("Experiment dir: {}", results.experiment_dir.display());
         }
+    }
 
-        let client = builder.default_headers(headers).build()?;
+    Ok(())
+}
 
-        Ok(client)
+fn print_test_cases(json: bool, test_cases: &[TestCase]) -> Result<(), Error> {
+    if json {
+        println!("{}", serde_json::to_string_pretty(test_cases)?);
+    } else {
+        for test_case in test_cases {
+            println!("{}@{}", test_case.display_name(), test_case.version());
+        }
+        println!("{} test cases", test_cases.len());
+    }
+
+    Ok(())
+}
+
+impl Debug for Run {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let Run {
+            registry,
+            token,
+            http,
+            output,
+            output_format,
+            max_concurrent_downloads,
+            concurrency,
+            cache_profile,
+            max_requests_per_second,
+            max_concurrent_requests,
+            cache_dir,
+            shared_cache_dir,
+            shuffle_seed,
+            snapshot_every,
+            inject_download_failures,
+            inject_delay_ms,
+            reuse_results,
+            allow_duplicates,
+            dry_run,
+            json,
+            experiment,
+        } = self;
+
+        f.debug_struct("Run")
+            .field("registry", registry)
+            .field("token", &token.as_ref().map(|_| "[REDACTED]"))
+            .field("http", http)
+            .field("output", output)
+            .field("output_format", output_format)
+            .field("max_concurrent_downloads", max_concurrent_downloads)
+            .field("concurrency", concurrency)
+            .field("cache_profile", cache_profile)
+            .field("max_requests_per_second", max_requests_per_second)
+            .field("max_concurrent_requests", max_concurrent_requests)
+            .field("cache_dir", cache_dir)
+            .field("shared_cache_dir", shared_cache_dir)
+            .field("shuffle_seed", shuffle_seed)
+            .field("snapshot_every", snapshot_every)
+            .field("inject_download_failures", inject_download_failures)
+            .field("inject_delay_ms", inject_delay_ms)
+            .field("reuse_results", reuse_results)
+            .field("allow_duplicates", allow_duplicates)
+            .field("dry_run", dry_run)
+            .field("json", json)
+            .field("experiment", experiment)
+            .finish()
     }
 }
 
+fn parse_rate(s: &str) -> Result<f64, String> {
+    let rate: f64 = s.parse().map_err(|e| format!("{e}"))?;
+
+    if (0.0..=1.0).contains(&rate) {
+        Ok(rate)
+    } else {
+        Err(format!("{rate} isn't between 0 and 1"))
+    }
+}
+
+/// Derive a cache profile from a token without revealing the token itself.
+fn token_profile(token: &str) -> String {
+    let hash = format!("{:x}", Sha256::digest(token));
+    hash[..16].to_string()
+}
+
 pub fn format_graphql(registry: &str) -> String {
     if let Ok(mut url) = Url::parse(registry) {
         // Looks like we've got a valid URL. Let's try to use it as-is.
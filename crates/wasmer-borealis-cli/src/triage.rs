@@ -0,0 +1,206 @@
+use std::{path::PathBuf, str::FromStr, time::SystemTime};
+
+use anyhow::{Context, Error};
+use clap::ValueHint;
+use regex::Regex;
+use wasmer_borealis::experiment::{
+    history::Change, Category, Report, Results, Triage as TriageInfo, TriageState,
+};
+
+#[derive(Debug, clap::Parser)]
+pub struct Triage {
+    /// The results.json file generated during an experiment run
+    #[clap(value_hint = ValueHint::FilePath)]
+    json: PathBuf,
+    /// The test cases to update (e.g. "wasmer/python", "wasmer/python@3.12.0",
+    /// or "wasmer/*")
+    test_cases: Option<Selector>,
+    /// Only update test cases in this category
+    #[clap(long, value_enum)]
+    category: Option<CategoryArg>,
+    /// Only update test cases where a line of stdout or stderr matches this
+    /// regular expression (e.g. "panicked at")
+    #[clap(long)]
+    output: Option<Regex>,
+    /// Where the investigation is up to (untriaged, expected, bug-filed, or
+    /// fixed)
+    #[clap(long)]
+    state: Option<TriageState>,
+    /// Who is looking into these test cases
+    #[clap(long)]
+    assignee: Option<String>,
+    /// Free-form notes (e.g. a link to the bug report)
+    #[clap(long)]
+    note: Option<String>,
+}
+
+impl Triage {
+    pub fn execute(self) -> Result<(), Error> {
+        anyhow::ensure!(
+            self.test_cases.is_some() || self.category.is_some() || self.output.is_some(),
+            "Please specify which test cases to triage"
+        );
+
+        let raw = std::fs::read_to_string(&self.json)
+            .with_context(|| format!("Unable to read \"{}\"", self.json.display()))?;
+        let mut results: Results = serde_json::from_str(&raw)?;
+
+        let mut updated = 0;
+        let mut changes = Vec::new();
+        let timestamp = SystemTime::now();
+
+        for report in &mut results.reports {
+            if !self.matches(report)? {
+                continue;
+            }
+
+            let before = report.triage.clone();
+
+            let triage = report.triage.get_or_insert_with(|| TriageInfo {
+                state: TriageState::default(),
+                assignee: None,
+                note: None,
+            });
+
+            if let Some(state) = self.state {
+                triage.state = state;
+            }
+            if let Some(assignee) = &self.assignee {
+                triage.assignee = Some(assignee.clone());
+            }
+            if let Some(note) = &self.note {
+                triage.note = Some(note.clone());
+            }
+
+            println!(
+                "{}@{}: {}",
+                report.display_name,
+                report.package_version.version,
+                triage.state.as_str()
+            );
+
+            if report.triage != before {
+                changes.push(Change {
+                    timestamp,
+                    display_name: report.display_name.clone(),
+                    version: report.package_version.version.clone(),
+                    wasmer: report.wasmer.clone(),
+                    before,
+                    after: report.triage.clone(),
+                });
+            }
+
+            updated += 1;
+        }
+
+        anyhow::ensure!(updated > 0, "No test cases matched");
+        println!("Updated {updated} test cases");
+
+        // If we can't record the changes, results.json must stay untouched
+        // or they could never be rewound
+        wasmer_borealis::experiment::history::record_changes(&self.json, &changes)?;
+        save(&self.json, &results)
+    }
+
+    fn matches(&self, report: &Report) -> Result<bool, Error> {
+        if let Some(selector) = &self.test_cases {
+            if !selector.matches(report) {
+                return Ok(false);
+            }
+        }
+
+        if let Some(category) = self.category {
+            if report.outcome.category() != Category::from(category) {
+                return Ok(false);
+            }
+        }
+
+        if let Some(pattern) = &self.output {
+            if crate::report::matching_lines(report, pattern)?.is_empty() {
+                return Ok(false);
+            }
+        }
+
+        Ok(true)
+    }
+}
+
+/// Write the updated results back to disk, regenerating the HTML report that
+/// sits alongside them.
+fn save(json: &std::path::Path, results: &Results) -> Result<(), Error> {
+    let serialized = serde_json::to_string_pretty(results)?;
+    std::fs::write(json, serialized)
+        .with_context(|| format!("Unable to save to \"{}\"", json.display()))?;
+
+    if let Some(parent) = json.parent() {
+        let html = parent.join("report.html");
+        let rendered = wasmer_borealis::render::html(results)?;
+        std::fs::write(&html, rendered)
+            .with_context(|| format!("Unable to save to \"{}\"", html.display()))?;
+    }
+
+    Ok(())
+}
+
+#[derive(Debug, Copy, Clone, PartialEq, Eq, clap::ValueEnum)]
+enum CategoryArg {
+    Success,
+    Failure,
+    Bug,
+}
+
+impl From<CategoryArg> for Category {
+    fn from(value: CategoryArg) -> Self {
+        match value {
+            CategoryArg::Success => Category::Success,
+            CategoryArg::Failure => Category::Failure,
+            CategoryArg::Bug => Category::Bug,
+        }
+    }
+}
+
+/// A pattern matching some of the test cases in an experiment, where `*`
+/// matches any sequence of characters.
+#[derive(Debug, Clone)]
+struct Selector {
+    package: Regex,
+    version: Option<Regex>,
+}
+
+impl Selector {
+    fn matches(&self, report: &Report) -> bool {
+        self.package.is_match(&report.display_name)
+            && self
+                .version
+                .as_ref()
+                .map_or(true, |v| v.is_match(&report.package_version.version))
+    }
+}
+
+impl FromStr for Selector {
+    type Err = Error;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let (package, version) = match s.split_once('@') {
+            Some((package, version)) => (package, Some(version)),
+            None => (s, None),
+        };
+
+        anyhow::ensure!(
+            package.contains('/'),
+            "Expected a package name like \"namespace/package\""
+        );
+
+        Ok(Selector {
+            package: glob(package)?,
+            version: version.map(glob).transpose()?,
+        })
+    }
+}
+
+/// Turn a pattern containing `*` wildcards into an anchored [`Regex`].
+fn glob(pattern: &str) -> Result<Regex, Error> {
+    let escaped = regex::escape(pattern).replace(r"\*", ".*");
+    let re = Regex::new(&format!("^{escaped}$"))?;
+    Ok(re)
+}
@@ -0,0 +1,65 @@
+use anyhow::Error;
+use clap::Parser;
+
+#[derive(Parser, Debug)]
+pub struct Version {
+    /// How the build information should be printed.
+    #[clap(long, value_enum, default_value_t = Format::Text)]
+    format: Format,
+}
+
+impl Version {
+    pub fn execute(self) -> Result<(), Error> {
+        let info = BuildInfo::current();
+
+        match self.format {
+            Format::Text => {
+                println!("{} {}", env!("CARGO_PKG_NAME"), info.version);
+                if let Some(commit) = info.git_commit {
+                    println!("commit: {commit}");
+                }
+                println!("build date: {}", info.build_date);
+                println!("rustc: {}", info.rustc);
+                if !info.features.is_empty() {
+                    println!("features: {}", info.features.join(", "));
+                }
+            }
+            Format::Json => println!("{}", serde_json::to_string_pretty(&info)?),
+        }
+
+        Ok(())
+    }
+}
+
+#[derive(Debug, Copy, Clone, PartialEq, Eq, clap::ValueEnum)]
+enum Format {
+    Text,
+    Json,
+}
+
+/// Information about this particular build of `wasmer-borealis`, as recorded
+/// by the build script.
+#[derive(Debug, serde::Serialize)]
+#[serde(rename_all = "kebab-case")]
+struct BuildInfo {
+    version: &'static str,
+    git_commit: Option<&'static str>,
+    build_date: &'static str,
+    rustc: &'static str,
+    features: Vec<&'static str>,
+}
+
+impl BuildInfo {
+    fn current() -> Self {
+        BuildInfo {
+            version: env!("CARGO_PKG_VERSION"),
+            git_commit: option_env!("BOREALIS_GIT_COMMIT"),
+            build_date: env!("BOREALIS_BUILD_DATE"),
+            rustc: env!("BOREALIS_RUSTC_VERSION"),
+            features: env!("BOREALIS_FEATURES")
+                .split(',')
+                .filter(|f| !f.is_empty())
+                .collect(),
+        }
+    }
+}
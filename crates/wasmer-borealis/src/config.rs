@@ -1,8 +1,10 @@
 use std::{
     borrow::Cow,
+    num::NonZeroUsize,
     path::{Path, PathBuf},
 };
 
+use anyhow::{Context, Error};
 use indexmap::IndexMap;
 use semver::Version;
 
@@ -53,11 +55,344 @@ pub struct Experiment {
     pub args: Vec<TemplatedString>,
     /// Environment variables that should be set for the package.
     #[serde(default, skip_serializing_if = "IndexMap::is_empty")]
-    pub env: IndexMap<String, TemplatedString>,
+    pub env: IndexMap<String, EnvValue>,
     #[serde(default, skip_serializing_if = "should_show_wasmer_config")]
     pub wasmer: WasmerConfig,
     #[serde(default, skip_serializing_if = "Filters::is_empty")]
     pub filters: Filters,
+    /// Values to extract from the JSON a package prints to stdout, keyed by
+    /// metric name.
+    ///
+    /// Each value is a JSON Pointer (e.g. `/summary/passed`) which will be
+    /// looked up in the package's output.
+    #[serde(default, skip_serializing_if = "IndexMap::is_empty")]
+    pub metrics: IndexMap<String, String>,
+    /// A package which will be used to decide whether each test case passed
+    /// or failed, instead of relying on the exit code.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub classifier: Option<Classifier>,
+    /// How each test case is expected to behave. A test case which doesn't
+    /// meet these expectations fails, even if `wasmer` exited successfully.
+    #[serde(default, skip_serializing_if = "Expectations::is_empty")]
+    pub expect: Expectations,
+    #[serde(default, skip_serializing_if = "Hooks::is_empty")]
+    pub hooks: Hooks,
+    #[serde(default, skip_serializing_if = "Limits::is_empty")]
+    pub limits: Limits,
+    /// Run each test case inside a short-lived Docker container instead of
+    /// directly on the host (e.g. because the packages aren't trusted).
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub docker: Option<DockerConfig>,
+    /// Which of each package's artifacts should be downloaded and made
+    /// available to the experiment.
+    #[serde(default, skip_serializing_if = "Artifacts::is_all")]
+    pub artifacts: Artifacts,
+    /// Extract each package's tarball into `$FIXTURES_DIR/package/` so the
+    /// experiment can use its `wasmer.toml` and source files directly.
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub unpack_tarball: bool,
+    /// Instead of running `package`, run each package's own command straight
+    /// from its unpacked tarball, using the module and arguments from its
+    /// `wasmer.toml`. Requires `unpack-tarball`.
+    ///
+    /// The entrypoint is used unless `command` picks a different one.
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub run_unpacked: bool,
+    /// The maximum number of test cases to run at the same time (defaults to
+    /// the number of CPUs).
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub concurrency: Option<NonZeroUsize>,
+    /// The maximum number of seconds a test case can run for before it is
+    /// killed.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub timeout: Option<u64>,
+    /// Per-package changes to the experiment, keyed by package name (e.g.
+    /// `wasmer/python`).
+    #[serde(default, skip_serializing_if = "IndexMap::is_empty")]
+    pub overrides: IndexMap<String, Override>,
+    /// The maximum number of bytes to save from each test case's stdout and
+    /// stderr. Anything after that is discarded.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_output_size: Option<u64>,
+    #[serde(default, skip_serializing_if = "Retention::is_empty")]
+    pub retention: Retention,
+}
+
+impl Experiment {
+    /// The experiment with any [`Override`]s for a particular package (e.g.
+    /// `wasmer/python`) applied.
+    pub fn for_package(&self, package: &str) -> Cow<'_, Experiment> {
+        let Some(Override {
+            command,
+            args,
+            env,
+            expect,
+            timeout,
+        }) = self.overrides.get(package)
+        else {
+            return Cow::Borrowed(self);
+        };
+
+        let mut experiment = self.clone();
+
+        if let Some(command) = command {
+            experiment.command = Some(command.clone());
+        }
+        if let Some(args) = args {
+            experiment.args = args.clone();
+        }
+        experiment
+            .env
+            .extend(env.iter().map(|(k, v)| (k.clone(), v.clone())));
+        if let Some(exit_code) = expect.exit_code {
+            experiment.expect.exit_code = Some(exit_code);
+        }
+        if !expect.stdout.is_empty() {
+            experiment.expect.stdout = expect.stdout.clone();
+        }
+        if !expect.stderr.is_empty() {
+            experiment.expect.stderr = expect.stderr.clone();
+        }
+        if let Some(timeout) = timeout {
+            experiment.timeout = Some(*timeout);
+        }
+
+        Cow::Owned(experiment)
+    }
+}
+
+/// Changes to an [`Experiment`] which only apply to a particular package.
+#[derive(Debug, Default, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+#[cfg_attr(test, derive(schemars::JsonSchema))]
+#[serde(rename_all = "kebab-case", deny_unknown_fields)]
+pub struct Override {
+    /// Run a different command.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub command: Option<String>,
+    /// Replace the experiment's arguments.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub args: Option<Vec<TemplatedString>>,
+    /// Environment variables to set, in addition to (or instead of) the
+    /// experiment's.
+    #[serde(default, skip_serializing_if = "IndexMap::is_empty")]
+    pub env: IndexMap<String, EnvValue>,
+    /// Expectations which replace the experiment's. The `stdout` and `stderr`
+    /// sections are replaced as a whole.
+    #[serde(default, skip_serializing_if = "Expectations::is_empty")]
+    pub expect: Expectations,
+    /// Give the package more (or less) time than the experiment's `timeout`.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub timeout: Option<u64>,
+}
+
+/// The forms a package can be distributed in.
+#[derive(Debug, Default, Copy, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+#[cfg_attr(test, derive(schemars::JsonSchema))]
+#[serde(rename_all = "kebab-case")]
+pub enum Artifacts {
+    /// The tarball, plus the webc file if the package has one.
+    #[default]
+    All,
+    /// Only the webc file. Packages without one will be skipped.
+    Webc,
+    /// Only the tarball.
+    Tarball,
+}
+
+impl Artifacts {
+    fn is_all(&self) -> bool {
+        matches!(self, Artifacts::All)
+    }
+
+    pub fn wants_tarball(self) -> bool {
+        matches!(self, Artifacts::All | Artifacts::Tarball)
+    }
+
+    pub fn wants_webc(self) -> bool {
+        matches!(self, Artifacts::All | Artifacts::Webc)
+    }
+}
+
+/// Commands that are run on the host around each test case.
+///
+/// Each hook is a program followed by its arguments, and is run from the test
+/// case's directory with access to the same variables as the `wasmer` CLI.
+#[derive(Debug, Default, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+#[cfg_attr(test, derive(schemars::JsonSchema))]
+#[serde(rename_all = "kebab-case", deny_unknown_fields)]
+pub struct Hooks {
+    /// A command to run before each test case (e.g. to start a service).
+    ///
+    /// The test case will be marked as a bug if this fails.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub before_each: Vec<TemplatedString>,
+    /// A command to run after each test case (e.g. to collect diagnostics).
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub after_each: Vec<TemplatedString>,
+}
+
+impl Hooks {
+    fn is_empty(&self) -> bool {
+        self.before_each.is_empty() && self.after_each.is_empty()
+    }
+}
+
+/// Resource limits applied to the `wasmer` CLI for each test case.
+///
+/// Limits are only enforced on Unix.
+#[derive(Debug, Default, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+#[cfg_attr(test, derive(schemars::JsonSchema))]
+#[serde(rename_all = "kebab-case", deny_unknown_fields)]
+pub struct Limits {
+    /// The maximum number of seconds of CPU time a test case can use.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub cpu_seconds: Option<u64>,
+    /// The maximum amount of memory a test case can allocate, in megabytes.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub memory_mb: Option<u64>,
+}
+
+impl Limits {
+    pub fn is_empty(&self) -> bool {
+        self.cpu_seconds.is_none() && self.memory_mb.is_none()
+    }
+}
+
+/// How to run the `wasmer` CLI inside a Docker container.
+///
+/// The test case's directory is mounted into the container at the same path,
+/// so `$FIXTURES_DIR`, `$OUT_DIR`, etc. can be used as normal.
+#[derive(Debug, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+#[cfg_attr(test, derive(schemars::JsonSchema))]
+#[serde(rename_all = "kebab-case", deny_unknown_fields)]
+pub struct DockerConfig {
+    /// The image to use, which must have `wasmer` on its `$PATH`.
+    pub image: String,
+    /// Extra arguments passed to `docker run` (e.g. `--network=none`).
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub args: Vec<String>,
+}
+
+/// A Wasmer package which classifies the result of a test case.
+///
+/// The classifier receives a JSON object with the test case's `exit-code`,
+/// `success`, `stdout`, and `stderr` via stdin, and should print a JSON object
+/// containing a `verdict` (either `pass` or `fail`) and an optional list of
+/// `labels`.
+#[derive(Debug, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+#[cfg_attr(test, derive(schemars::JsonSchema))]
+#[serde(rename_all = "kebab-case", deny_unknown_fields)]
+pub struct Classifier {
+    /// The package to run.
+    pub package: String,
+    /// Arguments passed to the classifier.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub args: Vec<String>,
+}
+
+/// How long to keep the logs from each test case.
+///
+/// Logs from test cases which failed or hit a bug are always kept in full so
+/// they can be investigated.
+#[derive(Debug, Default, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+#[cfg_attr(test, derive(schemars::JsonSchema))]
+#[serde(rename_all = "kebab-case", deny_unknown_fields)]
+pub struct Retention {
+    /// The number of days to keep the full stdout and stderr from passing
+    /// test cases, after which `wasmer-borealis prune` will truncate them.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub passing_days: Option<u64>,
+    /// The number of bytes to keep from the end of each truncated log
+    /// (defaults to 4096).
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub truncate_to: Option<u64>,
+}
+
+impl Retention {
+    pub fn is_empty(&self) -> bool {
+        self.passing_days.is_none() && self.truncate_to.is_none()
+    }
+}
+
+/// Assertions about how a test case should behave.
+#[derive(Debug, Default, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+#[cfg_attr(test, derive(schemars::JsonSchema))]
+#[serde(rename_all = "kebab-case", deny_unknown_fields)]
+pub struct Expectations {
+    /// The exit code `wasmer` should finish with (defaults to `0`).
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub exit_code: Option<i32>,
+    /// What should be written to stdout.
+    #[serde(default, skip_serializing_if = "OutputExpectations::is_empty")]
+    pub stdout: OutputExpectations,
+    /// What should be written to stderr.
+    #[serde(default, skip_serializing_if = "OutputExpectations::is_empty")]
+    pub stderr: OutputExpectations,
+}
+
+impl Expectations {
+    pub fn is_empty(&self) -> bool {
+        self.exit_code.is_none() && self.stdout.is_empty() && self.stderr.is_empty()
+    }
+}
+
+/// Assertions about a test case's stdout or stderr.
+#[derive(Debug, Default, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+#[cfg_attr(test, derive(schemars::JsonSchema))]
+#[serde(rename_all = "kebab-case", deny_unknown_fields)]
+pub struct OutputExpectations {
+    /// Text which should appear somewhere in the output.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub contains: Vec<String>,
+    /// Regular expressions which should match somewhere in the output.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    #[cfg_attr(test, schemars(with = "Vec<String>"))]
+    pub regex: Vec<Pattern>,
+}
+
+impl OutputExpectations {
+    pub fn is_empty(&self) -> bool {
+        self.contains.is_empty() && self.regex.is_empty()
+    }
+}
+
+/// A regular expression, which is checked when the experiment is loaded.
+#[derive(Debug, Clone)]
+pub struct Pattern(regex::Regex);
+
+impl Pattern {
+    pub fn new(pattern: &str) -> Result<Self, regex::Error> {
+        regex::Regex::new(pattern).map(Pattern)
+    }
+
+    pub fn as_str(&self) -> &str {
+        self.0.as_str()
+    }
+
+    pub fn is_match(&self, text: &str) -> bool {
+        self.0.is_match(text)
+    }
+}
+
+impl PartialEq for Pattern {
+    fn eq(&self, other: &Self) -> bool {
+        self.as_str() == other.as_str()
+    }
+}
+
+impl Eq for Pattern {}
+
+impl serde::Serialize for Pattern {
+    fn serialize<S: serde::Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+        serializer.serialize_str(self.as_str())
+    }
+}
+
+impl<'de> serde::Deserialize<'de> for Pattern {
+    fn deserialize<D: serde::Deserializer<'de>>(deserializer: D) -> Result<Self, D::Error> {
+        let pattern = String::deserialize(deserializer)?;
+        Pattern::new(&pattern).map_err(serde::de::Error::custom)
+    }
 }
 
 /// Configuration for the `wasmer` CLI being used.
@@ -72,16 +407,27 @@ pub struct WasmerConfig {
     pub args: Vec<TemplatedString>,
     /// Environment variables passed to the `wasmer` CLI.
     #[serde(default, skip_serializing_if = "IndexMap::is_empty")]
-    pub env: IndexMap<String, TemplatedString>,
+    pub env: IndexMap<String, EnvValue>,
+    /// Run every package with each of these `wasmer` CLIs, so their
+    /// behaviour can be compared.
+    ///
+    /// Entries are written the same way as `version`.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub matrix: Vec<WasmerVersion>,
 }
 
 fn should_show_wasmer_config(cfg: &WasmerConfig) -> bool {
-    let WasmerConfig { version, args, env } = cfg;
-    version.is_latest() && args.is_empty() && env.is_empty()
+    let WasmerConfig {
+        version,
+        args,
+        env,
+        matrix,
+    } = cfg;
+    version.is_latest() && args.is_empty() && env.is_empty() && matrix.is_empty()
 }
 
 /// The `wasmer` CLI version to use.
-#[derive(Debug, Default, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+#[derive(Debug, Default, Clone, PartialEq, Eq, serde::Serialize)]
 #[cfg_attr(test, derive(schemars::JsonSchema))]
 #[serde(rename_all = "kebab-case")]
 #[serde(untagged)]
@@ -91,10 +437,14 @@ pub enum WasmerVersion {
         /// The path.
         path: PathBuf,
     },
-    /// A released version.
+    /// A released version, which will be downloaded from GitHub.
     #[cfg_attr(test, schemars(with = "VersionRef"))]
     Release(Version),
-    /// Use the most recent version.
+    /// The path to a `wasmer` executable, or the name of a `wasmer-{name}`
+    /// executable on `$PATH` (e.g. `nightly`).
+    Named(String),
+    /// Use the most recent version (the `wasmer` on `$PATH`). This can also
+    /// be written as `"latest"`.
     #[default]
     Latest,
 }
@@ -105,6 +455,59 @@ impl WasmerVersion {
     }
 }
 
+/// The label used for a [`WasmerVersion`] in results and reports (e.g. the
+/// keys in [`crate::experiment::Results::matrix`]).
+impl std::fmt::Display for WasmerVersion {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            WasmerVersion::Local { path } => write!(f, "{}", path.display()),
+            WasmerVersion::Release(version) => write!(f, "{version}"),
+            WasmerVersion::Named(name) => f.write_str(name),
+            WasmerVersion::Latest => f.write_str("latest"),
+        }
+    }
+}
+
+impl<'de> serde::Deserialize<'de> for WasmerVersion {
+    fn deserialize<D: serde::Deserializer<'de>>(deserializer: D) -> Result<Self, D::Error> {
+        #[derive(serde::Deserialize)]
+        #[serde(untagged)]
+        enum Raw {
+            Local { path: PathBuf },
+            Name(String),
+            Latest,
+        }
+
+        let name = match Raw::deserialize(deserializer)? {
+            Raw::Local { path } => return Ok(WasmerVersion::Local { path }),
+            Raw::Name(name) => name,
+            Raw::Latest => return Ok(WasmerVersion::Latest),
+        };
+
+        if name == "latest" {
+            return Ok(WasmerVersion::Latest);
+        }
+
+        // Releases are also tagged with a "v" prefix (e.g. "v4.2.0"), so
+        // anything starting with a digit is meant to be a version and a typo
+        // like "4.2" shouldn't be mistaken for a "wasmer-4.2" executable
+        let unprefixed = name.strip_prefix('v').unwrap_or(&name);
+        if unprefixed.starts_with(|c: char| c.is_ascii_digit()) {
+            let version: Version = unprefixed.parse().map_err(|e| {
+                serde::de::Error::custom(format_args!(
+                    "\"{name}\" isn't a valid version (e.g. \"4.2.0\"): {e}"
+                ))
+            })?;
+
+            if unprefixed.len() == name.len() {
+                return Ok(WasmerVersion::Release(version));
+            }
+        }
+
+        Ok(WasmerVersion::Named(name))
+    }
+}
+
 /// A string that supports environment variable interpolation.
 #[derive(Debug, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
 #[cfg_attr(test, derive(schemars::JsonSchema))]
@@ -132,6 +535,46 @@ impl From<String> for TemplatedString {
     }
 }
 
+/// The value of an environment variable.
+#[derive(Debug, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+#[cfg_attr(test, derive(schemars::JsonSchema))]
+#[serde(untagged, deny_unknown_fields)]
+pub enum EnvValue {
+    /// A string which supports environment variable interpolation.
+    Templated(TemplatedString),
+    /// A secret that will be read from the host's environment when the
+    /// experiment is run, rather than being stored in the experiment file.
+    Secret {
+        /// The name of the host environment variable containing the secret.
+        secret: String,
+    },
+}
+
+impl EnvValue {
+    pub fn is_secret(&self) -> bool {
+        matches!(self, EnvValue::Secret { .. })
+    }
+
+    pub fn resolve(
+        &self,
+        home: &Path,
+        get_env: impl Fn(&str) -> Option<String>,
+    ) -> Result<Cow<'_, str>, Error> {
+        match self {
+            EnvValue::Templated(s) => Ok(s.resolve(home, get_env)),
+            EnvValue::Secret { secret } => std::env::var(secret)
+                .map(Cow::Owned)
+                .with_context(|| format!("Unable to read the \"{secret}\" secret")),
+        }
+    }
+}
+
+impl From<TemplatedString> for EnvValue {
+    fn from(value: TemplatedString) -> Self {
+        EnvValue::Templated(value)
+    }
+}
+
 #[derive(Debug, Default, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
 #[cfg_attr(test, derive(schemars::JsonSchema))]
 #[serde(rename_all = "kebab-case", deny_unknown_fields)]
@@ -151,11 +594,90 @@ pub struct Filters {
     /// recent one?
     #[serde(default, skip_serializing_if = "std::ops::Not::not")]
     pub include_every_version: bool,
+    /// If provided, only packages which appear to have been built with one of
+    /// these toolchains will be run.
+    ///
+    /// A package's toolchain can only be detected once it has been
+    /// downloaded, so this doesn't reduce the number of downloads.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub toolchains: Vec<Toolchain>,
 }
 
 impl Filters {
     fn is_empty(&self) -> bool {
-        self.namespaces.is_empty() && self.blacklist.is_empty()
+        self.namespaces.is_empty() && self.blacklist.is_empty() && self.toolchains.is_empty()
+    }
+}
+
+/// The language or toolchain a package was most likely built with.
+#[derive(
+    Debug, Copy, Clone, PartialEq, Eq, Hash, PartialOrd, Ord, serde::Serialize, serde::Deserialize,
+)]
+#[cfg_attr(test, derive(schemars::JsonSchema))]
+#[serde(rename_all = "kebab-case")]
+pub enum Toolchain {
+    Rust,
+    /// The standard Go compiler.
+    Go,
+    #[serde(rename = "tinygo")]
+    TinyGo,
+    /// C or C++ compiled with Emscripten.
+    Emscripten,
+    /// C or C++ compiled with something else (e.g. `wasi-sdk`).
+    C,
+    /// JavaScript running on an embedded engine (e.g. SpiderMonkey or
+    /// QuickJS).
+    #[serde(rename = "javascript")]
+    JavaScript,
+    /// Python running on an embedded interpreter (e.g. CPython).
+    Python,
+    /// There weren't enough hints to tell.
+    Unknown,
+}
+
+impl Toolchain {
+    pub const ALL: [Toolchain; 8] = [
+        Toolchain::Rust,
+        Toolchain::Go,
+        Toolchain::TinyGo,
+        Toolchain::Emscripten,
+        Toolchain::C,
+        Toolchain::JavaScript,
+        Toolchain::Python,
+        Toolchain::Unknown,
+    ];
+
+    pub fn as_str(self) -> &'static str {
+        match self {
+            Toolchain::Rust => "rust",
+            Toolchain::Go => "go",
+            Toolchain::TinyGo => "tinygo",
+            Toolchain::Emscripten => "emscripten",
+            Toolchain::C => "c",
+            Toolchain::JavaScript => "javascript",
+            Toolchain::Python => "python",
+            Toolchain::Unknown => "unknown",
+        }
+    }
+}
+
+impl std::fmt::Display for Toolchain {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
+
+impl std::str::FromStr for Toolchain {
+    type Err = Error;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        Toolchain::ALL
+            .into_iter()
+            .find(|t| t.as_str() == s)
+            .with_context(|| {
+                let expected: Vec<_> = Toolchain::ALL.iter().map(|t| t.as_str()).collect();
+                format!("Expected one of {}", expected.join(", "))
+            })
     }
 }
 
@@ -167,6 +689,8 @@ struct VersionRef(String);
 
 #[cfg(test)]
 mod tests {
+    use serde_json::json;
+
     use super::*;
 
     #[test]
@@ -179,6 +703,50 @@ mod tests {
         ensure_file_contents(dest, schema);
     }
 
+    #[test]
+    fn parse_wasmer_versions() {
+        let inputs = [
+            (json!(null), WasmerVersion::Latest),
+            (json!("latest"), WasmerVersion::Latest),
+            (
+                json!("4.2.0"),
+                WasmerVersion::Release(Version::new(4, 2, 0)),
+            ),
+            (json!("v4.2.0"), WasmerVersion::Named("v4.2.0".to_string())),
+            (
+                json!("nightly"),
+                WasmerVersion::Named("nightly".to_string()),
+            ),
+            (
+                json!("./target/release/wasmer"),
+                WasmerVersion::Named("./target/release/wasmer".to_string()),
+            ),
+            (
+                json!({ "path": "/usr/bin/wasmer" }),
+                WasmerVersion::Local {
+                    path: PathBuf::from("/usr/bin/wasmer"),
+                },
+            ),
+        ];
+
+        for (input, expected) in inputs {
+            let version: WasmerVersion = serde_json::from_value(input.clone()).unwrap();
+            assert_eq!(version, expected, "{input}");
+        }
+    }
+
+    #[test]
+    fn version_like_strings_must_be_valid_semver() {
+        for input in ["4.2", "v4.2", "4.2.x"] {
+            let err = serde_json::from_value::<WasmerVersion>(json!(input)).unwrap_err();
+            assert!(
+                err.to_string()
+                    .starts_with(&format!("\"{input}\" isn't a valid version")),
+                "{input}: {err}",
+            );
+        }
+    }
+
     /// Get the root directory for this repository.
     fn project_root() -> &'static Path {
         let root_dir = Path::new(env!("CARGO_MANIFEST_DIR"))
@@ -1,23 +1,34 @@
-use std::{fmt::Debug, path::PathBuf, sync::Arc};
+use std::{
+    fmt::Debug,
+    num::NonZeroUsize,
+    path::{Path, PathBuf},
+    sync::Arc,
+};
 
 use actix::{Actor, System};
 use anyhow::Error;
+use futures::StreamExt;
 use reqwest::Client;
 use tokio::runtime::Runtime;
 use tracing::Instrument;
 use url::Url;
 
 use crate::{
-    config::Experiment,
+    config::{Experiment, WasmerVersion},
     experiment::{
-        cache::Cache,
-        orchestrator::{BeginExperiment, Orchestrator},
+        cache::{self, Cache, CacheCounters},
+        matrix,
+        orchestrator::{BeginExperiment, Orchestrator, CANCEL_FILE, PARTIAL_RESULTS},
         progress::{Progress, ProgressMonitor},
+        runner,
+        wapm::{self, TestCase},
         Results,
     },
+    registry::{self, ClientOptions, Faults, Politeness},
 };
 
 const PRODUCTION_ENDPOINT: &str = "https://registry.wasmer.io/graphql";
+const DEFAULT_SNAPSHOT_EVERY: usize = 50;
 
 #[must_use = "An ExperimentBuilder won't do anything unless you call run()"]
 pub struct ExperimentBuilder {
@@ -25,9 +36,17 @@ pub struct ExperimentBuilder {
     runtime: Option<Box<dyn Fn() -> Runtime>>,
     progress: Box<dyn Progress>,
     cache_dir: Option<PathBuf>,
+    shared_cache_dir: Option<PathBuf>,
     client: Option<Client>,
     endpoint: Url,
     experiment_dir: Option<PathBuf>,
+    max_concurrent_downloads: Option<NonZeroUsize>,
+    concurrency: Option<NonZeroUsize>,
+    cache_profile: Option<String>,
+    shuffle_seed: Option<u64>,
+    snapshot_every: Option<NonZeroUsize>,
+    politeness: Option<Politeness>,
+    faults: Option<Faults>,
 }
 
 impl ExperimentBuilder {
@@ -37,9 +56,17 @@ impl ExperimentBuilder {
             runtime: None,
             progress: Box::new(Noop),
             cache_dir: None,
+            shared_cache_dir: None,
             client: None,
             endpoint: PRODUCTION_ENDPOINT.parse().unwrap(),
             experiment_dir: None,
+            max_concurrent_downloads: None,
+            concurrency: None,
+            cache_profile: None,
+            shuffle_seed: None,
+            snapshot_every: None,
+            politeness: None,
+            faults: None,
         }
     }
 
@@ -76,56 +103,307 @@ impl ExperimentBuilder {
         }
     }
 
+    pub fn with_cache_dir(self, cache_dir: impl Into<PathBuf>) -> Self {
+        ExperimentBuilder {
+            cache_dir: Some(cache_dir.into()),
+            ..self
+        }
+    }
+
+    /// Use a second-tier cache which is shared with other machines (e.g. a
+    /// network drive).
+    ///
+    /// Packages missing from the local cache are copied from the shared
+    /// cache if possible, and anything downloaded from the registry is added
+    /// to it.
+    pub fn with_shared_cache_dir(self, shared_cache_dir: impl Into<PathBuf>) -> Self {
+        ExperimentBuilder {
+            shared_cache_dir: Some(shared_cache_dir.into()),
+            ..self
+        }
+    }
+
+    /// Limit how many packages can be downloaded at the same time (defaults
+    /// to the number of CPUs).
+    pub fn with_max_concurrent_downloads(self, max_concurrent_downloads: NonZeroUsize) -> Self {
+        ExperimentBuilder {
+            max_concurrent_downloads: Some(max_concurrent_downloads),
+            ..self
+        }
+    }
+
+    /// Limit how many test cases can run at the same time, overriding the
+    /// experiment's `concurrency` field (defaults to the number of CPUs).
+    pub fn with_concurrency(self, concurrency: NonZeroUsize) -> Self {
+        ExperimentBuilder {
+            concurrency: Some(concurrency),
+            ..self
+        }
+    }
+
+    /// Keep downloaded packages separate from those downloaded under other
+    /// profiles (e.g. with a different token).
+    ///
+    /// The profile becomes part of a directory name, so it should only
+    /// contain alphanumeric characters, `-`, and `_`.
+    pub fn with_cache_profile(self, profile: impl Into<String>) -> Self {
+        ExperimentBuilder {
+            cache_profile: Some(profile.into()),
+            ..self
+        }
+    }
+
+    /// Run test cases in a random order, using `seed` so the order can be
+    /// reproduced later.
+    ///
+    /// Test cases are normally run as soon as they are discovered, in
+    /// whatever order the registry returns them (the reports are sorted
+    /// afterwards). Shuffling means every test case needs to be discovered
+    /// before the first one can start.
+    pub fn with_shuffle_seed(self, seed: u64) -> Self {
+        ExperimentBuilder {
+            shuffle_seed: Some(seed),
+            ..self
+        }
+    }
+
+    /// Save partial results to `results.partial.json` after every
+    /// `snapshot_every` test cases complete (and at least every 5 minutes),
+    /// so something is left over if the experiment is aborted.
+    pub fn with_snapshot_every(self, snapshot_every: NonZeroUsize) -> Self {
+        ExperimentBuilder {
+            snapshot_every: Some(snapshot_every),
+            ..self
+        }
+    }
+
+    /// Limit how hard the experiment will hit the registry (see
+    /// [`registry::set_politeness()`]).
+    pub fn with_politeness(self, politeness: Politeness) -> Self {
+        ExperimentBuilder {
+            politeness: Some(politeness),
+            ..self
+        }
+    }
+
+    /// Deliberately make some requests to the registry fail or slow down, so
+    /// recovery paths get exercised (see [`registry::set_faults()`]).
+    ///
+    /// This is only intended for tests and staging environments.
+    pub fn with_faults(self, faults: Faults) -> Self {
+        ExperimentBuilder {
+            faults: Some(faults),
+            ..self
+        }
+    }
+
     pub fn run(self) -> Result<Results, Error> {
         let ExperimentBuilder {
             experiment,
             runtime,
             progress,
             cache_dir,
+            shared_cache_dir,
             client,
             endpoint,
             experiment_dir,
+            max_concurrent_downloads,
+            concurrency,
+            cache_profile,
+            shuffle_seed,
+            snapshot_every,
+            politeness,
+            faults,
         } = self;
 
-        let client = client.unwrap_or_default();
+        let _overrides = RegistryOverrides::apply(faults, politeness, &endpoint);
+
+        anyhow::ensure!(
+            experiment.docker.is_none() || experiment.wasmer.matrix.is_empty(),
+            "A wasmer matrix can't be used when running inside Docker",
+        );
+        anyhow::ensure!(
+            experiment.docker.is_none() || experiment.wasmer.version == WasmerVersion::Latest,
+            "\"wasmer.version\" can't be used when running inside Docker",
+        );
+        anyhow::ensure!(
+            !experiment.unpack_tarball || experiment.artifacts.wants_tarball(),
+            "\"unpack-tarball\" needs the tarball, but only the webc is being downloaded",
+        );
+        anyhow::ensure!(
+            !experiment.run_unpacked || experiment.unpack_tarball,
+            "\"run-unpacked\" can only be used with \"unpack-tarball\"",
+        );
+
+        if let Some(profile) = &cache_profile {
+            anyhow::ensure!(
+                is_valid_profile(profile),
+                "\"{profile}\" isn't a valid cache profile"
+            );
+        }
+
+        let client = match client {
+            Some(client) => client,
+            None => registry::http_client(&ClientOptions::default())?,
+        };
         let cache_dir = cache_dir.unwrap_or_else(|| crate::DIRS.cache_dir().to_path_buf());
         let experiment_dir = experiment_dir.unwrap_or_else(|| {
             crate::DIRS
                 .data_local_dir()
                 .join(uuid::Uuid::new_v4().to_string())
         });
+        // A leftover request to cancel a previous run shouldn't cancel this one
+        let stale_cancel = experiment_dir.join(CANCEL_FILE);
+        if stale_cancel.exists() {
+            std::fs::remove_file(&stale_cancel)?;
+        }
+
+        // Every download still needs a request slot for its host, and hosts
+        // other than the registry (e.g. a CDN) always use the default limits
+        let per_host = politeness
+            .unwrap_or_default()
+            .max_concurrent_requests
+            .min(Politeness::default().max_concurrent_requests);
+        if let Some(requested) = max_concurrent_downloads.filter(|n| n.get() > per_host) {
+            tracing::warn!(
+                max_concurrent_downloads = requested.get(),
+                max_concurrent_requests = per_host,
+                "At most {per_host} packages will be downloaded from the same host at a time",
+            );
+        }
+        let max_concurrent_downloads =
+            max_concurrent_downloads.unwrap_or_else(cache::default_concurrent_downloads);
+        tracing::info!(
+            max_concurrent_downloads = max_concurrent_downloads.get(),
+            "Limiting concurrent downloads"
+        );
+        let concurrency = concurrency
+            .or(experiment.concurrency)
+            .unwrap_or_else(runner::default_concurrency);
+        tracing::info!(
+            concurrency = concurrency.get(),
+            "Limiting concurrent test cases"
+        );
 
         let system = match runtime {
             Some(rt) => System::with_tokio_rt(rt),
             None => System::new(),
         };
 
-        let results = system.block_on(
+        let counters = Arc::new(CacheCounters::default());
+
+        let mut results = system.block_on(
             async {
+                let matrix = matrix::resolve_matrix(&experiment.wasmer.matrix, &cache_dir).await?;
+                let default_wasmer =
+                    matrix::resolve_default(&experiment.wasmer.version, &cache_dir).await?;
+
                 let progress = ProgressMonitor::new(progress).start();
-                let cache = Cache::new(cache_dir, client.clone(), progress.recipient()).start();
-                let orchestrator = Orchestrator::new(cache, client, endpoint).start();
+                let cache = Cache::new(
+                    cache_dir,
+                    client.clone(),
+                    progress.clone().recipient(),
+                    max_concurrent_downloads,
+                    counters.clone(),
+                    cache_profile,
+                    shared_cache_dir,
+                )
+                .start();
+                let orchestrator =
+                    Orchestrator::new(cache, client, endpoint, progress.recipient()).start();
 
                 orchestrator
                     .send(BeginExperiment {
                         experiment,
                         base_dir: experiment_dir.clone(),
+                        shuffle_seed,
+                        snapshot_every: snapshot_every
+                            .unwrap_or_else(|| NonZeroUsize::new(DEFAULT_SNAPSHOT_EVERY).unwrap()),
+                        concurrency,
+                        matrix,
+                        default_wasmer,
                     })
                     .await
+                    .map_err(Error::from)
             }
             .in_current_span(),
         )?;
+        results.cache = counters.snapshot();
 
-        let report = crate::render::html(&results)?;
-        let reports_html = experiment_dir.join("report.html");
-        std::fs::write(reports_html, report)?;
+        save(&results, &experiment_dir)?;
 
-        let reports_json = experiment_dir.join("results.json");
-        let json = serde_json::to_string_pretty(&results)?;
-        std::fs::write(reports_json, json)?;
+        // The partial results are redundant now we have the real thing
+        let partial = experiment_dir.join(PARTIAL_RESULTS);
+        if partial.exists() {
+            std::fs::remove_file(partial)?;
+        }
 
         Ok(results)
     }
+
+    /// Find every [`TestCase`] the experiment would run, without downloading
+    /// or running anything.
+    ///
+    /// Test cases are sorted by package name, with the newest version first.
+    /// Unlike a real run, any error while querying the registry is returned
+    /// rather than skipping the packages it affected.
+    ///
+    /// The experiment's `filters.toolchains` can't be applied without
+    /// downloading each package, so it is ignored.
+    pub fn dry_run(self) -> Result<Vec<TestCase>, Error> {
+        let ExperimentBuilder {
+            experiment,
+            runtime,
+            client,
+            endpoint,
+            politeness,
+            ..
+        } = self;
+
+        let _overrides = RegistryOverrides::apply(None, politeness, &endpoint);
+
+        if !experiment.filters.toolchains.is_empty() {
+            // Detecting a package's toolchain means downloading it
+            tracing::warn!(
+                toolchains = ?experiment.filters.toolchains,
+                "The toolchain filter is ignored by dry runs, so some of these test cases may be skipped",
+            );
+        }
+
+        let client = match client {
+            Some(client) => client,
+            None => registry::http_client(&ClientOptions::default())?,
+        };
+
+        let system = match runtime {
+            Some(rt) => System::with_tokio_rt(rt),
+            None => System::new(),
+        };
+
+        let mut test_cases = system.block_on(
+            async move {
+                let mut pages = wapm::discover_test_cases(
+                    client,
+                    experiment.filters.clone(),
+                    experiment.artifacts,
+                    endpoint,
+                );
+
+                // A dry run that silently skipped a namespace would be
+                // misleading, so stop at the first error
+                let mut test_cases = Vec::new();
+                while let Some(page) = pages.next().await {
+                    test_cases.extend(page?);
+                }
+
+                Ok::<_, Error>(test_cases)
+            }
+            .in_current_span(),
+        )?;
+        test_cases.sort_by(|a, b| a.cmp_canonical(b));
+
+        Ok(test_cases)
+    }
 }
 
 impl Debug for ExperimentBuilder {
@@ -135,22 +413,100 @@ impl Debug for ExperimentBuilder {
             runtime: _,
             progress,
             cache_dir,
+            shared_cache_dir,
             experiment_dir,
             client,
             endpoint,
+            max_concurrent_downloads,
+            concurrency,
+            cache_profile,
+            shuffle_seed,
+            snapshot_every,
+            politeness,
+            faults,
         } = self;
 
         f.debug_struct("ExperimentBuilder")
             .field("experiment", experiment)
             .field("progress", progress)
             .field("cache_dir", cache_dir)
+            .field("shared_cache_dir", shared_cache_dir)
             .field("experiment_dir", experiment_dir)
             .field("client", client)
             .field("endpoint", endpoint)
+            .field("max_concurrent_downloads", max_concurrent_downloads)
+            .field("concurrency", concurrency)
+            .field("cache_profile", cache_profile)
+            .field("shuffle_seed", shuffle_seed)
+            .field("snapshot_every", snapshot_every)
+            .field("politeness", politeness)
+            .field("faults", faults)
             .finish_non_exhaustive()
     }
 }
 
+/// The [`Faults`] and [`Politeness`] settings are shared by the whole
+/// process, so this puts back whatever was there before once an experiment
+/// is done with them.
+#[derive(Debug, Default)]
+struct RegistryOverrides {
+    faults: Option<Faults>,
+    politeness: Option<(String, Politeness)>,
+}
+
+impl RegistryOverrides {
+    fn apply(faults: Option<Faults>, politeness: Option<Politeness>, endpoint: &Url) -> Self {
+        let mut overrides = RegistryOverrides::default();
+
+        if let Some(faults) = faults {
+            overrides.faults = Some(registry::set_faults(faults));
+        }
+
+        if let (Some(politeness), Some(host)) = (politeness, endpoint.host_str()) {
+            let previous = registry::set_politeness(host, politeness);
+            overrides.politeness = Some((host.to_string(), previous));
+        }
+
+        overrides
+    }
+}
+
+impl Drop for RegistryOverrides {
+    fn drop(&mut self) {
+        if let Some(faults) = self.faults.take() {
+            registry::set_faults(faults);
+        }
+
+        if let Some((host, politeness)) = self.politeness.take() {
+            registry::set_politeness(&host, politeness);
+        }
+    }
+}
+
+/// Save the `results.json` file and everything generated from it to the
+/// experiment directory.
+pub(crate) fn save(results: &Results, experiment_dir: &Path) -> Result<(), Error> {
+    let report = crate::render::html(results)?;
+    let reports_html = experiment_dir.join("report.html");
+    std::fs::write(reports_html, report)?;
+
+    let badge = experiment_dir.join("badge.svg");
+    std::fs::write(badge, crate::render::badge(results))?;
+
+    let reports_json = experiment_dir.join("results.json");
+    let json = serde_json::to_string_pretty(results)?;
+    std::fs::write(reports_json, json)?;
+
+    Ok(())
+}
+
+fn is_valid_profile(profile: &str) -> bool {
+    !profile.is_empty()
+        && profile
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '_')
+}
+
 #[derive(Debug, Clone, Copy)]
 struct Noop;
 
@@ -1,17 +1,31 @@
 use std::{
+    num::NonZeroUsize,
     path::{Path, PathBuf},
-    sync::Arc,
-    time::{Duration, Instant},
+    sync::{
+        atomic::{AtomicU64, AtomicUsize, Ordering},
+        Arc,
+    },
+    time::{Duration, Instant, SystemTime},
 };
 
 use actix::{Actor, Context, Handler, Recipient};
 use anyhow::{Context as _, Error};
+use fs4::FileExt;
+use indexmap::IndexMap;
 use reqwest::Client;
+use sha2::{Digest, Sha256};
 use tempfile::TempDir;
-use tokio::sync::Semaphore;
+use tokio::{
+    io::AsyncReadExt,
+    sync::{watch, Semaphore},
+};
 use url::Url;
 
-use crate::experiment::wapm::TestCase;
+use crate::{
+    config::Artifacts,
+    experiment::{wapm::TestCase, CacheStats},
+    registry::{self, faults, politeness},
+};
 
 const DEFAULT_CONCURRENT_DOWNLOADS: usize = 16;
 
@@ -21,6 +35,11 @@ pub(crate) struct Cache {
     client: Client,
     progress: Recipient<CacheStatusMessage>,
     download_limiter: Arc<Semaphore>,
+    counters: Arc<CacheCounters>,
+    profile: Option<String>,
+    /// A second-tier cache (e.g. on a network drive) shared by several
+    /// machines.
+    shared_dir: Option<PathBuf>,
 }
 
 impl Cache {
@@ -28,28 +47,103 @@ impl Cache {
         dir: PathBuf,
         client: Client,
         progress: Recipient<CacheStatusMessage>,
+        max_concurrent_downloads: NonZeroUsize,
+        counters: Arc<CacheCounters>,
+        profile: Option<String>,
+        shared_dir: Option<PathBuf>,
     ) -> Self {
         Cache {
             dir,
             client,
             progress,
-            download_limiter: Arc::new(Semaphore::new(
-                std::thread::available_parallelism()
-                    .map(|p| p.get())
-                    .unwrap_or(DEFAULT_CONCURRENT_DOWNLOADS),
-            )),
+            download_limiter: Arc::new(Semaphore::new(max_concurrent_downloads.get())),
+            counters,
+            profile,
+            shared_dir,
         }
     }
 }
 
+/// Running totals which are updated as the [`Cache`] serves requests.
+#[derive(Debug, Default)]
+pub(crate) struct CacheCounters {
+    hits: AtomicUsize,
+    misses: AtomicUsize,
+    bytes_downloaded: AtomicU64,
+}
+
+impl CacheCounters {
+    pub(crate) fn snapshot(&self) -> CacheStats {
+        CacheStats {
+            hits: self.hits.load(Ordering::Relaxed),
+            misses: self.misses.load(Ordering::Relaxed),
+            bytes_downloaded: self.bytes_downloaded.load(Ordering::Relaxed),
+        }
+    }
+}
+
+/// The number of concurrent downloads to use when the user hasn't specified
+/// one, based on the number of CPUs.
+pub(crate) fn default_concurrent_downloads() -> NonZeroUsize {
+    std::thread::available_parallelism()
+        .unwrap_or(NonZeroUsize::new(DEFAULT_CONCURRENT_DOWNLOADS).unwrap())
+}
+
 impl Actor for Cache {
     type Context = Context<Self>;
+
+    fn started(&mut self, _ctx: &mut Self::Context) {
+        remove_orphaned_temp_dirs(&self.dir);
+    }
+}
+
+/// How old a temporary directory needs to be before we assume the process
+/// that created it has crashed.
+const ORPHANED_TEMP_DIR_AGE: Duration = Duration::from_secs(60 * 60);
+
+/// Clean up any temporary download directories left behind when a previous
+/// run was killed part-way through a download.
+fn remove_orphaned_temp_dirs(dir: &Path) {
+    let Ok(entries) = std::fs::read_dir(dir) else {
+        return;
+    };
+
+    for entry in entries.flatten() {
+        let path = entry.path();
+
+        let is_temp_dir = entry.file_name().to_string_lossy().starts_with(".tmp")
+            && entry.file_type().map(|t| t.is_dir()).unwrap_or(false);
+        let age = entry
+            .metadata()
+            .and_then(|m| m.modified())
+            .ok()
+            .and_then(|modified| modified.elapsed().ok());
+
+        if !is_temp_dir || !matches!(age, Some(age) if age >= ORPHANED_TEMP_DIR_AGE) {
+            continue;
+        }
+
+        match std::fs::remove_dir_all(&path) {
+            Ok(_) => tracing::debug!(path=%path.display(), "Removed an orphaned temp dir"),
+            Err(e) => tracing::warn!(
+                path=%path.display(),
+                error=&e as &dyn std::error::Error,
+                "Unable to remove an orphaned temp dir",
+            ),
+        }
+    }
 }
 
 #[derive(Debug, Clone, actix::Message)]
 #[rtype(result = "Result<AssetsFetched, Error>")]
 pub(crate) struct FetchAssets {
     pub test_case: TestCase,
+    pub artifacts: Artifacts,
+    /// Extract the tarball, too.
+    pub unpack: bool,
+    /// Set to `true` when the experiment is cancelled, so queued downloads
+    /// can be skipped.
+    pub cancelled: watch::Receiver<bool>,
 }
 
 impl Handler<FetchAssets> for Cache {
@@ -60,15 +154,45 @@ impl Handler<FetchAssets> for Cache {
         msg: FetchAssets,
         _ctx: &mut Self::Context,
     ) -> actix::ResponseFuture<Result<AssetsFetched, Error>> {
-        let FetchAssets { test_case } = msg;
+        let FetchAssets {
+            test_case,
+            artifacts,
+            unpack,
+            cancelled,
+        } = msg;
         let progress = self.progress.clone();
         let dir = self.dir.clone();
         let client = self.client.clone();
         let semaphore = self.download_limiter.clone();
+        let counters = self.counters.clone();
+        let profile = self.profile.clone();
+        let shared_dir = self.shared_dir.clone();
 
         Box::pin(async move {
             let _guard = semaphore.acquire().await?;
-            let assets = prepare_assets(&client, &dir, &test_case, progress).await?;
+            // The experiment may have been cancelled while we were waiting
+            anyhow::ensure!(!*cancelled.borrow(), "The experiment was cancelled");
+            let cache_dir = package_version_dir(&dir, profile.as_deref(), &test_case);
+            let shared = shared_dir.map(|root| {
+                let entry = package_version_dir(&root, profile.as_deref(), &test_case);
+                SharedEntry { root, entry }
+            });
+            let mut assets = prepare_assets(
+                &client,
+                &dir,
+                &cache_dir,
+                shared.as_ref(),
+                &test_case,
+                artifacts,
+                progress,
+                &counters,
+            )
+            .await?;
+
+            if let (true, Some(tarball)) = (unpack, &assets.tarball) {
+                assets.unpacked = Some(unpack_cached_tarball(&cache_dir, tarball).await?);
+            }
+
             Ok(AssetsFetched { test_case, assets })
         })
     }
@@ -82,12 +206,25 @@ pub(crate) struct AssetsFetched {
 
 #[derive(Debug, Clone)]
 pub(crate) struct Assets {
-    pub tarball: PathBuf,
+    pub tarball: Option<PathBuf>,
     pub webc: Option<PathBuf>,
+    /// The tarball's contents, if it has been extracted.
+    pub unpacked: Option<PathBuf>,
     /// The total size of the assets on disk.
     pub total_size: u64,
 }
 
+impl Assets {
+    /// Which artifacts are available.
+    pub(crate) fn artifacts(&self) -> Artifacts {
+        match (&self.tarball, &self.webc) {
+            (Some(_), Some(_)) => Artifacts::All,
+            (None, Some(_)) => Artifacts::Webc,
+            _ => Artifacts::Tarball,
+        }
+    }
+}
+
 /// Messages emitted by the [`Cache`] as it downloads a packages.
 #[derive(Debug, actix::Message)]
 #[rtype(result = "()")]
@@ -108,60 +245,107 @@ pub(crate) enum CacheStatusMessage {
         pkg.name=test_case.package_name.as_str(),
         pkg.version=test_case.version(),
     ))]
+#[allow(clippy::too_many_arguments)]
 async fn prepare_assets(
     client: &Client,
     dir: &Path,
+    cache_dir: &Path,
+    shared: Option<&SharedEntry>,
     test_case: &TestCase,
+    artifacts: Artifacts,
     progress: Recipient<CacheStatusMessage>,
+    counters: &CacheCounters,
 ) -> Result<Assets, Error> {
     let _ = progress
         .send(CacheStatusMessage::Fetching(test_case.clone()))
         .await;
 
-    let cache_dir = package_version_dir(dir, test_case);
-    let tarball_path = cache_dir
-        .join(&test_case.package_name)
-        .with_extension("tar.gz");
-    let webc_path = cache_dir
-        .join(&test_case.package_name)
-        .with_extension("webc");
-
-    if cache_dir.exists() && tarball_path.exists() {
-        let tarball_size = std::fs::metadata(&tarball_path)?.len();
-
-        let assets = match std::fs::metadata(&webc_path) {
-            Ok(webc_meta) => Assets {
-                tarball: tarball_path,
-                webc: Some(webc_path),
-                total_size: tarball_size + webc_meta.len(),
-            },
-            Err(_) => Assets {
-                tarball: tarball_path,
-                webc: None,
-                total_size: tarball_size,
-            },
-        };
+    let tarball_path = artifacts
+        .wants_tarball()
+        .then(|| cache_dir.join(asset_file_name(test_case, "tar.gz")));
+    let webc_path = (artifacts.wants_webc() && test_case.webc_url().is_some())
+        .then(|| cache_dir.join(asset_file_name(test_case, "webc")));
 
-        tracing::debug!(cache_dir=%cache_dir.display(), "Cache hit!");
-        let _ = progress
-            .send(CacheStatusMessage::CacheHit(test_case.clone()))
-            .await;
+    // Other Borealis processes may be sharing this cache directory, so make
+    // sure only one of us touches this package version at a time.
+    let _lock = lock_package_version(cache_dir).await?;
 
-        return Ok(assets);
+    match cached_assets(cache_dir, tarball_path.as_deref(), webc_path.as_deref()).await {
+        Ok(Some(assets)) => {
+            tracing::debug!(cache_dir=%cache_dir.display(), "Cache hit!");
+            counters.hits.fetch_add(1, Ordering::Relaxed);
+            let _ = progress
+                .send(CacheStatusMessage::CacheHit(test_case.clone()))
+                .await;
+
+            return Ok(assets);
+        }
+        Ok(None) => {}
+        Err(e) => {
+            tracing::warn!(
+                cache_dir=%cache_dir.display(),
+                error=&*e,
+                "Discarding an invalid cache entry",
+            );
+        }
     }
 
     tracing::debug!(
         cache_dir.path = %cache_dir.display(),
         cache_dir.exists = cache_dir.exists(),
-        tarball.path = %tarball_path.display(),
-        tarball.exists = tarball_path.exists(),
+        manifest.exists = cache_dir.join(MANIFEST).exists(),
         "Cache miss",
     );
 
+    if let Some(shared) = shared {
+        match fetch_from_shared(
+            shared,
+            dir,
+            cache_dir,
+            tarball_path.as_deref(),
+            webc_path.as_deref(),
+        )
+        .await
+        {
+            Ok(Some(assets)) => {
+                tracing::debug!(shared_dir=%shared.entry.display(), "Shared cache hit!");
+                counters.hits.fetch_add(1, Ordering::Relaxed);
+                let _ = progress
+                    .send(CacheStatusMessage::CacheHit(test_case.clone()))
+                    .await;
+
+                return Ok(assets);
+            }
+            Ok(None) => {}
+            Err(e) => {
+                tracing::warn!(
+                    shared_dir=%shared.entry.display(),
+                    error=&*e,
+                    "Unable to use the shared cache",
+                );
+            }
+        }
+    }
+
     let start = Instant::now();
-    let result = do_download(client, dir, &cache_dir, tarball_path, webc_path, test_case).await;
+    let result = do_download(client, dir, cache_dir, tarball_path, webc_path, test_case).await;
+
+    counters.misses.fetch_add(1, Ordering::Relaxed);
+
+    if let (Ok(_), Some(shared)) = (&result, shared) {
+        if let Err(e) = populate_shared(shared, cache_dir).await {
+            tracing::warn!(
+                shared_dir=%shared.entry.display(),
+                error=&*e,
+                "Unable to add the download to the shared cache",
+            );
+        }
+    }
 
     if let Ok(assets) = &result {
+        counters
+            .bytes_downloaded
+            .fetch_add(assets.total_size, Ordering::Relaxed);
         let duration = start.elapsed();
         let _ = progress
             .send(CacheStatusMessage::CacheMiss {
@@ -175,12 +359,242 @@ async fn prepare_assets(
     result
 }
 
+/// A package version's entry in the shared cache.
+#[derive(Debug)]
+struct SharedEntry {
+    /// The shared cache's root directory.
+    root: PathBuf,
+    entry: PathBuf,
+}
+
+/// Check the shared cache for a package version, copying it into the local
+/// cache if it is there.
+async fn fetch_from_shared(
+    shared: &SharedEntry,
+    dir: &Path,
+    cache_dir: &Path,
+    tarball_path: Option<&Path>,
+    webc_path: Option<&Path>,
+) -> Result<Option<Assets>, Error> {
+    let _lock = lock_package_version(&shared.entry).await?;
+
+    let in_shared = |path: &Path| shared.entry.join(path.file_name().unwrap());
+    let shared_tarball = tarball_path.map(in_shared);
+    let shared_webc = webc_path.map(in_shared);
+
+    let cached = cached_assets(
+        &shared.entry,
+        shared_tarball.as_deref(),
+        shared_webc.as_deref(),
+    )
+    .await?;
+    if cached.is_none() {
+        return Ok(None);
+    }
+
+    copy_entry(&shared.entry, dir, cache_dir).await?;
+
+    // Check the copy, too
+    cached_assets(cache_dir, tarball_path, webc_path).await
+}
+
+/// Copy a freshly downloaded cache entry into the shared cache.
+async fn populate_shared(shared: &SharedEntry, cache_dir: &Path) -> Result<(), Error> {
+    let _lock = lock_package_version(&shared.entry).await?;
+    copy_entry(cache_dir, &shared.root, &shared.entry).await?;
+    tracing::debug!(shared_dir=%shared.entry.display(), "Populated the shared cache");
+    Ok(())
+}
+
+/// Copy a cache entry (including its manifest) into a cache rooted at `root`,
+/// replacing whatever was there.
+async fn copy_entry(src: &Path, root: &Path, dest: &Path) -> Result<(), Error> {
+    tokio::fs::create_dir_all(root)
+        .await
+        .with_context(|| format!("Unable to create \"{}\"", root.display()))?;
+    let temp = TempDir::new_in(root).context("Unable to create a temporary directory")?;
+
+    let mut entries = tokio::fs::read_dir(src)
+        .await
+        .with_context(|| format!("Unable to read \"{}\"", src.display()))?;
+
+    while let Some(entry) = entries.next_entry().await? {
+        // The unpacked tarball is cheap to recreate, so it isn't copied
+        if entry.file_type().await?.is_dir() {
+            continue;
+        }
+
+        let from = entry.path();
+        let to = temp.path().join(entry.file_name());
+        tokio::fs::copy(&from, &to)
+            .await
+            .with_context(|| format!("Unable to copy \"{}\"", from.display()))?;
+    }
+
+    persist(temp, dest).await
+}
+
+/// Extract a cached tarball into its cache entry (if that hasn't been done
+/// already), returning the directory it was extracted to.
+async fn unpack_cached_tarball(cache_dir: &Path, tarball: &Path) -> Result<PathBuf, Error> {
+    let dest = cache_dir.join(UNPACKED_DIR);
+
+    let _lock = lock_package_version(cache_dir).await?;
+
+    if dest.is_dir() {
+        return Ok(dest);
+    }
+
+    // Extract to a temporary directory first so we never leave a
+    // half-unpacked tree behind
+    let temp = TempDir::new_in(cache_dir).context("Unable to create a temporary directory")?;
+    unpack_tarball(tarball, temp.path()).await?;
+    tokio::fs::rename(temp.path(), &dest)
+        .await
+        .with_context(|| format!("Unable to save to \"{}\"", dest.display()))?;
+
+    Ok(dest)
+}
+
+/// Extract a `*.tar.gz` file into a directory.
+async fn unpack_tarball(tarball: &Path, dest: &Path) -> Result<(), Error> {
+    let tarball = tarball.to_path_buf();
+    let dest = dest.to_path_buf();
+
+    tokio::task::spawn_blocking(move || {
+        let f = std::fs::File::open(&tarball)
+            .with_context(|| format!("Unable to open \"{}\"", tarball.display()))?;
+        let mut archive = tar::Archive::new(flate2::read::GzDecoder::new(f));
+        // Note: unpack() refuses to write anything outside the destination
+        archive
+            .unpack(&dest)
+            .with_context(|| format!("Unable to extract to \"{}\"", dest.display()))?;
+        Ok(())
+    })
+    .await?
+}
+
+/// Take an exclusive lock on a package version's cache entry, blocking until
+/// any other process holding it is done.
+///
+/// The lock is released when the returned file is dropped.
+async fn lock_package_version(cache_dir: &Path) -> Result<std::fs::File, Error> {
+    let mut filename = cache_dir.file_name().unwrap().to_os_string();
+    filename.push(".lock");
+    let lock_path = cache_dir.with_file_name(filename);
+
+    tokio::task::spawn_blocking(move || {
+        if let Some(parent) = lock_path.parent() {
+            std::fs::create_dir_all(parent)
+                .with_context(|| format!("Unable to create \"{}\"", parent.display()))?;
+        }
+
+        let file = std::fs::OpenOptions::new()
+            .create(true)
+            .write(true)
+            .open(&lock_path)
+            .with_context(|| format!("Unable to open \"{}\"", lock_path.display()))?;
+        file.lock_exclusive()
+            .with_context(|| format!("Unable to lock \"{}\"", lock_path.display()))?;
+
+        Ok(file)
+    })
+    .await?
+}
+
+/// Check the manifest in a cache directory and make sure every file it lists
+/// is still intact, returning `None` if the files we want haven't been cached.
+///
+/// Entries without a manifest were either left behind by an interrupted
+/// download or written by an older version of Borealis, so they are treated
+/// as missing and get downloaded again.
+///
+/// Hashing large files on every lookup is expensive, so a file is only hashed
+/// if its size or modification time differs from when it was last checked.
+async fn cached_assets(
+    cache_dir: &Path,
+    tarball_path: Option<&Path>,
+    webc_path: Option<&Path>,
+) -> Result<Option<Assets>, Error> {
+    let manifest_path = cache_dir.join(MANIFEST);
+
+    let raw = match tokio::fs::read(&manifest_path).await {
+        Ok(raw) => raw,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(None),
+        Err(e) => {
+            return Err(
+                Error::new(e).context(format!("Unable to read \"{}\"", manifest_path.display()))
+            )
+        }
+    };
+    let mut manifest: Manifest = serde_json::from_slice(&raw)
+        .with_context(|| format!("Unable to parse \"{}\"", manifest_path.display()))?;
+
+    let file_name = |path: &Path| path.file_name().unwrap().to_string_lossy().into_owned();
+    let wanted = tarball_path.into_iter().chain(webc_path);
+
+    for path in wanted {
+        if !manifest.files.contains_key(&file_name(path)) {
+            // Probably cached by an experiment that wanted other artifacts
+            return Ok(None);
+        }
+    }
+
+    let mut total_size = 0;
+    let mut rechecked = false;
+
+    for (filename, expected) in &mut manifest.files {
+        let path = cache_dir.join(filename);
+        let metadata = tokio::fs::metadata(&path)
+            .await
+            .with_context(|| format!("Unable to read \"{}\"", path.display()))?;
+        let modified = metadata.modified().ok();
+
+        if metadata.len() == expected.size
+            && expected.modified.is_some()
+            && expected.modified == modified
+        {
+            total_size += expected.size;
+            continue;
+        }
+
+        let contents = tokio::fs::read(&path)
+            .await
+            .with_context(|| format!("Unable to read \"{}\"", path.display()))?;
+        let actual = FileEntry::for_contents(&contents);
+
+        anyhow::ensure!(
+            actual.size == expected.size && actual.sha256 == expected.sha256,
+            "\"{}\" doesn't match the manifest (expected {expected:?}, found {actual:?})",
+            path.display(),
+        );
+
+        expected.modified = modified;
+        rechecked = true;
+        total_size += actual.size;
+    }
+
+    if rechecked {
+        // Remember the files are intact so the next lookup can skip hashing
+        if let Err(e) = save_manifest(cache_dir, &manifest).await {
+            tracing::warn!(error = &*e, "Unable to update the cache manifest");
+        }
+    }
+
+    Ok(Some(Assets {
+        tarball: tarball_path.map(Path::to_path_buf),
+        webc: webc_path.map(Path::to_path_buf),
+        unpacked: None,
+        total_size,
+    }))
+}
+
 async fn do_download(
     client: &Client,
     dir: &Path,
     cache_dir: &Path,
-    tarball_path: PathBuf,
-    webc_path: PathBuf,
+    tarball_path: Option<PathBuf>,
+    webc_path: Option<PathBuf>,
     test_case: &TestCase,
 ) -> Result<Assets, Error> {
     tokio::fs::create_dir_all(dir)
@@ -188,28 +602,50 @@ async fn do_download(
         .with_context(|| format!("Unable to create \"{}\"", dir.display()))?;
     let temp = TempDir::new_in(dir).context("Unable to create a temporary directory")?;
 
+    let mut manifest = Manifest::default();
+    let mut bytes_downloaded = 0;
+
+    let downloads = [
+        (tarball_path.as_deref(), Some(test_case.tarball_url())),
+        (webc_path.as_deref(), test_case.webc_url()),
+    ];
+
     // Download our files to a temporary directory
-    let mut bytes_downloaded = download_file(
-        client,
-        test_case.tarball_url(),
-        temp.path().join(tarball_path.file_name().unwrap()),
-    )
-    .await
-    .with_context(|| format!("Downloading \"{}\" failed", test_case.tarball_url()))?;
-    if let Some(url) = test_case.webc_url() {
-        bytes_downloaded += download_file(
-            client,
-            url,
-            temp.path().join(webc_path.file_name().unwrap()),
-        )
-        .await
-        .with_context(|| format!("Downloading \"{url}\" failed"))?;
+    for (path, url) in downloads {
+        let (Some(path), Some(url)) = (path, url) else {
+            continue;
+        };
+
+        let filename = path.file_name().unwrap();
+        let entry = download_file(client, url, temp.path().join(filename))
+            .await
+            .with_context(|| format!("Downloading \"{url}\" failed"))?;
+        bytes_downloaded += entry.size;
+        manifest
+            .files
+            .insert(filename.to_string_lossy().into_owned(), entry);
     }
 
+    // The manifest is written last so its presence means every file was
+    // downloaded successfully.
+    save_manifest(temp.path(), &manifest).await?;
+
+    persist(temp, cache_dir).await?;
+
+    Ok(Assets {
+        tarball: tarball_path,
+        webc: webc_path,
+        unpacked: None,
+        total_size: bytes_downloaded,
+    })
+}
+
+/// Move a temporary directory into the cache, replacing any existing entry.
+async fn persist(temp: TempDir, cache_dir: &Path) -> Result<(), Error> {
     tracing::debug!(
         from=%temp.path().display(),
         to=%cache_dir.display(),
-        "Persisting downloaded artifacts",
+        "Persisting cached artifacts",
     );
 
     // Before persisting the downloaded directory, make sure we remove
@@ -250,33 +686,30 @@ async fn do_download(
         return Err(error);
     }
 
-    Ok(Assets {
-        tarball: tarball_path,
-        webc: test_case
-            .package_version
-            .distribution
-            .pirita_download_url
-            .is_some()
-            .then_some(webc_path),
-        total_size: bytes_downloaded,
-    })
+    Ok(())
 }
 
 #[tracing::instrument(skip_all, fields(url=tracing::field::Empty, bytes_read=tracing::field::Empty))]
-async fn download_file(client: &Client, url: &str, dest: impl AsRef<Path>) -> Result<u64, Error> {
+async fn download_file(
+    client: &Client,
+    url: &str,
+    dest: impl AsRef<Path>,
+) -> Result<FileEntry, Error> {
     let url = Url::parse(url)?;
     tracing::Span::current().record("url", url.path());
 
     let dest = dest.as_ref();
     tracing::debug!(dest=%dest.display(), "Downloading");
 
-    let payload = client
-        .get(url)
-        .send()
-        .await?
-        .error_for_status()?
-        .bytes()
-        .await?;
+    let permit = politeness::acquire(url.as_str()).await;
+    if let Err(e) = faults::inject(faults::Request::Download).await {
+        permit.record(false);
+        return Err(e);
+    }
+    let response = client.get(url).send().await;
+    permit.record(registry::is_success(&response));
+
+    let payload = response?.error_for_status()?.bytes().await?;
 
     tracing::Span::current().record("bytes_read", payload.len());
     tracing::debug!("Download complete");
@@ -285,12 +718,369 @@ async fn download_file(client: &Client, url: &str, dest: impl AsRef<Path>) -> Re
         .await
         .with_context(|| format!("Unable to save to \"{}\"", dest.display()))?;
 
-    Ok(payload.len().try_into().unwrap())
+    Ok(FileEntry {
+        modified: modified_time(dest).await?,
+        ..FileEntry::for_contents(&payload)
+    })
 }
 
-pub fn package_version_dir(dir: &Path, test_case: &TestCase) -> PathBuf {
-    dir.join(&test_case.registry)
-        .join(&test_case.namespace)
-        .join(&test_case.package_name)
-        .join(test_case.version())
+/// Atomically write a cache entry's manifest, so it is never seen half
+/// written.
+async fn save_manifest(cache_dir: &Path, manifest: &Manifest) -> Result<(), Error> {
+    let path = cache_dir.join(MANIFEST);
+    let temp = tempfile::NamedTempFile::new_in(cache_dir)
+        .context("Unable to create a temporary file")?
+        .into_temp_path();
+
+    tokio::fs::write(&temp, serde_json::to_vec_pretty(manifest)?)
+        .await
+        .with_context(|| format!("Unable to save to \"{}\"", temp.display()))?;
+    temp.persist(&path)
+        .with_context(|| format!("Unable to save to \"{}\"", path.display()))?;
+
+    Ok(())
+}
+
+/// When a file was last modified, if the platform records it.
+async fn modified_time(path: &Path) -> Result<Option<SystemTime>, Error> {
+    let metadata = tokio::fs::metadata(path)
+        .await
+        .with_context(|| format!("Unable to read \"{}\"", path.display()))?;
+    Ok(metadata.modified().ok())
+}
+
+/// The name of the file, stored alongside a package's cached assets, which
+/// records what was downloaded.
+const MANIFEST: &str = "manifest.json";
+/// The directory, inside a package version's cache entry, that its tarball
+/// is extracted to.
+const UNPACKED_DIR: &str = "package";
+
+#[derive(Debug, Default, serde::Serialize, serde::Deserialize)]
+struct Manifest {
+    files: IndexMap<String, FileEntry>,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+struct FileEntry {
+    size: u64,
+    sha256: String,
+    /// The file's modification time when it was last checked against
+    /// `sha256`.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    modified: Option<SystemTime>,
+}
+
+impl FileEntry {
+    fn for_contents(contents: &[u8]) -> Self {
+        FileEntry {
+            size: contents.len().try_into().unwrap(),
+            sha256: format!("{:x}", Sha256::digest(contents)),
+            modified: None,
+        }
+    }
+}
+
+/// The bytes every webc file starts with.
+const WEBC_MAGIC: &[u8] = b"\0webc";
+/// The webc format versions we know about.
+const WEBC_VERSIONS: [&[u8]; 3] = [b"001", b"002", b"003"];
+
+/// Do a quick sanity check on a webc file's header so corrupt downloads are
+/// caught before handing them to the `wasmer` CLI.
+pub(crate) async fn validate_webc(path: &Path) -> Result<(), Error> {
+    let mut header = [0_u8; 8];
+    let mut f = tokio::fs::File::open(path)
+        .await
+        .with_context(|| format!("Unable to open \"{}\"", path.display()))?;
+    f.read_exact(&mut header)
+        .await
+        .with_context(|| format!("\"{}\" is too short to be a webc file", path.display()))?;
+
+    let (magic, version) = header.split_at(WEBC_MAGIC.len());
+
+    anyhow::ensure!(
+        magic == WEBC_MAGIC,
+        "\"{}\" isn't a webc file (magic bytes: {magic:?})",
+        path.display(),
+    );
+    anyhow::ensure!(
+        WEBC_VERSIONS.contains(&version),
+        "\"{}\" has an unknown webc version, {:?}",
+        path.display(),
+        String::from_utf8_lossy(version),
+    );
+
+    Ok(())
+}
+
+/// The deterministic name an asset is saved as, regardless of what its
+/// download URL looks like (e.g. `package-1.2.3.webc`).
+fn asset_file_name(test_case: &TestCase, extension: &str) -> String {
+    format!(
+        "{}-{}.{extension}",
+        sanitize_file_name(&test_case.package_name),
+        sanitize_file_name(test_case.version()),
+    )
+}
+
+/// Replace anything that could be interpreted as a path separator or is
+/// otherwise awkward in a filename.
+pub(crate) fn sanitize_file_name(name: &str) -> String {
+    let sanitized: String = name
+        .chars()
+        .map(|c| match c {
+            'a'..='z' | 'A'..='Z' | '0'..='9' | '-' | '_' | '.' | '+' => c,
+            _ => '_',
+        })
+        .collect();
+
+    match sanitized.trim_start_matches('.') {
+        "" => "_".to_string(),
+        s => s.to_string(),
+    }
+}
+
+/// Where a package version's assets are cached.
+///
+/// Packages downloaded under a profile (e.g. with a particular token) are kept
+/// separate from everyone else's so private packages can't leak between
+/// accounts.
+pub fn package_version_dir(dir: &Path, profile: Option<&str>, test_case: &TestCase) -> PathBuf {
+    let registry = sanitize_file_name(&test_case.registry);
+    let registry = match profile {
+        Some(profile) => format!("{registry}@{}", sanitize_file_name(profile)),
+        None => registry,
+    };
+
+    dir.join(registry).join(package_version_path(test_case))
+}
+
+/// The `namespace/name/version` path used for a package version's
+/// directories, with each component sanitized so a malicious package can't
+/// escape the directory it is joined to.
+pub(crate) fn package_version_path(test_case: &TestCase) -> PathBuf {
+    [
+        test_case.namespace.as_str(),
+        test_case.package_name.as_str(),
+        test_case.version(),
+    ]
+    .into_iter()
+    .map(sanitize_file_name)
+    .collect()
+}
+
+/// A summary of what is currently stored in a cache directory.
+#[derive(Debug, Default, Clone, PartialEq, Eq, serde::Serialize)]
+pub struct DiskUsage {
+    /// The number of package versions stored for each registry.
+    pub package_versions: IndexMap<String, usize>,
+    /// The total size of all cached files, in bytes.
+    pub total_size: u64,
+}
+
+/// Inspect a cache directory to see what it contains.
+pub fn disk_usage(dir: &Path) -> Result<DiskUsage, Error> {
+    let mut usage = DiskUsage::default();
+
+    if !dir.exists() {
+        return Ok(usage);
+    }
+
+    // The cache is laid out as $registry[@$profile]/$namespace/$package/$version
+    // (see package_version_dir()).
+    for registry in read_dirs(dir)? {
+        let name = registry.file_name().unwrap().to_string_lossy().into_owned();
+        let mut count = 0;
+
+        for namespace in read_dirs(&registry)? {
+            for package in read_dirs(&namespace)? {
+                count += read_dirs(&package)?.len();
+            }
+        }
+
+        usage.total_size += dir_size(&registry)?;
+        usage.package_versions.insert(name, count);
+    }
+
+    usage.package_versions.sort_keys();
+
+    Ok(usage)
+}
+
+fn read_dirs(dir: &Path) -> Result<Vec<PathBuf>, Error> {
+    let mut dirs = Vec::new();
+
+    for entry in
+        std::fs::read_dir(dir).with_context(|| format!("Unable to read \"{}\"", dir.display()))?
+    {
+        let entry = entry?;
+        // Skip any in-progress downloads
+        let is_hidden = entry.file_name().to_string_lossy().starts_with('.');
+        if entry.file_type()?.is_dir() && !is_hidden {
+            dirs.push(entry.path());
+        }
+    }
+
+    Ok(dirs)
+}
+
+fn dir_size(dir: &Path) -> Result<u64, Error> {
+    let mut size = 0;
+
+    for entry in
+        std::fs::read_dir(dir).with_context(|| format!("Unable to read \"{}\"", dir.display()))?
+    {
+        let entry = entry?;
+        let meta = entry.metadata()?;
+
+        if meta.is_dir() {
+            size += dir_size(&entry.path())?;
+        } else {
+            size += meta.len();
+        }
+    }
+
+    Ok(size)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn sanitize_awkward_file_names() {
+        let inputs = [
+            ("cowsay", "cowsay"),
+            ("python.wasm", "python.wasm"),
+            ("1.2.3-rc.1+build.5", "1.2.3-rc.1+build.5"),
+            ("../../etc/passwd", "_.._etc_passwd"),
+            ("..", "_"),
+            ("a\\b c", "a_b_c"),
+            (
+                "package.webc?X-Amz-Signature=abc&X-Amz-Expires=60",
+                "package.webc_X-Amz-Signature_abc_X-Amz-Expires_60",
+            ),
+        ];
+
+        for (input, expected) in inputs {
+            assert_eq!(sanitize_file_name(input), expected, "{input}");
+        }
+    }
+
+    #[test]
+    fn package_version_dirs_stay_inside_the_cache() {
+        let test_case: TestCase = serde_json::from_value(serde_json::json!({
+            "registry": "registry.wasmer.io",
+            "namespace": "..",
+            "package_name": "../../etc",
+            "package_version": {
+                "id": "evil@1.0.0",
+                "version": "/passwd",
+                "distribution": {
+                    "downloadUrl": "https://example.com/evil.tar.gz",
+                    "piritaDownloadUrl": null,
+                },
+                "description": null,
+                "repository": null,
+                "homepage": null,
+            },
+        }))
+        .unwrap();
+
+        let dir = package_version_dir(Path::new("/cache"), Some("../me"), &test_case);
+
+        assert_eq!(
+            dir,
+            Path::new("/cache/registry.wasmer.io@_me/_/_.._etc/_passwd")
+        );
+    }
+
+    /// A test case whose assets are served from S3-style presigned URLs, which
+    /// get a fresh signature every time the registry is queried.
+    fn presigned_test_case(addr: std::net::SocketAddr, signature: &str) -> TestCase {
+        let query = format!(
+            "X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=AKIA%2F20240101&X-Amz-Expires=3600&X-Amz-Signature={signature}"
+        );
+
+        serde_json::from_value(serde_json::json!({
+            "registry": "registry.wasmer.io",
+            "namespace": "wasmer",
+            "package_name": "python",
+            "package_version": {
+                "id": "wasmer/python@3.12.0",
+                "version": "3.12.0",
+                "distribution": {
+                    "downloadUrl": format!("http://{addr}/python.tar.gz?{query}"),
+                    "piritaDownloadUrl": format!("http://{addr}/python.webc?{query}"),
+                },
+                "description": null,
+                "repository": null,
+                "homepage": null,
+            },
+        }))
+        .unwrap()
+    }
+
+    #[tokio::test]
+    async fn presigned_urls_are_cached_without_their_query_string() {
+        use axum::{extract::State, routing::get, Router};
+
+        let downloads = Arc::new(AtomicUsize::new(0));
+        let app = Router::new()
+            .route(
+                "/:name",
+                get(|State(downloads): State<Arc<AtomicUsize>>| async move {
+                    downloads.fetch_add(1, Ordering::SeqCst);
+                    "contents"
+                }),
+            )
+            .with_state(downloads.clone());
+        let listener = std::net::TcpListener::bind("127.0.0.1:0").unwrap();
+        listener.set_nonblocking(true).unwrap();
+        let addr = listener.local_addr().unwrap();
+        tokio::spawn(
+            axum::Server::from_tcp(listener)
+                .unwrap()
+                .serve(app.into_make_service()),
+        );
+
+        let temp = tempfile::tempdir().unwrap();
+        let first = presigned_test_case(addr, "abc123");
+        let cache_dir = package_version_dir(temp.path(), None, &first);
+        let tarball = cache_dir.join(asset_file_name(&first, "tar.gz"));
+        let webc = cache_dir.join(asset_file_name(&first, "webc"));
+
+        let assets = do_download(
+            &Client::new(),
+            temp.path(),
+            &cache_dir,
+            Some(tarball.clone()),
+            Some(webc.clone()),
+            &first,
+        )
+        .await
+        .unwrap();
+
+        assert_eq!(
+            cache_dir,
+            temp.path().join("registry.wasmer.io/wasmer/python/3.12.0")
+        );
+        assert_eq!(assets.tarball, Some(cache_dir.join("python-3.12.0.tar.gz")));
+        assert_eq!(assets.webc, Some(cache_dir.join("python-3.12.0.webc")));
+        assert_eq!(downloads.load(Ordering::SeqCst), 2);
+
+        // The next run sees the same package version with a new signature
+        let second = presigned_test_case(addr, "def456");
+        assert_eq!(package_version_dir(temp.path(), None, &second), cache_dir);
+        assert_eq!(asset_file_name(&second, "tar.gz"), "python-3.12.0.tar.gz");
+
+        let cached = cached_assets(&cache_dir, Some(&tarball), Some(&webc))
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(cached.tarball, assets.tarball);
+        assert_eq!(cached.webc, assets.webc);
+        assert_eq!(downloads.load(Ordering::SeqCst), 2);
+    }
 }
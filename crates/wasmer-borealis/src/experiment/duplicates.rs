@@ -0,0 +1,242 @@
+//! Spotting when an experiment has already been run, so nobody burns hours
+//! re-running identical work by accident.
+
+use std::{
+    path::{Path, PathBuf},
+    time::SystemTime,
+};
+
+use anyhow::Error;
+use indexmap::IndexMap;
+use url::Url;
+
+use crate::{
+    config::Experiment,
+    experiment::{results, WasmerBuild},
+};
+
+/// A previous run of an experiment.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Duplicate {
+    /// The run's `results.json` file.
+    pub results: PathBuf,
+    /// When the run finished.
+    pub finished: SystemTime,
+}
+
+/// Just enough of a `results.json` file to tell whether it is a duplicate.
+#[derive(serde::Deserialize)]
+struct Summary {
+    experiment: Experiment,
+    #[serde(default)]
+    registry: Option<String>,
+    #[serde(default)]
+    wasmer: Option<WasmerBuild>,
+    #[serde(default)]
+    matrix: IndexMap<String, WasmerBuild>,
+    #[serde(default)]
+    cancelled: bool,
+    #[serde(default)]
+    finished_at: Option<SystemTime>,
+}
+
+/// Search the runs in `runs_dir` (i.e. `$runs_dir/*/results.json`) for any
+/// which used the same [`Experiment`] definition, `wasmer` version, builds for
+/// each `wasmer.matrix` entry, and registry, newest first. Runs which were
+/// cancelled are never duplicates.
+///
+/// Experiments are compared after being deserialized, so differences in
+/// formatting, field order, or fields which were set to their defaults
+/// don't matter.
+pub fn find_duplicates(
+    experiment: &Experiment,
+    wasmer: &WasmerBuild,
+    matrix: &IndexMap<String, WasmerBuild>,
+    registry: &Url,
+    runs_dir: &Path,
+) -> Result<Vec<Duplicate>, Error> {
+    let mut duplicates = Vec::new();
+
+    let entries = match std::fs::read_dir(runs_dir) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(duplicates),
+        Err(e) => {
+            return Err(
+                Error::from(e).context(format!("Unable to read \"{}\"", runs_dir.display()))
+            );
+        }
+    };
+
+    for entry in entries {
+        let path = entry?.path().join("results.json");
+        if !path.is_file() {
+            continue;
+        }
+
+        let summary: Summary = match std::fs::read_to_string(&path)
+            .map_err(Error::from)
+            .and_then(|raw| serde_json::from_str(&raw).map_err(Error::from))
+        {
+            Ok(summary) => summary,
+            Err(e) => {
+                // Probably from an older or newer version of Borealis
+                tracing::debug!(
+                    path=%path.display(),
+                    error=&*e,
+                    "Skipping results which couldn't be loaded",
+                );
+                continue;
+            }
+        };
+
+        let same_wasmer = summary
+            .wasmer
+            .as_ref()
+            .is_some_and(|w| w.version == wasmer.version);
+        // Named builds (e.g. "nightly") can change between runs
+        let same_matrix = summary.matrix.len() == matrix.len()
+            && matrix.iter().all(|(label, build)| {
+                summary
+                    .matrix
+                    .get(label)
+                    .is_some_and(|b| b.version == build.version)
+            });
+        let same_registry = summary.registry.as_deref() == Some(registry.as_str());
+
+        // A cancelled run only has some of the results
+        if summary.experiment == *experiment
+            && same_wasmer
+            && same_matrix
+            && same_registry
+            && !summary.cancelled
+        {
+            let finished = results::finished(summary.finished_at, &path)?;
+            duplicates.push(Duplicate {
+                results: path,
+                finished,
+            });
+        }
+    }
+
+    duplicates.sort_by(|a, b| b.finished.cmp(&a.finished));
+
+    Ok(duplicates)
+}
+
+#[cfg(test)]
+mod tests {
+    use serde_json::json;
+
+    use super::*;
+
+    #[test]
+    fn only_identical_experiments_with_the_same_wasmer_and_registry_are_duplicates() {
+        let temp = tempfile::tempdir().unwrap();
+        let experiment: Experiment =
+            serde_json::from_value(json!({ "package": "wasmer/python", "args": ["--version"] }))
+                .unwrap();
+        let wasmer = WasmerBuild {
+            version: "wasmer 4.2.0".to_string(),
+            metadata: Default::default(),
+        };
+        let runs = [
+            // Formatting and explicit defaults don't matter
+            (
+                "same",
+                r#"{"experiment": {"args": ["--version"], "package": "wasmer/python", "unpack-tarball": false},
+                    "wasmer": {"version": "wasmer 4.2.0"}, "registry": "https://registry.wasmer.io/graphql"}"#,
+            ),
+            (
+                "different-args",
+                r#"{"experiment": {"package": "wasmer/python"}, "wasmer": {"version": "wasmer 4.2.0"},
+                    "registry": "https://registry.wasmer.io/graphql"}"#,
+            ),
+            (
+                "different-wasmer",
+                r#"{"experiment": {"package": "wasmer/python", "args": ["--version"]},
+                    "wasmer": {"version": "wasmer 4.1.0"}, "registry": "https://registry.wasmer.io/graphql"}"#,
+            ),
+            (
+                "cancelled",
+                r#"{"experiment": {"package": "wasmer/python", "args": ["--version"]},
+                    "wasmer": {"version": "wasmer 4.2.0"}, "registry": "https://registry.wasmer.io/graphql",
+                    "cancelled": true}"#,
+            ),
+            (
+                "different-registry",
+                r#"{"experiment": {"package": "wasmer/python", "args": ["--version"]},
+                    "wasmer": {"version": "wasmer 4.2.0"}, "registry": "https://registry.wasmer.wtf/graphql"}"#,
+            ),
+            ("corrupted", "{"),
+        ];
+        for (name, results) in runs {
+            let dir = temp.path().join(name);
+            std::fs::create_dir(&dir).unwrap();
+            std::fs::write(dir.join("results.json"), results).unwrap();
+        }
+
+        let registry: Url = "https://registry.wasmer.io/graphql".parse().unwrap();
+
+        let duplicates = find_duplicates(
+            &experiment,
+            &wasmer,
+            &IndexMap::new(),
+            &registry,
+            temp.path(),
+        )
+        .unwrap();
+
+        assert_eq!(duplicates.len(), 1);
+        assert_eq!(
+            duplicates[0].results,
+            temp.path().join("same").join("results.json")
+        );
+    }
+
+    #[test]
+    fn runs_with_a_different_matrix_build_are_not_duplicates() {
+        let temp = tempfile::tempdir().unwrap();
+        let experiment: Experiment = serde_json::from_value(json!({
+            "package": "wasmer/python",
+            "wasmer": { "matrix": ["4.2.0", "nightly"] },
+        }))
+        .unwrap();
+        let build = |version: &str| WasmerBuild {
+            version: version.to_string(),
+            metadata: Default::default(),
+        };
+        let wasmer = build("wasmer 4.2.0");
+        let matrix: IndexMap<String, WasmerBuild> = [
+            ("4.2.0".to_string(), build("wasmer 4.2.0")),
+            ("nightly".to_string(), build("wasmer 4.3.0-nightly.2")),
+        ]
+        .into_iter()
+        .collect();
+        let runs = [
+            ("same", "wasmer 4.3.0-nightly.2"),
+            // The nightly build has moved on since this run
+            ("older-nightly", "wasmer 4.3.0-nightly.1"),
+        ];
+        for (name, nightly) in runs {
+            let dir = temp.path().join(name);
+            std::fs::create_dir(&dir).unwrap();
+            let results = json!({
+                "experiment": experiment,
+                "wasmer": wasmer,
+                "matrix": { "4.2.0": build("wasmer 4.2.0"), "nightly": build(nightly) },
+                "registry": "https://registry.wasmer.io/graphql",
+            });
+            std::fs::write(dir.join("results.json"), results.to_string()).unwrap();
+        }
+        let registry: Url = "https://registry.wasmer.io/graphql".parse().unwrap();
+
+        let duplicates =
+            find_duplicates(&experiment, &wasmer, &matrix, &registry, temp.path()).unwrap();
+
+        assert_eq!(duplicates.len(), 1);
+        assert_eq!(
+            duplicates[0].results,
+            temp.path().join("same").join("results.json")
+        );
+    }
+}
@@ -0,0 +1,193 @@
+//! An append-only log of the changes made to a `results.json` file after the
+//! experiment finished (e.g. triage), so the results can be viewed exactly as
+//! they were at any point in time.
+
+use std::{
+    io::Write,
+    path::{Path, PathBuf},
+    time::SystemTime,
+};
+
+use anyhow::{Context, Error};
+
+use crate::experiment::{Results, Triage};
+
+/// The file changes are logged to, alongside `results.json`.
+const HISTORY_FILE: &str = "history.jsonl";
+
+/// A change to one of the test cases in a `results.json` file.
+#[derive(Debug, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+pub struct Change {
+    pub timestamp: SystemTime,
+    pub display_name: String,
+    pub version: String,
+    /// The entry from the experiment's `wasmer.matrix` the test case was run
+    /// with, if any.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub wasmer: Option<String>,
+    /// The test case's triage information before the change.
+    pub before: Option<Triage>,
+    /// The test case's triage information after the change.
+    pub after: Option<Triage>,
+}
+
+fn history_file(results_json: &Path) -> PathBuf {
+    results_json.with_file_name(HISTORY_FILE)
+}
+
+/// Append some changes to the history kept alongside a `results.json` file.
+pub fn record_changes(results_json: &Path, changes: &[Change]) -> Result<(), Error> {
+    let path = history_file(results_json);
+
+    let mut lines = Vec::new();
+    for change in changes {
+        serde_json::to_writer(&mut lines, change)?;
+        lines.push(b'\n');
+    }
+
+    std::fs::OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(&path)
+        .and_then(|mut f| f.write_all(&lines))
+        .with_context(|| format!("Unable to append to \"{}\"", path.display()))?;
+
+    Ok(())
+}
+
+/// Undo every change made to `results` after `as_of`, using the history kept
+/// alongside its `results.json` file.
+pub fn rewind(results: &mut Results, results_json: &Path, as_of: SystemTime) -> Result<(), Error> {
+    let path = history_file(results_json);
+
+    let raw = match std::fs::read_to_string(&path) {
+        Ok(raw) => raw,
+        // Nothing has changed since the experiment finished
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(()),
+        Err(e) => {
+            return Err(Error::new(e).context(format!("Unable to read \"{}\"", path.display())))
+        }
+    };
+
+    let mut changes = Vec::new();
+    for (i, line) in raw.lines().enumerate() {
+        let change: Change = serde_json::from_str(line)
+            .with_context(|| format!("Unable to parse line {} of \"{}\"", i + 1, path.display()))?;
+        changes.push(change);
+    }
+
+    // Undo the newest changes first
+    for change in changes.iter().rev().filter(|c| c.timestamp > as_of) {
+        let report = results.reports.iter_mut().find(|r| {
+            r.display_name == change.display_name
+                && r.package_version.version == change.version
+                && r.wasmer == change.wasmer
+        });
+        match report {
+            Some(report) => report.triage = change.before.clone(),
+            None => tracing::warn!(
+                test_case = %format!("{}@{}", change.display_name, change.version),
+                "The history mentions a test case that isn't in the results",
+            ),
+        }
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use serde_json::json;
+
+    use super::*;
+    use crate::experiment::TriageState;
+
+    fn results() -> Results {
+        let report = |wasmer: &str| {
+            json!({
+                "display_name": "wasmer/python",
+                "package_version": {
+                    "id": "python@3.12.0",
+                    "version": "3.12.0",
+                    "distribution": {
+                        "downloadUrl": "https://example.com/python.tar.gz",
+                        "piritaDownloadUrl": null,
+                    },
+                    "description": null,
+                    "repository": null,
+                    "homepage": null,
+                },
+                "wasmer": wasmer,
+                "outcome": {
+                    "outcome": "completed",
+                    "status": { "success": false, "code": 1 },
+                    "run_time": { "secs": 1, "nanos": 0 },
+                    "base_dir": format!("/tmp/experiment/{wasmer}/wasmer/python/3.12.0"),
+                },
+            })
+        };
+
+        serde_json::from_value(json!({
+            "experiment": { "package": "wasmer/runner" },
+            "reports": [report("4.1.0"), report("4.2.0")],
+            "total_time": { "secs": 1, "nanos": 0 },
+            "experiment_dir": "/tmp/experiment",
+        }))
+        .unwrap()
+    }
+
+    fn triage(state: TriageState) -> Option<Triage> {
+        Some(Triage {
+            state,
+            assignee: None,
+            note: None,
+        })
+    }
+
+    #[test]
+    fn rewind_undoes_changes_to_the_right_matrix_entry() {
+        let temp = tempfile::tempdir().unwrap();
+        let results_json = temp.path().join("results.json");
+        let start = SystemTime::UNIX_EPOCH + Duration::from_secs(1_700_000_000);
+        let change = |secs: u64, before: Option<Triage>, after: Option<Triage>| Change {
+            timestamp: start + Duration::from_secs(secs),
+            display_name: "wasmer/python".to_string(),
+            version: "3.12.0".to_string(),
+            wasmer: Some("4.2.0".to_string()),
+            before,
+            after,
+        };
+
+        // The same test case was run with wasmer 4.1.0 and 4.2.0, but only
+        // the 4.2.0 one has been triaged since the experiment finished
+        let mut results = results();
+        results.reports[0].triage = triage(TriageState::Expected);
+        results.reports[1].triage = triage(TriageState::Fixed);
+        record_changes(
+            &results_json,
+            &[change(10, None, triage(TriageState::BugFiled))],
+        )
+        .unwrap();
+        record_changes(
+            &results_json,
+            &[change(
+                20,
+                triage(TriageState::BugFiled),
+                triage(TriageState::Fixed),
+            )],
+        )
+        .unwrap();
+
+        rewind(&mut results, &results_json, start + Duration::from_secs(15)).unwrap();
+
+        assert_eq!(results.reports[0].triage, triage(TriageState::Expected));
+        assert_eq!(results.reports[1].triage, triage(TriageState::BugFiled));
+
+        rewind(&mut results, &results_json, start).unwrap();
+
+        assert_eq!(results.reports[0].triage, triage(TriageState::Expected));
+        assert_eq!(results.reports[1].triage, None);
+    }
+}
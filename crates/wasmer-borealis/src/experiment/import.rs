@@ -0,0 +1,352 @@
+//! Bringing in outcomes from test cases that were run outside Borealis (e.g.
+//! by a one-off script on an exotic platform), so they can be reported on and
+//! triaged like any other experiment's results.
+
+use std::{
+    collections::HashSet,
+    io::BufRead,
+    path::Path,
+    time::{Duration, SystemTime},
+};
+
+use anyhow::{Context, Error};
+use indexmap::IndexMap;
+use url::Url;
+
+use crate::{
+    config::Experiment,
+    experiment::{
+        builder, cache,
+        results::{CacheStats, ExitStatus},
+        runner, wapm, Outcome, Report, Results, TestCase,
+    },
+};
+
+/// The outcome of a single test case which was run outside Borealis.
+///
+/// This is one line of the newline-delimited JSON accepted by
+/// [`parse_external_outcomes()`].
+#[derive(Debug, Clone, PartialEq, serde::Serialize, serde::Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub struct ExternalOutcome {
+    /// The package's name (e.g. `wasmer/python`).
+    pub package: String,
+    pub version: String,
+    /// The exit code. This is required unless the test case timed out.
+    #[serde(default)]
+    pub exit_code: Option<i32>,
+    /// Set when the test case was killed for running too long.
+    #[serde(default)]
+    pub timed_out: bool,
+    /// How long the test case ran for.
+    #[serde(default)]
+    pub run_time_secs: f64,
+    #[serde(default)]
+    pub stdout: String,
+    #[serde(default)]
+    pub stderr: String,
+}
+
+/// Parse newline-delimited JSON where each line is an [`ExternalOutcome`].
+///
+/// Blank lines are ignored.
+pub fn parse_external_outcomes(reader: impl BufRead) -> Result<Vec<ExternalOutcome>, Error> {
+    let mut outcomes = Vec::new();
+
+    for (i, line) in reader.lines().enumerate() {
+        let line = line?;
+        if line.trim().is_empty() {
+            continue;
+        }
+
+        let outcome = serde_json::from_str(&line)
+            .with_context(|| format!("Unable to parse line {}", i + 1))?;
+        outcomes.push(outcome);
+    }
+
+    Ok(outcomes)
+}
+
+/// Turn outcomes from an external run into [`Results`] for `experiment`,
+/// saving them to `experiment_dir` as if the experiment had been run by
+/// Borealis.
+///
+/// Every outcome must match one of the experiment's `test_cases` (see
+/// [`crate::experiment::ExperimentBuilder::dry_run()`]), discovered on the
+/// `registry`, so it can be linked to the package version that was tested, and each package version can only
+/// appear once. The experiment's expectations are checked, but its
+/// classifier and hooks are not run.
+pub async fn import_results(
+    experiment: Experiment,
+    registry: &Url,
+    test_cases: &[TestCase],
+    outcomes: Vec<ExternalOutcome>,
+    experiment_dir: &Path,
+) -> Result<Results, Error> {
+    std::fs::create_dir_all(experiment_dir)
+        .with_context(|| format!("Unable to create \"{}\"", experiment_dir.display()))?;
+
+    let mut reports = Vec::new();
+    let mut seen = HashSet::new();
+
+    for outcome in outcomes {
+        let ExternalOutcome {
+            package,
+            version,
+            exit_code,
+            timed_out,
+            run_time_secs,
+            stdout,
+            stderr,
+        } = outcome;
+
+        anyhow::ensure!(
+            seen.insert((package.clone(), version.clone())),
+            "{package}@{version} was imported more than once",
+        );
+
+        let test_case = test_cases
+            .iter()
+            .find(|t| t.display_name() == package && t.version() == version)
+            .with_context(|| {
+                format!("{package}@{version} isn't one of the experiment's test cases")
+            })?;
+        let run_time = Duration::try_from_secs_f64(run_time_secs)
+            .with_context(|| format!("{package}@{version} has an invalid run time"))?;
+
+        let base_dir = experiment_dir
+            .join("experiments")
+            .join(cache::package_version_path(test_case));
+        std::fs::create_dir_all(&base_dir)
+            .with_context(|| format!("Unable to create \"{}\"", base_dir.display()))?;
+        std::fs::write(base_dir.join("stdout.txt"), stdout)?;
+        std::fs::write(base_dir.join("stderr.txt"), stderr)?;
+
+        let outcome = match (exit_code, timed_out) {
+            (Some(_), true) => {
+                anyhow::bail!("{package}@{version} can't have an exit code if it timed out")
+            }
+            (None, false) => anyhow::bail!(
+                "{package}@{version} needs an exit code, or \"timed-out\": true if it was killed"
+            ),
+            (Some(code), false) => {
+                let status = ExitStatus {
+                    success: code == 0,
+                    code,
+                };
+                let overridden = experiment.for_package(&package);
+                let expect = &overridden.expect;
+                let unmet_expectations = if expect.is_empty() {
+                    None
+                } else {
+                    Some(runner::check_expectations(expect, status, &base_dir).await)
+                };
+
+                Outcome::Completed {
+                    status,
+                    run_time,
+                    base_dir,
+                    metrics: IndexMap::new(),
+                    classification: None,
+                    unmet_expectations,
+                    hooks: IndexMap::new(),
+                    truncated: Vec::new(),
+                }
+            }
+            (None, true) => Outcome::TimedOut {
+                timeout: run_time,
+                base_dir,
+                hooks: IndexMap::new(),
+                truncated: Vec::new(),
+            },
+        };
+
+        reports.push(Report {
+            display_name: test_case.display_name(),
+            package_version: test_case.package_version.clone(),
+            artifacts: None,
+            toolchain: None,
+            wasmer: None,
+            outcome,
+            triage: None,
+        });
+    }
+
+    reports.sort_by(|a, b| {
+        a.display_name.cmp(&b.display_name).then_with(|| {
+            wapm::compare_versions(&b.package_version.version, &a.package_version.version)
+        })
+    });
+
+    let results = Results {
+        schema_version: Results::SCHEMA_VERSION,
+        experiment,
+        reports,
+        total_time: Duration::ZERO,
+        finished_at: Some(SystemTime::now()),
+        experiment_dir: experiment_dir.to_path_buf(),
+        cache: CacheStats::default(),
+        registry: Some(registry.to_string()),
+        wasmer: None,
+        matrix: IndexMap::new(),
+        host: None,
+        shuffle_seed: None,
+        cancelled: false,
+    };
+    builder::save(&results, experiment_dir)?;
+
+    Ok(results)
+}
+
+#[cfg(test)]
+mod tests {
+    use serde_json::json;
+
+    use super::*;
+    use crate::{
+        experiment::Category,
+        registry::queries::{PackageDistribution, PackageVersion},
+    };
+
+    fn test_case(package_name: &str, version: &str) -> TestCase {
+        TestCase {
+            registry: "registry.wasmer.io".to_string(),
+            namespace: "wasmer".to_string(),
+            package_name: package_name.to_string(),
+            package_version: PackageVersion {
+                id: cynic::Id::new(format!("{package_name}@{version}")),
+                version: version.to_string(),
+                distribution: PackageDistribution {
+                    download_url: format!("https://example.com/{package_name}.tar.gz"),
+                    pirita_download_url: None,
+                },
+                description: None,
+                repository: None,
+                homepage: None,
+            },
+        }
+    }
+
+    fn registry() -> Url {
+        "https://registry.wasmer.io/graphql".parse().unwrap()
+    }
+
+    #[tokio::test]
+    async fn external_outcomes_are_linked_to_test_cases() {
+        let temp = tempfile::tempdir().unwrap();
+        let experiment: Experiment = serde_json::from_value(json!({
+            "package": "wasmer/runner",
+            "expect": { "stdout": { "contains": ["Hello"] } },
+        }))
+        .unwrap();
+        let test_cases = [test_case("python", "3.12.0"), test_case("qjs", "0.1.0")];
+        let ndjson = r#"
+            {"package": "wasmer/qjs", "version": "0.1.0", "exit-code": 0, "stdout": "Hello, World!"}
+
+            {"package": "wasmer/python", "version": "3.12.0", "timed-out": true, "run-time-secs": 30}
+        "#;
+        let outcomes = parse_external_outcomes(ndjson.as_bytes()).unwrap();
+
+        let results = import_results(experiment, &registry(), &test_cases, outcomes, temp.path())
+            .await
+            .unwrap();
+
+        let categories: Vec<_> = results
+            .reports
+            .iter()
+            .map(|r| (r.display_name.as_str(), r.outcome.category()))
+            .collect();
+        assert_eq!(
+            categories,
+            [
+                ("wasmer/python", Category::Failure),
+                ("wasmer/qjs", Category::Success),
+            ]
+        );
+        assert!(temp.path().join("results.json").exists());
+        let stdout = temp.path().join("experiments/wasmer/qjs/0.1.0/stdout.txt");
+        assert_eq!(std::fs::read_to_string(stdout).unwrap(), "Hello, World!");
+    }
+
+    #[tokio::test]
+    async fn unknown_package_versions_are_rejected() {
+        let temp = tempfile::tempdir().unwrap();
+        let experiment: Experiment =
+            serde_json::from_value(json!({ "package": "wasmer/runner" })).unwrap();
+        let outcomes = vec![ExternalOutcome {
+            package: "wasmer/python".to_string(),
+            version: "0.0.0".to_string(),
+            exit_code: Some(0),
+            timed_out: false,
+            run_time_secs: 1.0,
+            stdout: String::new(),
+            stderr: String::new(),
+        }];
+
+        let err = import_results(
+            experiment,
+            &registry(),
+            &[test_case("python", "3.12.0")],
+            outcomes,
+            temp.path(),
+        )
+        .await
+        .unwrap_err();
+
+        assert_eq!(
+            err.to_string(),
+            "wasmer/python@0.0.0 isn't one of the experiment's test cases"
+        );
+    }
+
+    #[tokio::test]
+    async fn exit_codes_are_required_unless_the_test_case_timed_out() {
+        let temp = tempfile::tempdir().unwrap();
+        let experiment: Experiment =
+            serde_json::from_value(json!({ "package": "wasmer/runner" })).unwrap();
+        let ndjson = r#"{"package": "wasmer/python", "version": "3.12.0", "stdout": "Oops"}"#;
+        let outcomes = parse_external_outcomes(ndjson.as_bytes()).unwrap();
+
+        let err = import_results(
+            experiment,
+            &registry(),
+            &[test_case("python", "3.12.0")],
+            outcomes,
+            temp.path(),
+        )
+        .await
+        .unwrap_err();
+
+        assert_eq!(
+            err.to_string(),
+            "wasmer/python@3.12.0 needs an exit code, or \"timed-out\": true if it was killed"
+        );
+    }
+
+    #[tokio::test]
+    async fn duplicate_package_versions_are_rejected() {
+        let temp = tempfile::tempdir().unwrap();
+        let experiment: Experiment =
+            serde_json::from_value(json!({ "package": "wasmer/runner" })).unwrap();
+        let ndjson = r#"
+            {"package": "wasmer/python", "version": "3.12.0", "exit-code": 0}
+            {"package": "wasmer/python", "version": "3.12.0", "exit-code": 1}
+        "#;
+        let outcomes = parse_external_outcomes(ndjson.as_bytes()).unwrap();
+
+        let err = import_results(
+            experiment,
+            &registry(),
+            &[test_case("python", "3.12.0")],
+            outcomes,
+            temp.path(),
+        )
+        .await
+        .unwrap_err();
+
+        assert_eq!(
+            err.to_string(),
+            "wasmer/python@3.12.0 was imported more than once"
+        );
+    }
+}
@@ -0,0 +1,267 @@
+//! Getting hold of each `wasmer` CLI in an experiment's `wasmer.matrix`.
+
+use std::path::{Path, PathBuf};
+
+use anyhow::{Context, Error};
+use flate2::read::GzDecoder;
+use semver::Version;
+use sha2::{Digest, Sha256};
+
+use crate::{
+    config::WasmerVersion,
+    registry::{self, ClientOptions},
+};
+
+/// One of the `wasmer` CLIs an experiment is run with.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub(crate) struct MatrixEntry {
+    /// The entry from the experiment's `wasmer.matrix`.
+    pub label: String,
+    pub executable: PathBuf,
+}
+
+/// Find (or download) the `wasmer` executable for each entry in an
+/// experiment's `wasmer.matrix`.
+///
+/// Released versions are saved to `$cache_dir/wasmer/$version/` so they only
+/// need to be downloaded once.
+#[tracing::instrument(skip_all)]
+pub(crate) async fn resolve_matrix(
+    matrix: &[WasmerVersion],
+    cache_dir: &Path,
+) -> Result<Vec<MatrixEntry>, Error> {
+    let mut entries = Vec::new();
+
+    for version in matrix {
+        let label = version.to_string();
+        let executable = resolve(version, cache_dir)
+            .await
+            .with_context(|| format!("Unable to find the \"{label}\" wasmer CLI"))?;
+        tracing::debug!(%label, executable = %executable.display(), "Resolved a wasmer CLI");
+        entries.push(MatrixEntry { label, executable });
+    }
+
+    Ok(entries)
+}
+
+/// Find the `wasmer` executable picked by an experiment's `wasmer.version`,
+/// returning `None` if the `wasmer` on `$PATH` should be used.
+pub(crate) async fn resolve_default(
+    version: &WasmerVersion,
+    cache_dir: &Path,
+) -> Result<Option<PathBuf>, Error> {
+    match version {
+        WasmerVersion::Latest => Ok(None),
+        version => resolve(version, cache_dir)
+            .await
+            .map(Some)
+            .with_context(|| format!("Unable to find the \"{version}\" wasmer CLI")),
+    }
+}
+
+/// Find the `wasmer` executable for a [`WasmerVersion`], downloading it if
+/// necessary.
+pub(crate) async fn resolve(version: &WasmerVersion, cache_dir: &Path) -> Result<PathBuf, Error> {
+    match version {
+        WasmerVersion::Local { path } => {
+            anyhow::ensure!(path.is_file(), "\"{}\" doesn't exist", path.display());
+            Ok(path.clone())
+        }
+        WasmerVersion::Release(version) => download_release(version, cache_dir).await,
+        WasmerVersion::Named(name) => {
+            let path = Path::new(name);
+            if path.is_file() {
+                return Ok(path.to_path_buf());
+            }
+
+            if let Some(executable) = find_on_path(&format!("wasmer-{name}")) {
+                return Ok(executable);
+            }
+
+            // Releases are also tagged with a "v" prefix (e.g. "v4.2.0")
+            let version: Version = name.trim_start_matches('v').parse().with_context(|| {
+                format!("Expected a path, a \"wasmer-{name}\" executable on $PATH, or a released version")
+            })?;
+
+            download_release(&version, cache_dir).await
+        }
+        WasmerVersion::Latest => {
+            find_on_path("wasmer").context("Unable to find \"wasmer\" on $PATH")
+        }
+    }
+}
+
+/// Find the `wasmer` executable for a [`WasmerVersion`] without downloading
+/// anything, returning `None` if it isn't available locally.
+pub(crate) fn resolve_cached(version: &WasmerVersion, cache_dir: &Path) -> Option<PathBuf> {
+    match version {
+        WasmerVersion::Local { path } => Some(path.clone()).filter(|path| path.is_file()),
+        WasmerVersion::Release(version) => cached_release(version, cache_dir),
+        WasmerVersion::Named(name) => {
+            let path = Path::new(name);
+            if path.is_file() {
+                return Some(path.to_path_buf());
+            }
+
+            find_on_path(&format!("wasmer-{name}")).or_else(|| {
+                let version: Version = name.trim_start_matches('v').parse().ok()?;
+                cached_release(&version, cache_dir)
+            })
+        }
+        WasmerVersion::Latest => find_on_path("wasmer"),
+    }
+}
+
+fn find_on_path(name: &str) -> Option<PathBuf> {
+    let file_name = format!("{name}{}", std::env::consts::EXE_SUFFIX);
+    let path = std::env::var_os("PATH")?;
+
+    std::env::split_paths(&path)
+        .map(|dir| dir.join(&file_name))
+        .find(|candidate| candidate.is_file())
+}
+
+/// The name of the release asset for the current platform.
+fn release_asset() -> Result<&'static str, Error> {
+    use std::env::consts::{ARCH, OS};
+
+    match (OS, ARCH) {
+        ("linux", "x86_64") => Ok("wasmer-linux-amd64.tar.gz"),
+        ("linux", "aarch64") => Ok("wasmer-linux-aarch64.tar.gz"),
+        ("macos", "x86_64") => Ok("wasmer-darwin-amd64.tar.gz"),
+        ("macos", "aarch64") => Ok("wasmer-darwin-arm64.tar.gz"),
+        ("windows", "x86_64") => Ok("wasmer-windows-amd64.tar.gz"),
+        _ => anyhow::bail!("Wasmer doesn't publish releases for {OS}-{ARCH}"),
+    }
+}
+
+/// Where a release is installed to inside the cache directory.
+fn release_dir(version: &Version, cache_dir: &Path) -> PathBuf {
+    cache_dir.join("wasmer").join(version.to_string())
+}
+
+fn release_executable(install_dir: &Path) -> PathBuf {
+    install_dir
+        .join("bin")
+        .join(format!("wasmer{}", std::env::consts::EXE_SUFFIX))
+}
+
+/// A release which has already been downloaded.
+fn cached_release(version: &Version, cache_dir: &Path) -> Option<PathBuf> {
+    Some(release_executable(&release_dir(version, cache_dir))).filter(|exe| exe.is_file())
+}
+
+async fn download_release(version: &Version, cache_dir: &Path) -> Result<PathBuf, Error> {
+    let install_dir = release_dir(version, cache_dir);
+    let executable = release_executable(&install_dir);
+
+    if executable.is_file() {
+        return Ok(executable);
+    }
+
+    // Deliberately not the registry's client, so its token isn't sent to
+    // GitHub
+    let client = registry::http_client(&ClientOptions::default())?;
+
+    let asset = release_asset()?;
+    let Asset {
+        browser_download_url: url,
+        digest,
+        ..
+    } = find_release_asset(&client, version, asset).await?;
+    tracing::info!(%url, "Downloading a wasmer release");
+
+    let tarball = client
+        .get(&url)
+        .send()
+        .await
+        .and_then(|response| response.error_for_status())
+        .with_context(|| format!("Unable to download \"{url}\""))?
+        .bytes()
+        .await?;
+
+    let expected = digest
+        .as_deref()
+        .and_then(|d| d.strip_prefix("sha256:"))
+        .with_context(|| format!("GitHub doesn't have a SHA-256 checksum for \"{url}\""))?;
+    let actual = format!("{:x}", Sha256::digest(&tarball));
+    anyhow::ensure!(
+        actual.eq_ignore_ascii_case(expected),
+        "The checksum for \"{url}\" doesn't match (expected {expected}, found {actual})",
+    );
+
+    let parent = cache_dir.join("wasmer");
+    tokio::fs::create_dir_all(&parent)
+        .await
+        .with_context(|| format!("Unable to create \"{}\"", parent.display()))?;
+
+    tokio::task::spawn_blocking({
+        let install_dir = install_dir.clone();
+        move || {
+            // Unpack somewhere temporary first so a half-extracted release is
+            // never used
+            let temp = tempfile::tempdir_in(&parent)?;
+            tar::Archive::new(GzDecoder::new(&tarball[..])).unpack(temp.path())?;
+
+            match std::fs::rename(temp.path(), &install_dir) {
+                Ok(()) => Ok(()),
+                // Someone else installed it at the same time
+                Err(_) if install_dir.exists() => Ok(()),
+                Err(e) => Err(Error::from(e)),
+            }
+        }
+    })
+    .await?
+    .with_context(|| format!("Unable to unpack \"{url}\""))?;
+
+    anyhow::ensure!(
+        executable.is_file(),
+        "The release didn't contain \"{}\"",
+        executable.display(),
+    );
+
+    Ok(executable)
+}
+
+/// The parts of GitHub's release API that we care about.
+#[derive(Debug, serde::Deserialize)]
+struct Release {
+    assets: Vec<Asset>,
+}
+
+#[derive(Debug, serde::Deserialize)]
+struct Asset {
+    name: String,
+    browser_download_url: String,
+    /// The asset's checksum (e.g. `sha256:...`).
+    #[serde(default)]
+    digest: Option<String>,
+}
+
+/// Look up one of a release's assets, so we know where to download it from
+/// and what its checksum should be.
+async fn find_release_asset(
+    client: &reqwest::Client,
+    version: &Version,
+    name: &str,
+) -> Result<Asset, Error> {
+    let url = format!("https://api.github.com/repos/wasmerio/wasmer/releases/tags/v{version}");
+
+    let body = client
+        .get(&url)
+        .header(reqwest::header::ACCEPT, "application/vnd.github+json")
+        .send()
+        .await
+        .and_then(|response| response.error_for_status())
+        .with_context(|| format!("Unable to fetch \"{url}\""))?
+        .bytes()
+        .await?;
+    let release: Release = serde_json::from_slice(&body)
+        .with_context(|| format!("Unable to parse the response from \"{url}\""))?;
+
+    release
+        .assets
+        .into_iter()
+        .find(|a| a.name == name)
+        .with_context(|| format!("Wasmer {version} doesn't have a \"{name}\" release"))
+}
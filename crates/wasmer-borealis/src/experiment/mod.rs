@@ -1,14 +1,30 @@
 mod builder;
 mod cache;
+mod duplicates;
+pub mod history;
+mod import;
+mod matrix;
 mod orchestrator;
 mod progress;
 mod results;
+mod retention;
 mod runner;
+mod toolchain;
 mod wapm;
+mod wasmer_toml;
 
 pub use self::{
     builder::ExperimentBuilder,
+    cache::{disk_usage, DiskUsage},
+    duplicates::{find_duplicates, Duplicate},
+    import::{import_results, parse_external_outcomes, ExternalOutcome},
+    orchestrator::cancel,
     progress::Progress,
-    results::{Outcome, Report, Results},
+    results::{
+        CacheStats, Category, Classification, HostInfo, Outcome, Report, Resource, Results, Triage,
+        TriageState, Verdict, WasmerBuild,
+    },
+    retention::{apply_retention, Pruned},
+    runner::{matrix_builds, wasmer_build},
     wapm::TestCase,
 };
@@ -1,35 +1,90 @@
-use std::{path::PathBuf, sync::Arc, time::Instant};
+use std::{
+    num::NonZeroUsize,
+    path::{Path, PathBuf},
+    sync::Arc,
+    time::{Duration, SystemTime},
+};
 
-use actix::{Actor, Addr, Context, Handler, ResponseFuture};
-use anyhow::Error;
-use futures::{stream::FuturesUnordered, StreamExt};
+use actix::{Actor, Addr, Context, Handler, Recipient, ResponseFuture};
+use anyhow::{Context as _, Error};
+use futures::{
+    stream::{BoxStream, FuturesUnordered},
+    FutureExt, StreamExt,
+};
+use indexmap::IndexMap;
+use rand::{seq::SliceRandom, SeedableRng};
+use rand_chacha::ChaCha8Rng;
 use reqwest::Client;
+use tokio::{sync::watch, time::Instant};
 use url::Url;
 
 use crate::{
     config::Experiment,
     experiment::{
-        cache::{AssetsFetched, Cache, FetchAssets},
-        runner::{BeginTest, Runner},
-        wapm::{FetchTestCases, TestCaseDiscovered, Wapm},
-        Outcome, Report, Results,
+        cache::{validate_webc, AssetsFetched, Cache, FetchAssets},
+        matrix::MatrixEntry,
+        progress::ExperimentStatusMessage,
+        runner::{default_build, host_info, query_build, BeginTest, Runner},
+        toolchain,
+        wapm::{compare_versions, FetchTestCases, TestCaseDiscovered, Wapm},
+        CacheStats, Outcome, Report, Results,
     },
 };
 
+/// The file partial results are periodically saved to while an experiment is
+/// running.
+pub(crate) const PARTIAL_RESULTS: &str = "results.partial.json";
+
+/// The longest we'll go without saving partial results.
+const SNAPSHOT_PERIOD: Duration = Duration::from_secs(5 * 60);
+
+/// A file which, when created in the experiment's directory, asks a running
+/// experiment to stop.
+pub(crate) const CANCEL_FILE: &str = "cancel";
+
+/// How often to check whether the experiment has been cancelled.
+const CANCEL_POLL_INTERVAL: Duration = Duration::from_secs(1);
+
+/// Ask the experiment running in `experiment_dir` to stop.
+///
+/// The experiment won't start any new test cases, running test cases are
+/// terminated, and the results so far are saved with
+/// [`Results::cancelled`] set.
+pub fn cancel(experiment_dir: &Path) -> Result<(), Error> {
+    anyhow::ensure!(
+        experiment_dir.is_dir(),
+        "\"{}\" isn't an experiment directory",
+        experiment_dir.display()
+    );
+
+    let path = experiment_dir.join(CANCEL_FILE);
+    std::fs::write(&path, "")
+        .with_context(|| format!("Unable to create \"{}\"", path.display()))?;
+
+    Ok(())
+}
+
 /// The top-level experiment runner.
 #[derive(Debug)]
 pub(crate) struct Orchestrator {
     cache: Addr<Cache>,
     client: Client,
     endpoint: Url,
+    progress: Recipient<ExperimentStatusMessage>,
 }
 
 impl Orchestrator {
-    pub fn new(cache: Addr<Cache>, client: Client, endpoint: Url) -> Self {
+    pub fn new(
+        cache: Addr<Cache>,
+        client: Client,
+        endpoint: Url,
+        progress: Recipient<ExperimentStatusMessage>,
+    ) -> Self {
         Orchestrator {
             cache,
             client,
             endpoint,
+            progress,
         }
     }
 }
@@ -44,6 +99,18 @@ pub struct BeginExperiment {
     pub experiment: Arc<Experiment>,
     /// The directory experiment results should be saved to.
     pub base_dir: PathBuf,
+    /// Run test cases in a random (but reproducible) order instead of the
+    /// order they are discovered in.
+    pub shuffle_seed: Option<u64>,
+    /// Save partial results after this many test cases complete.
+    pub snapshot_every: NonZeroUsize,
+    /// The maximum number of test cases to run at the same time.
+    pub concurrency: NonZeroUsize,
+    /// Each `wasmer` CLI in the experiment's `wasmer.matrix`.
+    pub matrix: Vec<MatrixEntry>,
+    /// The `wasmer` CLI picked by the experiment's `wasmer.version`, if it
+    /// isn't the one on `$PATH`.
+    pub default_wasmer: Option<PathBuf>,
 }
 
 impl Handler<BeginExperiment> for Orchestrator {
@@ -57,85 +124,400 @@ impl Handler<BeginExperiment> for Orchestrator {
         let BeginExperiment {
             experiment,
             base_dir,
+            shuffle_seed,
+            snapshot_every,
+            concurrency,
+            matrix,
+            default_wasmer,
         } = msg;
+        let matrix = Arc::new(matrix);
+        let registry = self.endpoint.to_string();
         let start = Instant::now();
 
         tracing::info!(?base_dir, "Experiment started");
 
         let (sender, receiver) = futures::channel::mpsc::channel(1);
+        let (cancel, cancelled) = watch::channel(false);
 
         let cache = self.cache.clone();
         let wapm = Wapm::new(self.client.clone(), self.endpoint.clone()).start();
-        let runner = Runner::new(experiment.clone(), base_dir.join("experiments")).start();
+        let runner = Runner::new(
+            experiment.clone(),
+            base_dir.join("experiments"),
+            concurrency,
+            cancelled.clone(),
+            default_wasmer.clone(),
+        )
+        .start();
 
         wapm.do_send(FetchTestCases {
             filters: experiment.filters.clone(),
+            artifacts: experiment.artifacts,
             recipient: sender,
         });
 
-        let mut reports = receiver.map(move |TestCaseDiscovered(test_case)| {
+        let progress = self.progress.clone();
+        let discovered = progress.clone();
+
+        let artifacts = experiment.artifacts;
+        let unpack = experiment.unpack_tarball;
+        let toolchains = experiment.filters.toolchains.clone();
+
+        let test_cases: BoxStream<'static, TestCaseDiscovered> = match shuffle_seed {
+            Some(seed) => async move {
+                // We need to know every test case before they can be shuffled
+                let mut test_cases: Vec<_> = receiver.collect().await;
+                shuffle(&mut test_cases, seed);
+                futures::stream::iter(test_cases)
+            }
+            .flatten_stream()
+            .boxed(),
+            // Run test cases as soon as they are discovered. The reports are
+            // sorted at the end, so the order doesn't matter.
+            None => receiver.boxed(),
+        };
+
+        let test_matrix = matrix.clone();
+        let mut reports = test_cases.fuse().map(move |TestCaseDiscovered(test_case)| {
             let cache = cache.clone();
             let runner = runner.clone();
+            let cancelled = cancelled.clone();
+            let toolchains = toolchains.clone();
+            let matrix = test_matrix.clone();
+
+            discovered.do_send(ExperimentStatusMessage::Discovered(test_case.clone()));
 
             async move {
+                if *cancelled.borrow() {
+                    return Vec::new();
+                }
+
                 let result = cache
                     .send(FetchAssets {
                         test_case: test_case.clone(),
+                        artifacts,
+                        unpack,
+                        cancelled: cancelled.clone(),
                     })
                     .await
                     .map_err(Error::from)
                     .and_then(|r| r);
 
-                let begin_test = match result {
-                    Ok(AssetsFetched { test_case, assets }) => BeginTest { test_case, assets },
+                if *cancelled.borrow() {
+                    return Vec::new();
+                }
+
+                let (test_case, assets, toolchain) = match result {
+                    Ok(AssetsFetched { test_case, assets }) => {
+                        let validation = match &assets.webc {
+                            Some(webc) => validate_webc(webc).await,
+                            None => Ok(()),
+                        };
+
+                        if let Err(error) = validation {
+                            return vec![Report {
+                                display_name: test_case.display_name(),
+                                package_version: test_case.package_version,
+                                artifacts: Some(assets.artifacts()),
+                                toolchain: None,
+                                wasmer: None,
+                                outcome: Outcome::CorruptArtifact {
+                                    error: error.into(),
+                                },
+                                triage: None,
+                            }];
+                        }
+
+                        let toolchain = toolchain::detect(&assets).await;
+                        if !toolchains.is_empty() && !toolchains.contains(&toolchain) {
+                            tracing::debug!(
+                                test_case = %format!("{}@{}", test_case.display_name(), test_case.version()),
+                                %toolchain,
+                                "Skipping a package built with an unwanted toolchain",
+                            );
+                            return Vec::new();
+                        }
+
+                        (test_case, assets, toolchain)
+                    }
                     Err(error) => {
-                        return Report {
+                        return vec![Report {
                             display_name: test_case.display_name(),
                             package_version: test_case.package_version,
+                            artifacts: None,
+                            toolchain: None,
+                            wasmer: None,
                             outcome: Outcome::FetchFailed {
                                 error: error.into(),
                             },
-                        };
+                            triage: None,
+                        }];
                     }
                 };
 
-                runner.send(begin_test).await.unwrap()
+                if *cancelled.borrow() {
+                    return Vec::new();
+                }
+
+                // One test case for each wasmer CLI in the matrix, or just the
+                // default one if there isn't a matrix
+                let wasmers: Vec<Option<MatrixEntry>> = if matrix.is_empty() {
+                    vec![None]
+                } else {
+                    matrix.iter().cloned().map(Some).collect()
+                };
+                let tests = wasmers.into_iter().map(|wasmer| {
+                    runner.send(BeginTest {
+                        test_case: test_case.clone(),
+                        assets: assets.clone(),
+                        wasmer,
+                    })
+                });
+
+                futures::future::join_all(tests)
+                    .await
+                    .into_iter()
+                    .filter_map(|report| report.unwrap())
+                    .map(|report| Report {
+                        toolchain: Some(toolchain),
+                        ..report
+                    })
+                    .collect::<Vec<_>>()
             }
         });
 
         Box::pin(async move {
+            let host = host_info();
+            tracing::debug!(?host, "Collected host information");
+
+            let wasmer =
+                match default_build(experiment.docker.as_ref(), default_wasmer.as_deref()).await {
+                    Ok(build) => {
+                        tracing::info!(version = %build.version, "Using the wasmer CLI");
+                        Some(build)
+                    }
+                    Err(e) => {
+                        tracing::warn!(error = &*e, "Unable to determine the wasmer CLI's version");
+                        None
+                    }
+                };
+
+            let mut matrix_builds = IndexMap::new();
+            for entry in matrix.iter() {
+                match query_build(tokio::process::Command::new(&entry.executable)).await {
+                    Ok(build) => {
+                        tracing::info!(
+                            label = %entry.label,
+                            version = %build.version,
+                            "Using a wasmer CLI from the matrix",
+                        );
+                        matrix_builds.insert(entry.label.clone(), build);
+                    }
+                    Err(e) => tracing::warn!(
+                        error = &*e,
+                        label = %entry.label,
+                        "Unable to determine the wasmer CLI's version",
+                    ),
+                }
+            }
+
+            let results = |mut reports: Vec<Report>, cancelled: bool| {
+                // Reports finish in whatever order the tests happen to
+                // complete, so make sure they are always listed in the same
+                // order.
+                let matrix_position = |report: &Report| {
+                    report
+                        .wasmer
+                        .as_ref()
+                        .and_then(|label| matrix.iter().position(|m| &m.label == label))
+                };
+                reports.sort_by(|a, b| {
+                    a.display_name
+                        .cmp(&b.display_name)
+                        .then_with(|| {
+                            compare_versions(&b.package_version.version, &a.package_version.version)
+                        })
+                        .then_with(|| matrix_position(a).cmp(&matrix_position(b)))
+                });
+
+                Results {
+                    schema_version: Results::SCHEMA_VERSION,
+                    experiment: Experiment::clone(&experiment),
+                    reports,
+                    total_time: start.elapsed(),
+                    // Only set once the experiment is over
+                    finished_at: None,
+                    experiment_dir: base_dir.clone(),
+                    cache: CacheStats::default(),
+                    registry: Some(registry.clone()),
+                    wasmer: wasmer.clone(),
+                    matrix: matrix_builds.clone(),
+                    host: Some(host.clone()),
+                    shuffle_seed,
+                    cancelled,
+                }
+            };
+
+            let mut snapshots = Snapshots::new(base_dir.join(PARTIAL_RESULTS), snapshot_every);
             let mut futures = FuturesUnordered::new();
             let mut completed = Vec::new();
+            let mut discovery_complete = false;
+            let cancel_file = base_dir.join(CANCEL_FILE);
+            let mut cancel_checks = futures::stream::unfold(
+                tokio::time::interval(CANCEL_POLL_INTERVAL),
+                |mut interval| async move {
+                    interval.tick().await;
+                    Some(((), interval))
+                },
+            )
+            .boxed()
+            .fuse();
+            // Make sure slow test cases can't stop us from saving for ages
+            let mut snapshot_checks = futures::stream::unfold(
+                tokio::time::interval_at(Instant::now() + SNAPSHOT_PERIOD, SNAPSHOT_PERIOD),
+                |mut interval| async move {
+                    interval.tick().await;
+                    Some(((), interval))
+                },
+            )
+            .boxed()
+            .fuse();
 
             // Note: for maximum throughput, poll the reports while still
-            // fetching test cases.
-            loop {
+            // fetching test cases. When shuffling, nothing comes through
+            // until discovery has finished.
+            while !discovery_complete || !futures.is_empty() {
                 futures::select! {
                     fut = reports.next() => {
                         match fut {
                             Some(fut) => futures.push(fut),
                             None => {
-                                break;
+                                progress.do_send(ExperimentStatusMessage::DiscoveryComplete);
+                                discovery_complete = true;
                             },
                         }
                     }
-                    report = futures.next() => {
-                        if let Some(report) = report {
+                    reports = futures.next() => {
+                        for report in reports.into_iter().flatten() {
+                            progress.do_send(ExperimentStatusMessage::Finished(report.clone()));
                             completed.push(report);
+
+                            if snapshots.is_due(completed.len()) {
+                                snapshots.save(&results(completed.clone(), false)).await;
+                            }
+                        }
+                    }
+                    _ = snapshot_checks.next() => {
+                        if snapshots.is_overdue(completed.len()) {
+                            snapshots.save(&results(completed.clone(), false)).await;
+                        }
+                    }
+                    _ = cancel_checks.next() => {
+                        if tokio::fs::try_exists(&cancel_file).await.unwrap_or(false) {
+                            tracing::warn!("Experiment cancelled");
+                            // Stops any running test cases
+                            let _ = cancel.send(true);
+                            break;
                         }
                     }
                 }
             }
 
-            let remaining_reports: Vec<_> = futures.collect().await;
-            completed.extend(remaining_reports);
+            let cancelled = *cancel.borrow();
+
+            if cancelled {
+                // Wait for running test cases to be stopped. Any which managed
+                // to finish in the meantime are still worth keeping.
+                while let Some(reports) = futures.next().await {
+                    for report in reports {
+                        progress.do_send(ExperimentStatusMessage::Finished(report.clone()));
+                        completed.push(report);
+                    }
+                }
+
+                if let Err(e) = tokio::fs::remove_file(&cancel_file).await {
+                    tracing::warn!(
+                        error = &e as &dyn std::error::Error,
+                        "Unable to remove the cancel file",
+                    );
+                }
+            }
 
             Results {
-                experiment: Experiment::clone(&experiment),
-                reports: completed,
-                total_time: start.elapsed(),
-                experiment_dir: base_dir,
+                finished_at: Some(SystemTime::now()),
+                ..results(completed, cancelled)
             }
         })
     }
 }
+
+/// Periodically saves the results so far, so there is something to look at
+/// if a long experiment is aborted.
+#[derive(Debug)]
+struct Snapshots {
+    path: PathBuf,
+    every: NonZeroUsize,
+    last_saved: Instant,
+    /// How many reports had completed when we last saved.
+    saved: usize,
+}
+
+impl Snapshots {
+    fn new(path: PathBuf, every: NonZeroUsize) -> Self {
+        Snapshots {
+            path,
+            every,
+            last_saved: Instant::now(),
+            saved: 0,
+        }
+    }
+
+    fn is_due(&self, completed: usize) -> bool {
+        completed % self.every.get() == 0 || self.is_overdue(completed)
+    }
+
+    /// Has it been too long since the last snapshot, and is there anything
+    /// new to save?
+    fn is_overdue(&self, completed: usize) -> bool {
+        completed != self.saved && self.last_saved.elapsed() >= SNAPSHOT_PERIOD
+    }
+
+    async fn save(&mut self, results: &Results) {
+        self.last_saved = Instant::now();
+        self.saved = results.reports.len();
+
+        let result = async {
+            let json = serde_json::to_vec_pretty(results)?;
+            let parent = self.path.parent().unwrap_or(Path::new("."));
+            tokio::fs::create_dir_all(parent).await?;
+
+            // Write to a temporary file first so a crash part-way through
+            // never leaves a truncated snapshot behind
+            let temp = tempfile::NamedTempFile::new_in(parent)?.into_temp_path();
+            tokio::fs::write(&temp, json).await?;
+            temp.persist(&self.path)?;
+            Ok::<_, Error>(())
+        };
+
+        match result.await {
+            Ok(()) => tracing::debug!(
+                path = %self.path.display(),
+                completed = results.reports.len(),
+                "Saved partial results",
+            ),
+            Err(e) => tracing::warn!(
+                error = &*e,
+                path = %self.path.display(),
+                "Unable to save partial results",
+            ),
+        }
+    }
+}
+
+/// Shuffle the test cases in a way that is reproducible for a given seed,
+/// regardless of the order they were discovered in.
+fn shuffle(test_cases: &mut [TestCaseDiscovered], seed: u64) {
+    test_cases.sort_by(|a, b| a.0.cmp_canonical(&b.0));
+    let mut rng = ChaCha8Rng::seed_from_u64(seed);
+    test_cases.shuffle(&mut rng);
+}
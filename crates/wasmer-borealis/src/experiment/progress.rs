@@ -2,7 +2,7 @@ use std::{fmt::Debug, time::Duration};
 
 use actix::{Actor, Context, Handler};
 
-use crate::experiment::{cache::CacheStatusMessage, wapm::TestCase};
+use crate::experiment::{cache::CacheStatusMessage, wapm::TestCase, Report};
 
 #[derive(Debug)]
 pub(crate) struct ProgressMonitor(Box<dyn Progress>);
@@ -14,9 +14,12 @@ impl ProgressMonitor {
 }
 
 pub trait Progress: Debug {
+    fn test_case_discovered(&mut self, _test_case: TestCase) {}
+    fn discovery_complete(&mut self) {}
     fn downloading(&mut self, _test_case: TestCase) {}
     fn cache_hit(&mut self, _test_case: TestCase) {}
     fn cache_miss(&mut self, _test_case: TestCase, _duration: Duration, _bytes_downloaded: u64) {}
+    fn test_case_finished(&mut self, _report: Report) {}
 }
 
 impl Actor for ProgressMonitor {
@@ -38,3 +41,27 @@ impl Handler<CacheStatusMessage> for ProgressMonitor {
         }
     }
 }
+
+/// Messages emitted by the orchestrator as an experiment progresses.
+#[derive(Debug, actix::Message)]
+#[rtype(result = "()")]
+pub(crate) enum ExperimentStatusMessage {
+    Discovered(TestCase),
+    /// All [`TestCase`]s have been retrieved from the registry.
+    DiscoveryComplete,
+    Finished(Report),
+}
+
+impl Handler<ExperimentStatusMessage> for ProgressMonitor {
+    type Result = ();
+
+    fn handle(&mut self, msg: ExperimentStatusMessage, _ctx: &mut Self::Context) {
+        match msg {
+            ExperimentStatusMessage::Discovered(test_case) => {
+                self.0.test_case_discovered(test_case)
+            }
+            ExperimentStatusMessage::DiscoveryComplete => self.0.discovery_complete(),
+            ExperimentStatusMessage::Finished(report) => self.0.test_case_finished(report),
+        }
+    }
+}
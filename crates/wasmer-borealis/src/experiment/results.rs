@@ -1,35 +1,287 @@
-use std::{path::PathBuf, time::Duration};
+use std::{
+    path::{Path, PathBuf},
+    str::FromStr,
+    time::{Duration, SystemTime},
+};
 
-use anyhow::Error;
+use anyhow::{Context, Error};
+use indexmap::IndexMap;
 
-use crate::{config::Experiment, registry::queries::PackageVersion};
+use crate::{
+    config::{Artifacts, Experiment, Toolchain},
+    registry::queries::PackageVersion,
+};
 
 #[derive(Debug, serde::Serialize, serde::Deserialize)]
 pub struct Results {
+    /// The version of the `results.json` format these results were saved
+    /// with.
+    ///
+    /// Files written before the format was versioned don't have this field
+    /// and are treated as version `0`.
+    #[serde(default)]
+    pub schema_version: u32,
     pub experiment: Experiment,
     pub reports: Vec<Report>,
     pub total_time: Duration,
+    /// When the experiment finished. Results saved before this was recorded
+    /// don't have it (see [`Results::finished()`]).
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub finished_at: Option<SystemTime>,
     pub experiment_dir: PathBuf,
+    /// How effective the package cache was during this run.
+    #[serde(default)]
+    pub cache: CacheStats,
+    /// The GraphQL endpoint of the registry packages were fetched from.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub registry: Option<String>,
+    /// The `wasmer` CLI every test case was run with.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub wasmer: Option<WasmerBuild>,
+    /// The build of each `wasmer` CLI in the experiment's `wasmer.matrix`,
+    /// keyed by matrix entry.
+    #[serde(default, skip_serializing_if = "IndexMap::is_empty")]
+    pub matrix: IndexMap<String, WasmerBuild>,
+    /// The machine the experiment was run on.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub host: Option<HostInfo>,
+    /// The seed used to shuffle the order test cases were run in, if any.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub shuffle_seed: Option<u64>,
+    /// Whether the experiment was cancelled before every test case could be
+    /// run.
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub cancelled: bool,
 }
 
-#[derive(Debug, serde::Serialize, serde::Deserialize)]
+impl Results {
+    /// The current version of the `results.json` format.
+    ///
+    /// This only changes when a field is removed or changes meaning. New
+    /// fields may be added at any time, so consumers should ignore fields
+    /// they don't recognise.
+    pub const SCHEMA_VERSION: u32 = 1;
+
+    /// When the experiment finished.
+    ///
+    /// Older results don't record this, so we fall back to when
+    /// `results_json` was last modified. That is only accurate until
+    /// somebody triages the results.
+    pub fn finished(&self, results_json: &Path) -> Result<SystemTime, Error> {
+        finished(self.finished_at, results_json)
+    }
+}
+
+/// The logic behind [`Results::finished()`], for code which only has the
+/// `finished_at` field.
+pub(crate) fn finished(
+    finished_at: Option<SystemTime>,
+    results_json: &Path,
+) -> Result<SystemTime, Error> {
+    if let Some(finished_at) = finished_at {
+        return Ok(finished_at);
+    }
+
+    std::fs::metadata(results_json)
+        .and_then(|m| m.modified())
+        .with_context(|| {
+            format!(
+                "Unable to check when \"{}\" was modified",
+                results_json.display()
+            )
+        })
+}
+
+/// A snapshot of the host environment, so results from different machines
+/// can be compared.
+#[derive(Debug, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+pub struct HostInfo {
+    /// The operating system (e.g. `Linux 22.04 Ubuntu`).
+    pub os: String,
+    pub arch: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub kernel: Option<String>,
+    /// The CPU's brand name.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub cpu: Option<String>,
+    /// The number of logical CPUs.
+    pub cpus: usize,
+    /// The amount of RAM, in bytes.
+    pub total_memory: u64,
+    /// Host environment variables that were passed through to the `wasmer`
+    /// CLI.
+    #[serde(default, skip_serializing_if = "IndexMap::is_empty")]
+    pub env: IndexMap<String, String>,
+}
+
+/// Information about a particular `wasmer` CLI binary.
+#[derive(Debug, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+pub struct WasmerBuild {
+    /// The version string (e.g. `wasmer 4.1.1`).
+    pub version: String,
+    /// Build metadata reported by `wasmer --version --verbose` (commit hash,
+    /// host, compilers, etc.).
+    #[serde(default, skip_serializing_if = "IndexMap::is_empty")]
+    pub metadata: IndexMap<String, String>,
+}
+
+/// Counters for how often the package cache was able to satisfy a request.
+#[derive(Debug, Default, Copy, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+#[cfg_attr(feature = "schemars", derive(schemars::JsonSchema))]
+pub struct CacheStats {
+    pub hits: usize,
+    pub misses: usize,
+    /// The number of bytes downloaded because of cache misses.
+    pub bytes_downloaded: u64,
+}
+
+impl CacheStats {
+    /// The fraction of lookups that were served from the cache, if there were
+    /// any.
+    pub fn hit_rate(&self) -> Option<f64> {
+        let total = self.hits + self.misses;
+        (total > 0).then(|| self.hits as f64 / total as f64)
+    }
+}
+
+#[derive(Debug, Clone, serde::Serialize, serde::Deserialize)]
 pub struct Report {
     pub display_name: String,
     pub package_version: PackageVersion,
+    /// The artifacts which were made available to the experiment.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub artifacts: Option<Artifacts>,
+    /// The toolchain the package appears to have been built with, if it
+    /// could be downloaded.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub toolchain: Option<Toolchain>,
+    /// The entry from the experiment's `wasmer.matrix` this test case was run
+    /// with, if it has one.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub wasmer: Option<String>,
     pub outcome: Outcome,
+    /// Notes from whoever has been investigating this test case.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub triage: Option<Triage>,
 }
 
-#[derive(Debug, serde::Serialize, serde::Deserialize)]
+/// Where an investigation into a test case's [`Outcome`] is up to.
+#[derive(Debug, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+pub struct Triage {
+    pub state: TriageState,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub assignee: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub note: Option<String>,
+}
+
+#[derive(Debug, Default, Copy, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum TriageState {
+    /// Nobody has looked at this test case yet.
+    #[default]
+    Untriaged,
+    /// The outcome is what we expected (e.g. the package is known to be
+    /// broken).
+    Expected,
+    /// A bug has been filed.
+    BugFiled,
+    /// The underlying issue has been fixed.
+    Fixed,
+}
+
+impl TriageState {
+    pub const ALL: [TriageState; 4] = [
+        TriageState::Untriaged,
+        TriageState::Expected,
+        TriageState::BugFiled,
+        TriageState::Fixed,
+    ];
+
+    pub fn as_str(self) -> &'static str {
+        match self {
+            TriageState::Untriaged => "untriaged",
+            TriageState::Expected => "expected",
+            TriageState::BugFiled => "bug-filed",
+            TriageState::Fixed => "fixed",
+        }
+    }
+}
+
+impl FromStr for TriageState {
+    type Err = Error;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        TriageState::ALL
+            .into_iter()
+            .find(|state| state.as_str() == s)
+            .with_context(|| {
+                let expected: Vec<_> = TriageState::ALL.iter().map(|s| s.as_str()).collect();
+                format!("Expected one of {}", expected.join(", "))
+            })
+    }
+}
+
+/// What happened when a test case was run.
+///
+/// If the `wasmer` CLI ran, `truncated` lists the output streams (`stdout`
+/// or `stderr`) which were cut short because they exceeded the experiment's
+/// `max-output-size`.
+#[derive(Debug, Clone, serde::Serialize, serde::Deserialize)]
+#[cfg_attr(feature = "schemars", derive(schemars::JsonSchema))]
 #[serde(tag = "outcome", rename_all = "kebab-case")]
 pub enum Outcome {
     Completed {
         status: ExitStatus,
         run_time: Duration,
         base_dir: PathBuf,
+        /// Any metrics that were extracted from the package's output.
+        #[serde(default, skip_serializing_if = "IndexMap::is_empty")]
+        metrics: IndexMap<String, serde_json::Value>,
+        /// The verdict from the experiment's classifier, if it has one.
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        classification: Option<Classification>,
+        /// Descriptions of the experiment's expectations which weren't met,
+        /// or `None` if the experiment doesn't have any.
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        unmet_expectations: Option<Vec<String>>,
+        /// Output from any hooks that were run, keyed by hook name.
+        #[serde(default, skip_serializing_if = "IndexMap::is_empty")]
+        hooks: IndexMap<String, HookOutput>,
+        #[serde(default, skip_serializing_if = "Vec::is_empty")]
+        truncated: Vec<String>,
+    },
+    /// The test case was killed because it ran for longer than the
+    /// experiment's timeout.
+    TimedOut {
+        timeout: Duration,
+        base_dir: PathBuf,
+        /// Output from any hooks that were run, keyed by hook name.
+        #[serde(default, skip_serializing_if = "IndexMap::is_empty")]
+        hooks: IndexMap<String, HookOutput>,
+        #[serde(default, skip_serializing_if = "Vec::is_empty")]
+        truncated: Vec<String>,
+    },
+    /// The test case was killed for exceeding one of the experiment's
+    /// resource limits.
+    LimitExceeded {
+        resource: Resource,
+        status: ExitStatus,
+        run_time: Duration,
+        base_dir: PathBuf,
+        /// Output from any hooks that were run, keyed by hook name.
+        #[serde(default, skip_serializing_if = "IndexMap::is_empty")]
+        hooks: IndexMap<String, HookOutput>,
+        #[serde(default, skip_serializing_if = "Vec::is_empty")]
+        truncated: Vec<String>,
     },
     FetchFailed {
         error: SerializableError,
     },
+    /// The package's artifacts were downloaded, but aren't valid.
+    CorruptArtifact {
+        error: SerializableError,
+    },
     SetupFailed {
         base_dir: PathBuf,
         error: SerializableError,
@@ -38,9 +290,99 @@ pub enum Outcome {
         base_dir: PathBuf,
         error: SerializableError,
     },
+    ClassificationFailed {
+        base_dir: PathBuf,
+        error: SerializableError,
+    },
 }
 
+impl Outcome {
+    /// The directory the test case was run in, if it got that far.
+    pub fn base_dir(&self) -> Option<&Path> {
+        match self {
+            Outcome::Completed { base_dir, .. }
+            | Outcome::TimedOut { base_dir, .. }
+            | Outcome::LimitExceeded { base_dir, .. }
+            | Outcome::SetupFailed { base_dir, .. }
+            | Outcome::SpawnFailed { base_dir, .. }
+            | Outcome::ClassificationFailed { base_dir, .. } => Some(base_dir),
+            Outcome::FetchFailed { .. } | Outcome::CorruptArtifact { .. } => None,
+        }
+    }
+
+    pub fn category(&self) -> Category {
+        match self {
+            Outcome::Completed {
+                unmet_expectations: Some(unmet),
+                ..
+            } if !unmet.is_empty() => Category::Failure,
+            Outcome::Completed {
+                classification: Some(classification),
+                ..
+            } => match classification.verdict {
+                Verdict::Pass => Category::Success,
+                Verdict::Fail => Category::Failure,
+            },
+            // Expectations can say a non-zero exit code is fine
+            Outcome::Completed {
+                unmet_expectations: Some(_),
+                ..
+            } => Category::Success,
+            Outcome::Completed { status, .. } if status.success => Category::Success,
+            Outcome::Completed { .. }
+            | Outcome::TimedOut { .. }
+            | Outcome::LimitExceeded { .. } => Category::Failure,
+            Outcome::FetchFailed { .. }
+            | Outcome::CorruptArtifact { .. }
+            | Outcome::SetupFailed { .. }
+            | Outcome::SpawnFailed { .. }
+            | Outcome::ClassificationFailed { .. } => Category::Bug,
+        }
+    }
+}
+
+/// A resource a test case can be limited in how much it uses (see
+/// [`crate::config::Limits`]).
+#[derive(Debug, Copy, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+#[cfg_attr(feature = "schemars", derive(schemars::JsonSchema))]
+#[serde(rename_all = "kebab-case")]
+pub enum Resource {
+    Cpu,
+    Memory,
+}
+
+/// The broad category an [`Outcome`] falls into.
+#[derive(Debug, Copy, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum Category {
+    /// The experiment passed.
+    Success,
+    /// The experiment ran, but didn't pass.
+    Failure,
+    /// Something went wrong while trying to run the experiment.
+    Bug,
+}
+
+/// The result of running an experiment's classifier.
 #[derive(Debug, Clone, PartialEq, serde::Serialize, serde::Deserialize)]
+#[cfg_attr(feature = "schemars", derive(schemars::JsonSchema))]
+pub struct Classification {
+    pub verdict: Verdict,
+    /// Arbitrary labels attached by the classifier.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub labels: Vec<String>,
+}
+
+#[derive(Debug, Copy, Clone, PartialEq, Eq, serde::Serialize, serde::Deserialize)]
+#[cfg_attr(feature = "schemars", derive(schemars::JsonSchema))]
+#[serde(rename_all = "kebab-case")]
+pub enum Verdict {
+    Pass,
+    Fail,
+}
+
+#[derive(Debug, Clone, PartialEq, serde::Serialize, serde::Deserialize)]
+#[cfg_attr(feature = "schemars", derive(schemars::JsonSchema))]
 pub struct SerializableError {
     pub error: String,
     pub detailed_error: String,
@@ -67,7 +409,17 @@ impl From<Error> for SerializableError {
     }
 }
 
+/// The result of running one of an experiment's hooks.
+#[derive(Debug, Clone, PartialEq, serde::Serialize, serde::Deserialize)]
+#[cfg_attr(feature = "schemars", derive(schemars::JsonSchema))]
+pub struct HookOutput {
+    pub status: ExitStatus,
+    pub stdout: String,
+    pub stderr: String,
+}
+
 #[derive(Debug, Copy, Clone, PartialEq, serde::Serialize, serde::Deserialize)]
+#[cfg_attr(feature = "schemars", derive(schemars::JsonSchema))]
 pub struct ExitStatus {
     pub success: bool,
     pub code: i32,
@@ -0,0 +1,124 @@
+//! Shrinking the logs of old test cases that passed, so keeping a long history
+//! of experiment runs doesn't cost too much disk space.
+
+use std::{
+    fs::OpenOptions,
+    io::{ErrorKind, Read, Seek, SeekFrom, Write},
+    path::Path,
+    time::Duration,
+};
+
+use anyhow::{Context, Error};
+
+use crate::experiment::{Category, Results};
+
+/// How many bytes are kept from the end of a truncated log if the experiment
+/// doesn't say otherwise.
+const DEFAULT_TRUNCATE_TO: u64 = 4 * 1024;
+const SECONDS_PER_DAY: u64 = 24 * 60 * 60;
+const TRUNCATED_MARKER: &[u8] = b"[... truncated by the experiment's retention rules ...]\n";
+
+/// What was cleaned up by [`apply_retention()`].
+#[derive(Debug, Default, Copy, Clone, PartialEq, Eq, serde::Serialize)]
+pub struct Pruned {
+    /// The number of log files that were truncated.
+    pub files: usize,
+    /// The number of bytes freed.
+    pub bytes_freed: u64,
+}
+
+/// Apply the experiment's [`crate::config::Retention`] rules to results that
+/// are `age` old.
+///
+/// Only the logs of passing test cases are truncated. Failures, bugs, and
+/// anything somebody is triaging are always kept in full so they can still be
+/// investigated.
+pub fn apply_retention(results: &Results, age: Duration) -> Result<Pruned, Error> {
+    let mut pruned = Pruned::default();
+    let retention = &results.experiment.retention;
+
+    let Some(days) = retention.passing_days else {
+        return Ok(pruned);
+    };
+    if age < Duration::from_secs(days.saturating_mul(SECONDS_PER_DAY)) {
+        return Ok(pruned);
+    }
+    let keep = retention.truncate_to.unwrap_or(DEFAULT_TRUNCATE_TO);
+
+    for report in &results.reports {
+        if report.outcome.category() != Category::Success || report.triage.is_some() {
+            continue;
+        }
+        let Some(base_dir) = report.outcome.base_dir() else {
+            continue;
+        };
+
+        for filename in ["stdout.txt", "stderr.txt"] {
+            let path = base_dir.join(filename);
+            let freed = truncate_log(&path, keep)
+                .with_context(|| format!("Unable to truncate \"{}\"", path.display()))?;
+
+            if freed > 0 {
+                pruned.files += 1;
+                pruned.bytes_freed += freed;
+            }
+        }
+    }
+
+    Ok(pruned)
+}
+
+/// Replace a log with a note saying it was truncated, followed by its last
+/// few bytes, making sure the result is no more than `keep` bytes long.
+///
+/// Returns the number of bytes freed.
+fn truncate_log(path: &Path, keep: u64) -> Result<u64, std::io::Error> {
+    let mut file = match OpenOptions::new().read(true).write(true).open(path) {
+        Ok(file) => file,
+        Err(e) if e.kind() == ErrorKind::NotFound => return Ok(0),
+        Err(e) => return Err(e),
+    };
+
+    let len = file.metadata()?.len();
+    if len <= keep {
+        return Ok(0);
+    }
+
+    let tail_len = keep.saturating_sub(TRUNCATED_MARKER.len() as u64);
+    let mut contents = if tail_len > 0 {
+        TRUNCATED_MARKER.to_vec()
+    } else {
+        Vec::new()
+    };
+    file.seek(SeekFrom::Start(len - tail_len))?;
+    file.read_to_end(&mut contents)?;
+
+    file.seek(SeekFrom::Start(0))?;
+    file.write_all(&contents)?;
+    file.set_len(contents.len() as u64)?;
+
+    Ok(len - contents.len() as u64)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn truncated_logs_keep_their_tail() {
+        let temp = tempfile::tempdir().unwrap();
+        let path = temp.path().join("stdout.txt");
+        let original: String = (0..10_000).map(|i| format!("line {i}\n")).collect();
+        std::fs::write(&path, &original).unwrap();
+
+        let freed = truncate_log(&path, 1024).unwrap();
+
+        let truncated = std::fs::read_to_string(&path).unwrap();
+        assert_eq!(truncated.len(), 1024);
+        assert_eq!(freed, (original.len() - 1024) as u64);
+        assert!(truncated.starts_with("[... truncated"));
+        assert!(truncated.ends_with("line 9999\n"));
+        // Truncating again is a no-op
+        assert_eq!(truncate_log(&path, 1024).unwrap(), 0);
+    }
+}
@@ -2,17 +2,31 @@ use std::{
     collections::HashMap,
     num::NonZeroUsize,
     path::{Path, PathBuf},
+    process::Stdio,
     sync::Arc,
-    time::Instant,
+    time::{Duration, Instant},
 };
 
 use actix::{Actor, Context, Handler};
 use anyhow::{Context as _, Error};
-use tokio::sync::Semaphore;
+use indexmap::IndexMap;
+use sysinfo::{CpuExt, System, SystemExt};
+use tokio::{
+    io::{AsyncRead, AsyncReadExt, AsyncWriteExt},
+    process::Child,
+    sync::{watch, Semaphore},
+};
 
 use crate::{
-    config::Experiment,
-    experiment::{cache::Assets, Outcome, Report, TestCase},
+    config::{
+        Classifier, DockerConfig, Expectations, Experiment, Limits, TemplatedString, WasmerVersion,
+    },
+    experiment::{
+        cache::{package_version_path, sanitize_file_name, Assets},
+        matrix::{self, MatrixEntry},
+        results::{Classification, ExitStatus, HookOutput, HostInfo, WasmerBuild},
+        wasmer_toml, Outcome, Report, Resource, TestCase,
+    },
 };
 
 #[derive(Debug, Clone)]
@@ -20,51 +34,92 @@ pub(crate) struct Runner {
     experiment: Arc<Experiment>,
     semaphore: Arc<Semaphore>,
     base_dir: PathBuf,
+    /// Set to `true` when the experiment is cancelled.
+    cancelled: watch::Receiver<bool>,
+    /// The `wasmer` CLI picked by the experiment's `wasmer.version`, if it
+    /// isn't the one on `$PATH`.
+    default_wasmer: Option<PathBuf>,
 }
 
 impl Runner {
-    pub(crate) fn new(experiment: Arc<Experiment>, base_dir: PathBuf) -> Self {
+    pub(crate) fn new(
+        experiment: Arc<Experiment>,
+        base_dir: PathBuf,
+        concurrency: NonZeroUsize,
+        cancelled: watch::Receiver<bool>,
+        default_wasmer: Option<PathBuf>,
+    ) -> Self {
         Runner {
             experiment,
             base_dir,
-            semaphore: Arc::new(Semaphore::new(
-                std::thread::available_parallelism()
-                    .unwrap_or(NonZeroUsize::new(4).unwrap())
-                    .get(),
-            )),
+            semaphore: Arc::new(Semaphore::new(concurrency.get())),
+            cancelled,
+            default_wasmer,
         }
     }
 }
 
+/// How long a test case has to exit after being asked to stop, before it is
+/// killed.
+const TERMINATION_GRACE_PERIOD: Duration = Duration::from_secs(5);
+
+/// The number of test cases to run at the same time when neither the user
+/// nor the experiment specified one, based on the number of CPUs.
+pub(crate) fn default_concurrency() -> NonZeroUsize {
+    std::thread::available_parallelism().unwrap_or(NonZeroUsize::new(4).unwrap())
+}
+
 impl Actor for Runner {
     type Context = Context<Self>;
 }
 
+/// Run a test case, returning `None` if the experiment was cancelled before it
+/// could finish.
 #[derive(Debug, Clone, actix::Message)]
-#[rtype(result = "Report")]
+#[rtype(result = "Option<Report>")]
 pub(crate) struct BeginTest {
     pub test_case: TestCase,
     pub assets: Assets,
+    /// The entry from the experiment's `wasmer.matrix` to run with, if it has
+    /// one.
+    pub wasmer: Option<MatrixEntry>,
 }
 
 impl Handler<BeginTest> for Runner {
-    type Result = actix::ResponseFuture<Report>;
+    type Result = actix::ResponseFuture<Option<Report>>;
 
     fn handle(&mut self, msg: BeginTest, _ctx: &mut Self::Context) -> Self::Result {
-        let BeginTest { test_case, assets } = msg;
+        let BeginTest {
+            test_case,
+            assets,
+            wasmer,
+        } = msg;
 
-        let base_dir = self
-            .base_dir
-            .join(&test_case.namespace)
-            .join(&test_case.package_name)
-            .join(test_case.version());
+        let mut base_dir = self.base_dir.join(package_version_path(&test_case));
+        if let Some(wasmer) = &wasmer {
+            base_dir.push(sanitize_file_name(&wasmer.label));
+        }
 
         let experiment = self.experiment.clone();
         let semaphore = self.semaphore.clone();
+        let cancelled = self.cancelled.clone();
+        let default_wasmer = self.default_wasmer.clone();
 
         Box::pin(async move {
             let _guard = semaphore.acquire().await.unwrap();
-            run_experiment(&experiment, &test_case, &assets, base_dir).await
+            if *cancelled.borrow() {
+                return None;
+            }
+            run_experiment(
+                &experiment,
+                &test_case,
+                &assets,
+                wasmer.as_ref(),
+                default_wasmer.as_deref(),
+                base_dir,
+                cancelled,
+            )
+            .await
         })
     }
 }
@@ -82,38 +137,189 @@ async fn run_experiment(
     experiment: &Experiment,
     test_case: &TestCase,
     assets: &Assets,
+    wasmer: Option<&MatrixEntry>,
+    default_wasmer: Option<&Path>,
     base_dir: PathBuf,
-) -> Report {
+    cancelled: watch::Receiver<bool>,
+) -> Option<Report> {
+    let experiment = experiment.for_package(&test_case.display_name());
+    let experiment = experiment.as_ref();
     let dirs = directories::BaseDirs::new().unwrap();
+    let home_dir = dirs.home_dir();
+    let report = |outcome: Outcome| {
+        Some(Report {
+            display_name: test_case.display_name(),
+            package_version: test_case.package_version.clone(),
+            artifacts: Some(assets.artifacts()),
+            toolchain: None,
+            wasmer: wasmer.map(|w| w.label.clone()),
+            outcome,
+            triage: None,
+        })
+    };
+    let executable = wasmer.map(|w| w.executable.as_path()).or(default_wasmer);
 
-    let mut cmd = match setup(experiment, test_case, assets, &base_dir, dirs.home_dir()).await {
-        Ok(cmd) => cmd,
+    let Invocation {
+        mut cmd,
+        secrets,
+        env,
+        container,
+        stdout,
+        stderr,
+    } = match setup(
+        experiment, test_case, assets, executable, &base_dir, home_dir,
+    )
+    .await
+    {
+        Ok(invocation) => invocation,
         Err(error) => {
-            return Report {
-                display_name: test_case.display_name(),
-                package_version: test_case.package_version.clone(),
-                outcome: Outcome::SetupFailed {
+            return report(Outcome::SetupFailed {
+                base_dir,
+                error: error.into(),
+            })
+        }
+    };
+
+    let mut hooks = IndexMap::new();
+
+    if !experiment.hooks.before_each.is_empty() {
+        let result = run_hook(
+            "before-each",
+            &experiment.hooks.before_each,
+            &env,
+            &base_dir,
+            home_dir,
+        )
+        .await
+        .and_then(|output| {
+            if output.status.success {
+                Ok(output)
+            } else {
+                Err(Error::msg(format!(
+                    "The before-each hook failed with exit code {}: {}",
+                    output.status.code,
+                    output.stderr.trim()
+                )))
+            }
+        });
+
+        match result {
+            Ok(output) => {
+                hooks.insert("before-each".to_string(), output);
+            }
+            Err(error) => {
+                return report(Outcome::SetupFailed {
                     base_dir,
                     error: error.into(),
-                },
+                })
             }
         }
-    };
+    }
 
-    tracing::debug!(cmd=?cmd.as_std(), "Invoking wasmer CLI");
+    tracing::debug!(cmd=%redact(cmd.as_std(), &secrets), "Invoking wasmer CLI");
+    let timeout = experiment.timeout.map(Duration::from_secs);
     let start = Instant::now();
+    let result = match cmd.kill_on_drop(true).spawn() {
+        Ok(child) => {
+            let max_output_size = experiment.max_output_size;
+            run_to_completion(child, stdout, stderr, max_output_size, timeout, cancelled).await
+        }
+        Err(e) => Err(Error::new(e).context(format!(
+            "Unable to start \"{}\", is it installed?",
+            cmd.as_std().get_program().to_string_lossy()
+        ))),
+    };
+    let run_time = start.elapsed();
 
-    let outcome = match cmd.status().await {
-        Ok(status) => Outcome::Completed {
-            base_dir,
-            status: status.into(),
-            run_time: start.elapsed(),
-        },
+    if !experiment.hooks.after_each.is_empty() {
+        match run_hook(
+            "after-each",
+            &experiment.hooks.after_each,
+            &env,
+            &base_dir,
+            home_dir,
+        )
+        .await
+        {
+            Ok(output) => {
+                hooks.insert("after-each".to_string(), output);
+            }
+            Err(e) => {
+                tracing::warn!(error = &*e, "Unable to run the after-each hook");
+            }
+        }
+    }
+
+    let outcome = match result {
+        Ok((Exit::Cancelled, _)) => {
+            tracing::info!("Stopped a test case because the experiment was cancelled");
+            if let Some(container) = &container {
+                kill_container(container).await;
+            }
+            return None;
+        }
+        Ok((Exit::TimedOut, truncated)) => {
+            tracing::warn!(?run_time, "Killed a test case which timed out");
+            if let Some(container) = &container {
+                // Killing the docker CLI doesn't stop the container itself
+                kill_container(container).await;
+            }
+            Outcome::TimedOut {
+                timeout: timeout.unwrap_or(run_time),
+                base_dir,
+                hooks,
+                truncated,
+            }
+        }
+        Ok((Exit::Exited { status, cpu_time }, truncated)) => {
+            let limit = exceeded_limit(&experiment.limits, status, cpu_time, container.is_some());
+            if let Some(resource) = limit {
+                tracing::warn!(?resource, "A test case exceeded its resource limits");
+                return report(Outcome::LimitExceeded {
+                    resource,
+                    status: status.into(),
+                    run_time,
+                    base_dir,
+                    hooks,
+                    truncated,
+                });
+            }
+
+            let status = ExitStatus::from(status);
+            let metrics = extract_metrics(&experiment.metrics, &base_dir.join("stdout.txt")).await;
+            let unmet_expectations = if experiment.expect.is_empty() {
+                None
+            } else {
+                Some(check_expectations(&experiment.expect, status, &base_dir).await)
+            };
+
+            let classification = match &experiment.classifier {
+                Some(classifier) => classify(classifier, status, &base_dir).await.map(Some),
+                None => Ok(None),
+            };
+
+            match classification {
+                Ok(classification) => Outcome::Completed {
+                    base_dir,
+                    status,
+                    run_time,
+                    metrics,
+                    classification,
+                    unmet_expectations,
+                    hooks,
+                    truncated,
+                },
+                Err(error) => Outcome::ClassificationFailed {
+                    base_dir,
+                    error: error.into(),
+                },
+            }
+        }
         Err(error) => {
-            let error = Error::new(error).context(format!(
-                "Unable to start \"{}\", is it installed?",
-                cmd.as_std().get_program().to_string_lossy()
-            ));
+            if let Some(container) = &container {
+                // We may have given up on the docker CLI while it was running
+                kill_container(container).await;
+            }
             Outcome::SetupFailed {
                 error: error.into(),
                 base_dir,
@@ -121,21 +327,553 @@ async fn run_experiment(
         }
     };
 
-    Report {
-        display_name: test_case.display_name(),
-        package_version: test_case.package_version.clone(),
-        outcome,
+    report(outcome)
+}
+
+/// Wait for the `wasmer` CLI to exit (see [`wait()`]) while saving its output,
+/// returning the names of any streams which were truncated.
+///
+/// It is an error if the output couldn't be saved, because anything that
+/// looks at it afterwards (metrics, expectations, classifiers) can't be
+/// trusted.
+async fn run_to_completion(
+    mut child: Child,
+    stdout: tokio::fs::File,
+    stderr: tokio::fs::File,
+    max_output_size: Option<u64>,
+    timeout: Option<Duration>,
+    cancelled: watch::Receiver<bool>,
+) -> Result<(Exit, Vec<String>), Error> {
+    let child_stdout = child.stdout.take().expect("stdout is piped");
+    let child_stderr = child.stderr.take().expect("stderr is piped");
+
+    let (status, stdout_truncated, stderr_truncated) = tokio::join!(
+        wait(child, timeout, cancelled),
+        capture(child_stdout, stdout, max_output_size),
+        capture(child_stderr, stderr, max_output_size),
+    );
+
+    let status = status?;
+    if let Exit::Cancelled = status {
+        // Nobody will look at the output
+        return Ok((status, Vec::new()));
+    }
+
+    let stdout_truncated = stdout_truncated.context("Unable to save stdout")?;
+    let stderr_truncated = stderr_truncated.context("Unable to save stderr")?;
+    let truncated = [("stdout", stdout_truncated), ("stderr", stderr_truncated)]
+        .into_iter()
+        .filter(|(_, truncated)| *truncated)
+        .map(|(name, _)| name.to_string())
+        .collect();
+
+    Ok((status, truncated))
+}
+
+/// Copy output to a file as it is produced, discarding anything after the
+/// first `max_size` bytes.
+///
+/// The source is always read to the end so the process never blocks on a
+/// full pipe, even if the output can't be saved. Returns `true` if any output
+/// was discarded because of `max_size`.
+async fn capture(
+    mut src: impl AsyncRead + Unpin,
+    dest: tokio::fs::File,
+    max_size: Option<u64>,
+) -> Result<bool, std::io::Error> {
+    let mut dest = tokio::io::BufWriter::new(dest);
+    let mut buffer = vec![0; 8 * 1024];
+    let mut written: u64 = 0;
+    let mut truncated = false;
+    let mut write_error = None;
+
+    loop {
+        let bytes_read = src.read(&mut buffer).await?;
+        if bytes_read == 0 {
+            break;
+        }
+        if write_error.is_some() {
+            // Keep draining the pipe, but don't try to write anything else
+            continue;
+        }
+
+        let remaining = max_size.map_or(u64::MAX, |max| max.saturating_sub(written));
+        let len = bytes_read.min(usize::try_from(remaining).unwrap_or(usize::MAX));
+
+        if len > 0 {
+            if let Err(e) = dest.write_all(&buffer[..len]).await {
+                write_error = Some(e);
+                continue;
+            }
+        }
+
+        written += len as u64;
+        truncated |= len < bytes_read;
+    }
+
+    if let Some(e) = write_error {
+        return Err(e);
+    }
+    dest.flush().await?;
+
+    Ok(truncated)
+}
+
+/// How a test case's process finished (see [`wait()`]).
+#[derive(Debug)]
+enum Exit {
+    Exited {
+        status: std::process::ExitStatus,
+        /// The CPU time used by the process, if the OS could tell us.
+        cpu_time: Option<Duration>,
+    },
+    /// The process ran for too long and was killed.
+    TimedOut,
+    /// The experiment was cancelled, so the process was stopped.
+    Cancelled,
+}
+
+/// Wait for a child process to exit, killing it if it runs for longer than
+/// `timeout` or stopping it if the experiment is cancelled.
+async fn wait(
+    mut child: Child,
+    timeout: Option<Duration>,
+    mut cancelled: watch::Receiver<bool>,
+) -> Result<Exit, std::io::Error> {
+    let timed_out = async {
+        match timeout {
+            Some(timeout) => tokio::time::sleep(timeout).await,
+            None => std::future::pending().await,
+        }
+    };
+    let was_cancelled = async {
+        while !*cancelled.borrow_and_update() {
+            // If the sender is dropped, the experiment can't be cancelled
+            if cancelled.changed().await.is_err() {
+                std::future::pending::<()>().await;
+            }
+        }
+    };
+
+    let exit = tokio::select! {
+        result = wait_for_exit(&mut child) => {
+            return result.map(|(status, cpu_time)| Exit::Exited { status, cpu_time });
+        }
+        _ = timed_out => Exit::TimedOut,
+        _ = was_cancelled => Exit::Cancelled,
+    };
+
+    match exit {
+        Exit::Cancelled => terminate(&mut child).await?,
+        _ => child.kill().await?,
+    }
+
+    Ok(exit)
+}
+
+/// Wait for a child process to exit, also returning the CPU time it used
+/// where that is supported.
+async fn wait_for_exit(
+    child: &mut Child,
+) -> Result<(std::process::ExitStatus, Option<Duration>), std::io::Error> {
+    #[cfg(target_os = "linux")]
+    let cpu_time = match child.id() {
+        Some(pid) => tokio::task::spawn_blocking(move || cpu_time_on_exit(pid))
+            .await
+            .ok()
+            .flatten(),
+        None => None,
+    };
+    #[cfg(not(target_os = "linux"))]
+    let cpu_time = None;
+
+    let status = child.wait().await?;
+
+    Ok((status, cpu_time))
+}
+
+/// Block until a child process exits and read its CPU time, without reaping
+/// it so [`Child::wait()`] still sees the exit status.
+#[cfg(target_os = "linux")]
+fn cpu_time_on_exit(pid: u32) -> Option<Duration> {
+    // Safety: siginfo_t and rusage are plain C structs which the kernel
+    // fills in, and WNOWAIT leaves the child for tokio to reap.
+    let usage = unsafe {
+        let mut info: libc::siginfo_t = std::mem::zeroed();
+        let mut usage: libc::rusage = std::mem::zeroed();
+
+        loop {
+            // The waitid() syscall takes an extra rusage argument which
+            // libc's wrapper doesn't expose
+            let ret = libc::syscall(
+                libc::SYS_waitid,
+                libc::P_PID,
+                pid as libc::id_t,
+                &mut info as *mut libc::siginfo_t,
+                libc::WEXITED | libc::WNOWAIT,
+                &mut usage as *mut libc::rusage,
+            );
+
+            match ret {
+                0 => break usage,
+                _ if std::io::Error::last_os_error().kind() == std::io::ErrorKind::Interrupted => {
+                    continue
+                }
+                _ => return None,
+            }
+        }
+    };
+
+    let duration = |t: libc::timeval| {
+        Duration::from_secs(t.tv_sec as u64) + Duration::from_micros(t.tv_usec as u64)
+    };
+
+    Some(duration(usage.ru_utime) + duration(usage.ru_stime))
+}
+
+/// Ask a process to exit, killing it if it doesn't within
+/// [`TERMINATION_GRACE_PERIOD`].
+async fn terminate(child: &mut Child) -> Result<(), std::io::Error> {
+    #[cfg(unix)]
+    if let Some(pid) = child.id() {
+        use nix::{sys::signal::Signal, unistd::Pid};
+
+        // The docker CLI forwards this to the container
+        let pid = Pid::from_raw(pid as i32);
+        if nix::sys::signal::kill(pid, Signal::SIGTERM).is_ok()
+            && tokio::time::timeout(TERMINATION_GRACE_PERIOD, child.wait())
+                .await
+                .is_ok()
+        {
+            return Ok(());
+        }
+    }
+
+    child.kill().await
+}
+
+/// Make the OS enforce resource limits on the `wasmer` CLI.
+#[cfg(unix)]
+fn apply_limits(cmd: &mut tokio::process::Command, limits: &Limits) {
+    use nix::sys::resource::{setrlimit, Resource as RLimit};
+
+    if limits.is_empty() {
+        return;
+    }
+
+    let cpu_seconds = limits.cpu_seconds;
+    let memory_bytes = limits.memory_mb.map(|mb| mb.saturating_mul(1024 * 1024));
+
+    // Safety: setrlimit() is async-signal-safe and we don't touch any other
+    // state in the child.
+    unsafe {
+        cmd.pre_exec(move || {
+            if let Some(secs) = cpu_seconds {
+                // Leave a gap between the soft and hard limits so the process
+                // gets SIGXCPU instead of SIGKILL
+                setrlimit(RLimit::RLIMIT_CPU, secs, secs.saturating_add(1))?;
+            }
+            if let Some(bytes) = memory_bytes {
+                // RLIMIT_DATA rather than RLIMIT_AS because wasmer reserves
+                // huge amounts of address space it never touches
+                setrlimit(RLimit::RLIMIT_DATA, bytes, bytes)?;
+            }
+            Ok(())
+        });
+    }
+}
+
+#[cfg(not(unix))]
+fn apply_limits(_cmd: &mut tokio::process::Command, limits: &Limits) {
+    if !limits.is_empty() {
+        tracing::warn!("Resource limits are only enforced on Unix");
+    }
+}
+
+/// Figure out whether the `wasmer` CLI was killed for exceeding one of its
+/// resource limits.
+///
+/// Any process can be killed by a signal, so the CPU time it used is compared
+/// with the limit where possible instead of trusting the signal alone.
+fn exceeded_limit(
+    limits: &Limits,
+    status: std::process::ExitStatus,
+    cpu_time: Option<Duration>,
+    in_container: bool,
+) -> Option<Resource> {
+    if status.success() {
+        return None;
+    }
+
+    #[cfg(unix)]
+    {
+        use nix::sys::signal::Signal;
+        use std::os::unix::process::ExitStatusExt;
+
+        let signal = match status.signal() {
+            Some(signal) => Some(signal),
+            // Docker reports a container killed by a signal as exiting
+            // with 128 + the signal number
+            None if in_container => status.code().filter(|&c| c > 128).map(|c| c - 128),
+            None => None,
+        };
+        let signal = signal.and_then(|s| Signal::try_from(s).ok());
+
+        let Some(signal) = signal else {
+            return None;
+        };
+
+        if let Some(secs) = limits.cpu_seconds {
+            let exceeded = match cpu_time {
+                // We only know the docker CLI's CPU time, not the container's
+                Some(cpu_time) if !in_container => cpu_time >= Duration::from_secs(secs),
+                _ => signal == Signal::SIGXCPU,
+            };
+            if exceeded {
+                return Some(Resource::Cpu);
+            }
+        }
+
+        if limits.memory_mb.is_some() {
+            let exceeded = match signal {
+                // The container or process was OOM killed
+                Signal::SIGKILL => true,
+                // Rust programs (like wasmer) abort when an allocation fails
+                Signal::SIGABRT => !in_container,
+                _ => false,
+            };
+            if exceeded {
+                return Some(Resource::Memory);
+            }
+        }
+    }
+
+    #[cfg(not(unix))]
+    let _ = (limits, cpu_time, in_container);
+
+    None
+}
+
+/// Start building a `docker run` command which will run the `wasmer` CLI
+/// inside a short-lived container.
+///
+/// The test case's directory is mounted at the same path inside the
+/// container, and resource limits are enforced by Docker rather than by us.
+fn docker_run<'a>(
+    docker: &DockerConfig,
+    name: &str,
+    base_dir: &Path,
+    limits: &Limits,
+    env: impl Iterator<Item = &'a str>,
+) -> tokio::process::Command {
+    let mut cmd = tokio::process::Command::new("docker");
+    let dir = base_dir.display();
+
+    cmd.arg("run")
+        .arg("--rm")
+        .arg("--init")
+        .arg(format!("--name={name}"))
+        .arg(format!("--volume={dir}:{dir}"))
+        .arg(format!("--workdir={dir}"));
+
+    // Only pass the names so values are read from our environment and
+    // secrets don't end up in the command line
+    for name in env {
+        cmd.arg(format!("--env={name}"));
+    }
+
+    if let Some(secs) = limits.cpu_seconds {
+        cmd.arg(format!("--ulimit=cpu={secs}:{}", secs.saturating_add(1)));
+    }
+    if let Some(mb) = limits.memory_mb {
+        cmd.arg(format!("--memory={mb}m"));
+    }
+
+    cmd.args(&docker.args).arg(&docker.image).arg("wasmer");
+
+    cmd
+}
+
+/// Forcibly stop a container started by [`docker_run()`].
+async fn kill_container(name: &str) {
+    let result = tokio::process::Command::new("docker")
+        .arg("kill")
+        .arg(name)
+        .stdin(Stdio::null())
+        .stdout(Stdio::null())
+        .stderr(Stdio::null())
+        .status()
+        .await;
+
+    if let Err(e) = result {
+        tracing::warn!(error = &e as &dyn std::error::Error, %name, "Unable to kill the container");
     }
 }
 
+/// Ask the `wasmer` CLI an experiment will use which version it is, without
+/// downloading anything.
+///
+/// Returns `None` if the experiment's `wasmer.version` is a release that
+/// hasn't been downloaded to `cache_dir` yet.
+pub async fn wasmer_build(
+    experiment: &Experiment,
+    cache_dir: &Path,
+) -> Result<Option<WasmerBuild>, Error> {
+    let executable = match &experiment.wasmer.version {
+        WasmerVersion::Latest => None,
+        version => match matrix::resolve_cached(version, cache_dir) {
+            Some(executable) => Some(executable),
+            None => return Ok(None),
+        },
+    };
+
+    default_build(experiment.docker.as_ref(), executable.as_deref())
+        .await
+        .map(Some)
+}
+
+/// Ask each `wasmer` CLI in an experiment's `wasmer.matrix` which version it
+/// is, keyed by matrix entry, without downloading anything.
+///
+/// Returns `None` if any of them are releases that haven't been downloaded to
+/// `cache_dir` yet.
+pub async fn matrix_builds(
+    experiment: &Experiment,
+    cache_dir: &Path,
+) -> Result<Option<IndexMap<String, WasmerBuild>>, Error> {
+    let mut builds = IndexMap::new();
+
+    for version in &experiment.wasmer.matrix {
+        let label = version.to_string();
+        let Some(executable) = matrix::resolve_cached(version, cache_dir) else {
+            return Ok(None);
+        };
+        let build = query_build(tokio::process::Command::new(&executable))
+            .await
+            .with_context(|| format!("Unable to query the \"{label}\" wasmer CLI"))?;
+        builds.insert(label, build);
+    }
+
+    Ok(Some(builds))
+}
+
+/// Ask the `wasmer` CLI used when there is no matrix which version it is,
+/// where `executable` comes from [`matrix::resolve_default()`].
+pub(crate) async fn default_build(
+    docker: Option<&DockerConfig>,
+    executable: Option<&Path>,
+) -> Result<WasmerBuild, Error> {
+    let cmd = match docker {
+        Some(docker) => {
+            let mut cmd = tokio::process::Command::new("docker");
+            cmd.arg("run").arg("--rm").arg(&docker.image).arg("wasmer");
+            cmd
+        }
+        None => tokio::process::Command::new(executable.unwrap_or(Path::new("wasmer"))),
+    };
+
+    query_build(cmd).await
+}
+
+/// Run `wasmer --version --verbose` using a particular command (e.g. a
+/// `wasmer` executable or `docker run ... wasmer`).
+pub(crate) async fn query_build(mut cmd: tokio::process::Command) -> Result<WasmerBuild, Error> {
+    let program = cmd.as_std().get_program().to_string_lossy().into_owned();
+    let output = cmd
+        .arg("--version")
+        .arg("--verbose")
+        .stdin(Stdio::null())
+        .output()
+        .await
+        .with_context(|| format!("Unable to start \"{program}\", is it installed?"))?;
+
+    anyhow::ensure!(
+        output.status.success(),
+        "\"wasmer --version\" failed with {}: {}",
+        output.status,
+        String::from_utf8_lossy(&output.stderr).trim(),
+    );
+
+    let stdout = String::from_utf8_lossy(&output.stdout);
+    let mut lines = stdout
+        .lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty());
+    let version = lines
+        .next()
+        .context("\"wasmer --version\" didn't print anything")?
+        .to_string();
+
+    // The verbose output is a series of "key: value" lines
+    let metadata = lines
+        .filter_map(|line| line.split_once(':'))
+        .map(|(key, value)| (key.trim().to_string(), value.trim().to_string()))
+        .collect();
+
+    Ok(WasmerBuild { version, metadata })
+}
+
+/// Take a snapshot of the machine we are running on.
+pub(crate) fn host_info() -> HostInfo {
+    let mut sys = System::new();
+    sys.refresh_cpu();
+    sys.refresh_memory();
+
+    let env = WHITELISTED_VARS
+        .iter()
+        .filter_map(|&var| Some((var.to_string(), std::env::var(var).ok()?)))
+        .collect();
+
+    HostInfo {
+        os: sys
+            .long_os_version()
+            .unwrap_or_else(|| std::env::consts::OS.to_string()),
+        arch: std::env::consts::ARCH.to_string(),
+        kernel: sys.kernel_version(),
+        cpu: sys.cpus().first().map(|cpu| cpu.brand().trim().to_string()),
+        cpus: sys.cpus().len(),
+        total_memory: sys.total_memory(),
+        env,
+    }
+}
+
+/// A `wasmer` command that is ready to be run.
+#[derive(Debug)]
+struct Invocation {
+    cmd: tokio::process::Command,
+    /// Secret values which should be masked when printing the command.
+    secrets: Vec<String>,
+    env: Env,
+    /// The name of the Docker container the test case is run in, if any.
+    container: Option<String>,
+    /// Where the CLI's stdout should be saved.
+    stdout: tokio::fs::File,
+    /// Where the CLI's stderr should be saved.
+    stderr: tokio::fs::File,
+}
+
+/// Host environment variables which are passed through to the `wasmer` CLI.
+const WHITELISTED_VARS: [&str; 2] = ["PATH", "WASMER_DIR"];
+/// The variables the `docker` CLI needs to find and talk to the daemon.
+const DOCKER_WHITELISTED_VARS: [&str; 7] = [
+    "PATH",
+    "HOME",
+    "DOCKER_HOST",
+    "DOCKER_CONFIG",
+    "DOCKER_CONTEXT",
+    "DOCKER_CERT_PATH",
+    "DOCKER_TLS_VERIFY",
+];
+
 #[tracing::instrument(skip_all)]
 async fn setup(
     experiment: &Experiment,
     test_case: &TestCase,
     assets: &Assets,
+    executable: Option<&Path>,
     base_dir: &Path,
     home_dir: &Path,
-) -> Result<tokio::process::Command, Error> {
+) -> Result<Invocation, Error> {
     if base_dir.exists() {
         tokio::fs::remove_dir_all(base_dir)
             .await
@@ -160,21 +898,95 @@ async fn setup(
         .await
         .context("Unable to create the working dir")?;
 
-    let tarball_path = fixtures_dir.join("package.tar.gz");
-    tokio::fs::copy(&assets.tarball, &tarball_path)
-        .await
-        .context("Unable to copy the tarball into place")?;
+    if let Some(tarball) = &assets.tarball {
+        tokio::fs::copy(tarball, fixtures_dir.join("package.tar.gz"))
+            .await
+            .context("Unable to copy the tarball into place")?;
+    }
 
-    let webc_path = fixtures_dir.join("package.webc");
     if let Some(webc) = &assets.webc {
-        tokio::fs::copy(webc, &webc_path)
+        tokio::fs::copy(webc, fixtures_dir.join("package.webc"))
             .await
             .context("Unable to copy the webc into place")?;
     }
 
-    let env = Env::new(fixtures_dir, out_dir, test_case);
+    let package_dir = fixtures_dir.join("package");
 
-    let mut cmd = tokio::process::Command::new("wasmer");
+    // Each test case gets its own copy in case the experiment modifies it
+    if let Some(unpacked) = &assets.unpacked {
+        copy_dir(unpacked, &package_dir)
+            .await
+            .context("Unable to copy the unpacked tarball into place")?;
+    }
+
+    let entrypoint = if experiment.run_unpacked {
+        let entrypoint = wasmer_toml::entrypoint(&package_dir, experiment.command.as_deref())
+            .await
+            .context("Unable to work out how to run the package")?;
+        tracing::debug!(
+            command = %entrypoint.command,
+            module = %entrypoint.module.display(),
+            "Running the package's own command",
+        );
+        Some(entrypoint)
+    } else {
+        None
+    };
+
+    let env = Env::new(
+        fixtures_dir,
+        out_dir,
+        test_case,
+        assets,
+        assets.unpacked.is_some(),
+    );
+
+    let mut secrets = Vec::new();
+    let mut wasmer_env = Vec::new();
+
+    for (name, value) in &experiment.wasmer.env {
+        let resolved = value.resolve(home_dir, |var| env.get_host(var))?;
+        if value.is_secret() {
+            secrets.push(resolved.to_string());
+        }
+        wasmer_env.push((name.as_str(), resolved));
+    }
+
+    let mut guest_env = Vec::new();
+    // Secrets are passed to the CLI via its environment so they don't end up
+    // in the command line, where anyone on the host could read them
+    let mut guest_secrets = Vec::new();
+
+    for (name, value) in &experiment.env {
+        let resolved = value.resolve(home_dir, |var| env.get_guest(var))?;
+        if value.is_secret() {
+            secrets.push(resolved.to_string());
+            guest_secrets.push((name.as_str(), resolved));
+        } else {
+            guest_env.push((name.as_str(), resolved));
+        }
+    }
+
+    let (mut cmd, container) = match &experiment.docker {
+        Some(docker) => {
+            let base_dir = tokio::fs::canonicalize(base_dir)
+                .await
+                .context("Unable to resolve the base directory")?;
+            let name = format!("borealis-{}", uuid::Uuid::new_v4());
+            let env_names = wasmer_env
+                .iter()
+                .chain(&guest_secrets)
+                .map(|(name, _)| *name);
+            let cmd = docker_run(docker, &name, &base_dir, &experiment.limits, env_names);
+            (cmd, Some(name))
+        }
+        None => {
+            let program = executable.unwrap_or(Path::new("wasmer"));
+            let mut cmd = tokio::process::Command::new(program);
+            apply_limits(&mut cmd, &experiment.limits);
+            (cmd, None)
+        }
+    };
 
     let stdout = tokio::fs::File::create(base_dir.join("stdout.txt"))
         .await
@@ -184,44 +996,337 @@ async fn setup(
         .context("Unable to open stderr.txt")?;
 
     cmd.current_dir(base_dir)
-        .stdout(stdout.into_std().await)
-        .stderr(stderr.into_std().await)
-        .stdin(std::process::Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .stdin(Stdio::null())
         .env_clear();
 
-    let whitelisted_vars = ["PATH", "WASMER_DIR"];
-
-    for var in whitelisted_vars {
+    let whitelist: &[&str] = if container.is_some() {
+        &DOCKER_WHITELISTED_VARS
+    } else {
+        &WHITELISTED_VARS
+    };
+    for var in whitelist {
         if let Some(value) = std::env::var_os(var) {
             cmd.env(var, value);
         }
     }
 
-    for (name, value) in &experiment.wasmer.env {
-        let value = value.resolve(home_dir, |var| env.get_host(var));
+    for (name, value) in wasmer_env.iter().chain(&guest_secrets) {
         cmd.env(name, value.as_ref());
     }
 
-    cmd.arg("run").arg(&experiment.package);
+    cmd.arg("run");
+
+    match &entrypoint {
+        Some(entrypoint) => {
+            // Paths are relative to the base directory so they also work
+            // inside a Docker container
+            let package_dir = Path::new("fixtures").join("package");
+            cmd.arg(package_dir.join(&entrypoint.module));
+            for (guest, host) in &entrypoint.mapped_dirs {
+                cmd.arg(format!(
+                    "--mapdir={guest}:{}",
+                    package_dir.join(host).display()
+                ));
+            }
+        }
+        None => {
+            cmd.arg(&experiment.package);
+            if let Some(command) = &experiment.command {
+                cmd.arg(format!("--command-name={command}"));
+            }
+        }
+    }
 
     for arg in &experiment.wasmer.args {
         let arg = arg.resolve(home_dir, |var| env.get_host(var));
         cmd.arg(arg.as_ref());
     }
 
-    for (name, value) in &experiment.env {
-        let value = value.resolve(home_dir, |var| env.get_guest(var));
+    for (name, value) in &guest_env {
         cmd.arg(format!("--env={name}={value}"));
     }
+    // The CLI reads the value of a bare "--env=NAME" from its own environment
+    for (name, _) in &guest_secrets {
+        cmd.arg(format!("--env={name}"));
+    }
 
     cmd.arg("--");
 
+    if let Some(entrypoint) = &entrypoint {
+        cmd.args(&entrypoint.main_args);
+    }
+
     for arg in &experiment.args {
         let arg = arg.resolve(home_dir, |var| env.get_guest(var));
         cmd.arg(arg.as_ref());
     }
 
-    Ok(cmd)
+    Ok(Invocation {
+        cmd,
+        secrets,
+        env,
+        container,
+        stdout,
+        stderr,
+    })
+}
+
+/// Recursively copy a directory's files.
+async fn copy_dir(src: &Path, dest: &Path) -> Result<(), Error> {
+    let src = src.to_path_buf();
+    let dest = dest.to_path_buf();
+
+    tokio::task::spawn_blocking(move || copy_dir_blocking(&src, &dest)).await?
+}
+
+fn copy_dir_blocking(src: &Path, dest: &Path) -> Result<(), Error> {
+    std::fs::create_dir_all(dest)
+        .with_context(|| format!("Unable to create \"{}\"", dest.display()))?;
+
+    for entry in
+        std::fs::read_dir(src).with_context(|| format!("Unable to read \"{}\"", src.display()))?
+    {
+        let entry = entry?;
+        let from = entry.path();
+        let to = dest.join(entry.file_name());
+        let file_type = entry.file_type()?;
+
+        // Note: symlinks are skipped because they could point anywhere on
+        // the host
+        if file_type.is_dir() {
+            copy_dir_blocking(&from, &to)?;
+        } else if file_type.is_file() {
+            std::fs::copy(&from, &to)
+                .with_context(|| format!("Unable to copy \"{}\"", from.display()))?;
+        }
+    }
+
+    Ok(())
+}
+
+/// Run one of the experiment's hooks on the host.
+///
+/// Hooks inherit the host's environment and have access to the same
+/// variables as the `wasmer` CLI (e.g. `$OUT_DIR`).
+#[tracing::instrument(skip_all, fields(hook = name))]
+async fn run_hook(
+    name: &str,
+    command: &[TemplatedString],
+    env: &Env,
+    base_dir: &Path,
+    home_dir: &Path,
+) -> Result<HookOutput, Error> {
+    let (program, args) = command
+        .split_first()
+        .with_context(|| format!("The {name} hook doesn't specify a command"))?;
+
+    let mut cmd =
+        tokio::process::Command::new(program.resolve(home_dir, |var| env.get_host(var)).as_ref());
+
+    for arg in args {
+        cmd.arg(arg.resolve(home_dir, |var| env.get_host(var)).as_ref());
+    }
+
+    cmd.current_dir(base_dir)
+        .stdin(Stdio::null())
+        .envs(env.host_vars());
+
+    tracing::debug!(cmd=?cmd.as_std(), "Running hook");
+
+    let output = cmd
+        .output()
+        .await
+        .with_context(|| format!("Unable to start the {name} hook"))?;
+
+    Ok(HookOutput {
+        status: output.status.into(),
+        stdout: String::from_utf8_lossy(&output.stdout).into_owned(),
+        stderr: String::from_utf8_lossy(&output.stderr).into_owned(),
+    })
+}
+
+/// Ask the experiment's [`Classifier`] whether a test case passed.
+///
+/// The classifier is sent the test case's exit code and output as JSON via
+/// stdin, and should print a [`Classification`] to stdout.
+#[tracing::instrument(skip_all, fields(classifier = %classifier.package))]
+async fn classify(
+    classifier: &Classifier,
+    status: ExitStatus,
+    base_dir: &Path,
+) -> Result<Classification, Error> {
+    let stdout = tokio::fs::read_to_string(base_dir.join("stdout.txt"))
+        .await
+        .context("Unable to read stdout.txt")?;
+    let stderr = tokio::fs::read_to_string(base_dir.join("stderr.txt"))
+        .await
+        .context("Unable to read stderr.txt")?;
+    let input = serde_json::to_vec(&serde_json::json!({
+        "exit-code": status.code,
+        "success": status.success,
+        "stdout": stdout,
+        "stderr": stderr,
+    }))?;
+
+    let mut cmd = tokio::process::Command::new("wasmer");
+    cmd.current_dir(base_dir)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .env_clear();
+
+    for var in WHITELISTED_VARS {
+        if let Some(value) = std::env::var_os(var) {
+            cmd.env(var, value);
+        }
+    }
+
+    cmd.arg("run")
+        .arg(&classifier.package)
+        .arg("--")
+        .args(&classifier.args);
+
+    tracing::debug!(cmd=?cmd.as_std(), "Invoking the classifier");
+
+    let mut child = cmd.spawn().context("Unable to start the classifier")?;
+    let mut stdin = child.stdin.take().expect("stdin is always piped");
+
+    // Note: we need to send the input while reading output, otherwise we
+    // could deadlock when the classifier fills up its stdout pipe.
+    let send_input = async move {
+        stdin.write_all(&input).await?;
+        stdin.shutdown().await
+    };
+    let (sent, output) = tokio::join!(send_input, child.wait_with_output());
+
+    let output = output.context("Unable to wait for the classifier")?;
+    sent.context("Unable to send the test case to the classifier")?;
+
+    if !output.status.success() {
+        anyhow::bail!(
+            "The classifier failed with {}: {}",
+            output.status,
+            String::from_utf8_lossy(&output.stderr).trim(),
+        );
+    }
+
+    let json = parse_json_output(&String::from_utf8_lossy(&output.stdout))
+        .context("The classifier didn't print a verdict")?;
+    let classification =
+        serde_json::from_value(json).context("Unable to parse the classifier's verdict")?;
+
+    Ok(classification)
+}
+
+/// Extract the experiment's metrics from the JSON a package printed to stdout.
+async fn extract_metrics(
+    metrics: &IndexMap<String, String>,
+    stdout: &Path,
+) -> IndexMap<String, serde_json::Value> {
+    if metrics.is_empty() {
+        return IndexMap::new();
+    }
+
+    let output = match tokio::fs::read_to_string(stdout).await {
+        Ok(output) => output,
+        Err(e) => {
+            tracing::warn!(
+                path=%stdout.display(),
+                error=&e as &dyn std::error::Error,
+                "Unable to read stdout to extract metrics",
+            );
+            return IndexMap::new();
+        }
+    };
+
+    let json = match parse_json_output(&output) {
+        Some(json) => json,
+        None => {
+            tracing::debug!("No JSON found in stdout");
+            return IndexMap::new();
+        }
+    };
+
+    metrics
+        .iter()
+        .filter_map(|(name, pointer)| {
+            let value = json.pointer(pointer)?;
+            Some((name.clone(), value.clone()))
+        })
+        .collect()
+}
+
+/// Check a test case against the experiment's [`Expectations`], returning a
+/// description of each one that wasn't met.
+pub(crate) async fn check_expectations(
+    expect: &Expectations,
+    status: ExitStatus,
+    base_dir: &Path,
+) -> Vec<String> {
+    let mut unmet = Vec::new();
+
+    let expected_code = expect.exit_code.unwrap_or(0);
+    if status.code != expected_code {
+        unmet.push(format!(
+            "Exited with {} instead of {expected_code}",
+            status.code
+        ));
+    }
+
+    for (stream, expectations) in [("stdout", &expect.stdout), ("stderr", &expect.stderr)] {
+        if expectations.is_empty() {
+            continue;
+        }
+
+        let filename = format!("{stream}.txt");
+        let output = match tokio::fs::read_to_string(base_dir.join(&filename)).await {
+            Ok(output) => output,
+            Err(e) => {
+                unmet.push(format!("Unable to read {filename}: {e}"));
+                continue;
+            }
+        };
+
+        for text in &expectations.contains {
+            if !output.contains(text.as_str()) {
+                unmet.push(format!("{stream} doesn't contain {text:?}"));
+            }
+        }
+
+        for pattern in &expectations.regex {
+            if !pattern.is_match(&output) {
+                unmet.push(format!("{stream} doesn't match /{}/", pattern.as_str()));
+            }
+        }
+    }
+
+    unmet
+}
+
+/// Parse the JSON printed by a package.
+///
+/// Packages will often log things before printing their result, so if the
+/// output as a whole isn't valid JSON we fall back to the last line that is.
+fn parse_json_output(output: &str) -> Option<serde_json::Value> {
+    serde_json::from_str(output).ok().or_else(|| {
+        output
+            .lines()
+            .rev()
+            .find_map(|line| serde_json::from_str(line).ok())
+    })
+}
+
+/// Get a printable version of a command with any secrets masked out.
+fn redact(cmd: &std::process::Command, secrets: &[String]) -> String {
+    let mut formatted = format!("{cmd:?}");
+
+    for secret in secrets.iter().filter(|s| !s.is_empty()) {
+        formatted = formatted.replace(secret.as_str(), "[REDACTED]");
+    }
+
+    formatted
 }
 
 #[derive(Debug, PartialEq, Clone)]
@@ -231,22 +1336,38 @@ struct Env {
 }
 
 impl Env {
-    fn new(fixtures_dir: PathBuf, out_dir: PathBuf, test_case: &TestCase) -> Self {
+    fn new(
+        fixtures_dir: PathBuf,
+        out_dir: PathBuf,
+        test_case: &TestCase,
+        assets: &Assets,
+        unpacked: bool,
+    ) -> Self {
         let mut common: HashMap<&str, String> = HashMap::new();
 
         common.insert("PKG_NAMESPACE", test_case.namespace.clone());
         common.insert("PKG_NAME", test_case.package_name.clone());
         common.insert("PKG_VERSION", test_case.version().to_string());
-        common.insert("TARBALL_FILENAME", "package.tar.gz".to_string());
 
         let mut host: HashMap<&str, String> = HashMap::new();
 
-        host.insert(
-            "TARBALL_PATH",
-            fixtures_dir.join("package.tar.gz").display().to_string(),
-        );
+        if assets.tarball.is_some() {
+            host.insert(
+                "TARBALL_PATH",
+                fixtures_dir.join("package.tar.gz").display().to_string(),
+            );
+            common.insert("TARBALL_FILENAME", "package.tar.gz".to_string());
+        }
 
-        if test_case.webc_url().is_some() {
+        if unpacked {
+            host.insert(
+                "PACKAGE_DIR",
+                fixtures_dir.join("package").display().to_string(),
+            );
+            common.insert("PACKAGE_DIRNAME", "package".to_string());
+        }
+
+        if assets.webc.is_some() {
             host.insert(
                 "WEBC_PATH",
                 fixtures_dir.join("package.webc").display().to_string(),
@@ -267,4 +1388,12 @@ impl Env {
     fn get_guest(&self, var: &str) -> Option<String> {
         self.common.get(var).cloned()
     }
+
+    /// Every variable that is visible to the host.
+    fn host_vars(&self) -> impl Iterator<Item = (&str, &str)> {
+        self.common
+            .iter()
+            .chain(&self.host)
+            .map(|(name, value)| (*name, value.as_str()))
+    }
 }
@@ -0,0 +1,298 @@
+//! Working out which language or toolchain a package was built with, using
+//! hints from its manifest and the custom sections of its WebAssembly
+//! modules.
+
+use std::{
+    collections::HashSet,
+    fs::File,
+    io::Read,
+    path::{Path, PathBuf},
+};
+
+use anyhow::{Context, Error};
+use flate2::read::GzDecoder;
+use wasmparser::{Parser, Payload, ProducersSectionReader};
+
+use crate::{
+    config::Toolchain,
+    experiment::{cache::Assets, wasmer_toml},
+};
+
+const WASM_HEADER: &[u8] = b"\0asm\x01\0\0\0";
+const MANIFESTS: &[&str] = &["wasmer.toml", "wapm.toml"];
+/// Words in a manifest's module sources which suggest the package is an
+/// interpreter for another language.
+const PYTHON_HINTS: &[&str] = &["python", "cpython"];
+const JAVASCRIPT_HINTS: &[&str] = &["spidermonkey", "quickjs", "qjs", "winterjs", "javy"];
+
+/// Guess which [`Toolchain`] a package was built with.
+///
+/// This is best-effort, so anything that goes wrong while inspecting the
+/// package just means the toolchain is [`Toolchain::Unknown`].
+pub(crate) async fn detect(assets: &Assets) -> Toolchain {
+    let tarball = assets.tarball.clone();
+    let webc = assets.webc.clone();
+
+    let result = tokio::task::spawn_blocking(move || inspect(tarball, webc))
+        .await
+        .map_err(Error::from)
+        .and_then(|r| r);
+
+    match result {
+        Ok(hints) => hints.toolchain(),
+        Err(e) => {
+            tracing::debug!(error = &*e, "Unable to inspect the package's artifacts");
+            Toolchain::Unknown
+        }
+    }
+}
+
+fn inspect(tarball: Option<PathBuf>, webc: Option<PathBuf>) -> Result<Hints, Error> {
+    let mut hints = Hints::default();
+
+    if let Some(tarball) = &tarball {
+        inspect_tarball(tarball, &mut hints)
+            .with_context(|| format!("Unable to inspect \"{}\"", tarball.display()))?;
+    }
+
+    if let Some(webc) = &webc {
+        // The webc format isn't something we can parse, but modules are
+        // stored as-is so they can still be found by their header
+        let bytes = std::fs::read(webc)
+            .with_context(|| format!("Unable to read \"{}\"", webc.display()))?;
+        let mut rest = bytes.as_slice();
+        while let Some(start) = find(rest, WASM_HEADER) {
+            rest = &rest[start..];
+            hints.scan_module(rest);
+            rest = &rest[WASM_HEADER.len()..];
+        }
+    }
+
+    Ok(hints)
+}
+
+fn inspect_tarball(path: &Path, hints: &mut Hints) -> Result<(), Error> {
+    let mut archive = tar::Archive::new(GzDecoder::new(File::open(path)?));
+
+    for entry in archive.entries()? {
+        let mut entry = entry?;
+        let path = entry.path()?.to_string_lossy().to_lowercase();
+        let file_name = path.rsplit('/').next().unwrap_or_default();
+
+        if path.ends_with(".wasm") {
+            let mut wasm = Vec::new();
+            entry.read_to_end(&mut wasm)?;
+            hints.scan_module(&wasm);
+        } else if MANIFESTS.contains(&file_name) {
+            let mut manifest = String::new();
+            entry.read_to_string(&mut manifest)?;
+            hints.scan_manifest(&manifest);
+        } else if path.ends_with(".py") || path.contains("/python3.") {
+            hints.python_files = true;
+        }
+    }
+
+    Ok(())
+}
+
+fn find(haystack: &[u8], needle: &[u8]) -> Option<usize> {
+    haystack
+        .windows(needle.len())
+        .position(|window| window == needle)
+}
+
+/// Everything we've learned about a package that says which toolchain it was
+/// built with.
+#[derive(Debug, Default)]
+struct Hints {
+    /// The `language` entries from each module's `producers` section.
+    languages: HashSet<String>,
+    /// The `processed-by` entries from each module's `producers` section.
+    processed_by: HashSet<String>,
+    custom_sections: HashSet<String>,
+    emscripten_imports: bool,
+    /// The module sources listed in the package's manifest.
+    module_sources: Vec<String>,
+    python_files: bool,
+}
+
+impl Hints {
+    fn toolchain(&self) -> Toolchain {
+        let mentions = |hints: &[&str]| {
+            self.module_sources
+                .iter()
+                .any(|source| hints.iter().any(|hint| source.contains(hint)))
+        };
+        let processed_by = |tool: &str| self.processed_by.iter().any(|p| p.contains(tool));
+
+        // Interpreters are normally written in C, so look for them first
+        if mentions(PYTHON_HINTS) {
+            Toolchain::Python
+        } else if mentions(JAVASCRIPT_HINTS) {
+            Toolchain::JavaScript
+        } else if processed_by("tinygo") {
+            Toolchain::TinyGo
+        } else if self.languages.contains("go") || self.custom_sections.contains("go:buildid") {
+            Toolchain::Go
+        } else if self.languages.contains("rust") || processed_by("rustc") {
+            Toolchain::Rust
+        } else if self.emscripten_imports || processed_by("emscripten") {
+            Toolchain::Emscripten
+        } else if self.languages.iter().any(|l| l.starts_with('c')) || processed_by("clang") {
+            Toolchain::C
+        } else if self.python_files {
+            // Lots of packages bundle a Python script or two, so this is only
+            // a hint when there is nothing else to go on
+            Toolchain::Python
+        } else {
+            Toolchain::Unknown
+        }
+    }
+
+    fn scan_manifest(&mut self, manifest: &str) {
+        match wasmer_toml::module_sources(manifest) {
+            Ok(sources) => self.module_sources.extend(
+                sources
+                    .iter()
+                    .map(|source| source.to_string_lossy().to_lowercase()),
+            ),
+            Err(e) => tracing::debug!(error = &*e, "Unable to parse the manifest"),
+        }
+    }
+
+    /// Look through a WebAssembly module's sections for hints, stopping as
+    /// soon as something doesn't look right (e.g. because there are trailing
+    /// bytes or the module is truncated).
+    fn scan_module(&mut self, wasm: &[u8]) {
+        for payload in Parser::new(0).parse_all(wasm) {
+            let valid = match payload {
+                Ok(Payload::CustomSection(section)) => {
+                    self.custom_sections.insert(section.name().to_string());
+                    if section.name() == "producers" {
+                        self.scan_producers(section.data(), section.data_offset())
+                    } else {
+                        Ok(())
+                    }
+                }
+                Ok(Payload::ImportSection(imports)) => imports.into_iter().try_for_each(|import| {
+                    if import?.name.starts_with("emscripten_") {
+                        self.emscripten_imports = true;
+                    }
+                    Ok(())
+                }),
+                Ok(Payload::End(_)) => return,
+                Ok(_) => Ok(()),
+                Err(e) => Err(e),
+            };
+
+            if valid.is_err() {
+                return;
+            }
+        }
+    }
+
+    fn scan_producers(&mut self, data: &[u8], offset: usize) -> wasmparser::Result<()> {
+        for field in ProducersSectionReader::new(data, offset)? {
+            let field = field?;
+            for value in field.values {
+                let value = value?.name.to_lowercase();
+                match field.name {
+                    "language" => self.languages.insert(value),
+                    "processed-by" => self.processed_by.insert(value),
+                    _ => false,
+                };
+            }
+        }
+
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Create a WebAssembly module containing a `producers` section.
+    fn module_with_producers(fields: &[(&str, &[&str])]) -> Vec<u8> {
+        fn string(dest: &mut Vec<u8>, s: &str) {
+            dest.push(s.len() as u8);
+            dest.extend(s.as_bytes());
+        }
+
+        let mut section = Vec::new();
+        string(&mut section, "producers");
+        section.push(fields.len() as u8);
+        for (field, values) in fields {
+            string(&mut section, field);
+            section.push(values.len() as u8);
+            for value in *values {
+                string(&mut section, value);
+                string(&mut section, "1.0.0");
+            }
+        }
+
+        let mut wasm = WASM_HEADER.to_vec();
+        wasm.push(0);
+        wasm.push(section.len() as u8);
+        wasm.extend(section);
+        wasm
+    }
+
+    #[test]
+    fn detect_toolchains_from_the_producers_section() {
+        let inputs: [(&[(&str, &[&str])], Toolchain); 5] = [
+            (
+                &[("language", &["Rust", "C11"]), ("processed-by", &["rustc"])],
+                Toolchain::Rust,
+            ),
+            (
+                &[("language", &["Go"]), ("processed-by", &["Go cmd/compile"])],
+                Toolchain::Go,
+            ),
+            (&[("processed-by", &["TinyGo"])], Toolchain::TinyGo),
+            (
+                &[("language", &["C99"]), ("processed-by", &["clang"])],
+                Toolchain::C,
+            ),
+            (&[("sdk", &["wasi-sdk"])], Toolchain::Unknown),
+        ];
+
+        for (fields, expected) in inputs {
+            let mut hints = Hints::default();
+            hints.scan_module(&module_with_producers(fields));
+            assert_eq!(hints.toolchain(), expected, "{fields:?}");
+        }
+    }
+
+    #[test]
+    fn interpreters_are_detected_from_the_manifest() {
+        let mut hints = Hints::default();
+        hints.scan_module(&module_with_producers(&[("language", &["C11"])]));
+        hints.scan_manifest("[[module]]\nname = \"python\"\nsource = \"lib/python.wasm\"\n");
+
+        assert_eq!(hints.toolchain(), Toolchain::Python);
+    }
+
+    #[test]
+    fn python_files_are_only_used_as_a_last_resort() {
+        let mut hints = Hints {
+            python_files: true,
+            ..Default::default()
+        };
+        assert_eq!(hints.toolchain(), Toolchain::Python);
+
+        hints.scan_module(&module_with_producers(&[("language", &["Rust"])]));
+
+        assert_eq!(hints.toolchain(), Toolchain::Rust);
+    }
+
+    #[test]
+    fn truncated_modules_are_ignored() {
+        let wasm = module_with_producers(&[("language", &["Rust"])]);
+        let mut hints = Hints::default();
+
+        hints.scan_module(&wasm[..wasm.len() - 3]);
+
+        assert_eq!(hints.toolchain(), Toolchain::Unknown);
+    }
+}
@@ -1,11 +1,17 @@
+use std::cmp::Ordering;
+
 use actix::{Actor, AsyncContext, Context, Handler, WrapFuture};
-use futures::{channel::mpsc::Sender, SinkExt, Stream, StreamExt};
+use anyhow::Error;
+use futures::{
+    channel::mpsc::{SendError, Sender},
+    Sink, SinkExt, Stream, StreamExt,
+};
 use reqwest::Client;
 use tracing::Instrument;
 use url::Url;
 
 use crate::{
-    config::Filters,
+    config::{Artifacts, Filters},
     registry::queries::{Package, PackageVersion},
 };
 
@@ -37,6 +43,7 @@ impl Actor for Wapm {
 #[rtype(result = "()")]
 pub(crate) struct FetchTestCases {
     pub filters: Filters,
+    pub artifacts: Artifacts,
     pub recipient: Sender<TestCaseDiscovered>,
 }
 
@@ -51,6 +58,7 @@ impl Handler<FetchTestCases> for Wapm {
     fn handle(&mut self, msg: FetchTestCases, ctx: &mut Self::Context) {
         let FetchTestCases {
             filters,
+            artifacts,
             mut recipient,
         } = msg;
 
@@ -59,12 +67,25 @@ impl Handler<FetchTestCases> for Wapm {
 
         ctx.spawn(
             async move {
-                let mut responses = discover_test_cases(client, filters, endpoint);
+                let mut responses = discover_test_cases(client, filters, artifacts, endpoint);
+
+                while let Some(page) = responses.next().await {
+                    let test_cases = match page {
+                        Ok(test_cases) => test_cases,
+                        Err(e) => {
+                            // Run whatever we could find
+                            tracing::error!(error = &*e, "Unable to discover some test cases");
+                            continue;
+                        }
+                    };
 
-                while let Some(test_cases) = responses.next().await {
                     for test_case in test_cases {
                         if recipient.send(TestCaseDiscovered(test_case)).await.is_err() {
-                            break;
+                            // Nobody is listening any more. Dropping the
+                            // stream lets the background tasks know they
+                            // can stop fetching pages.
+                            tracing::debug!("Discovery cancelled");
+                            return;
                         };
                     }
                 }
@@ -76,17 +97,23 @@ impl Handler<FetchTestCases> for Wapm {
 }
 
 /// Discover [`TestCase`]s, retrieving them page-by-page.
-fn discover_test_cases(
+///
+/// Errors are yielded in between pages, and discovery carries on with the
+/// next namespace or user (if any) afterwards.
+pub(crate) fn discover_test_cases(
     client: Client,
     filters: Filters,
+    artifacts: Artifacts,
     endpoint: Url,
-) -> impl Stream<Item = Vec<TestCase>> {
-    let (mut sender, receiver) = futures::channel::mpsc::channel(1);
+) -> impl Stream<Item = Result<Vec<TestCase>, Error>> {
+    let (mut sender, receiver) = futures::channel::mpsc::channel::<Result<Vec<Package>, Error>>(1);
     let Filters {
         namespaces,
         blacklist,
         include_every_version,
         users,
+        // Toolchains can only be detected once a package is downloaded
+        toolchains: _,
     } = filters;
 
     let hostname = endpoint.host_str().unwrap_or("unknown").to_string();
@@ -94,51 +121,59 @@ fn discover_test_cases(
     if namespaces.is_empty() && users.is_empty() {
         tokio::spawn(async move {
             if let Err(e) =
-                crate::registry::all_packages(&client, endpoint.as_str(), &mut sender).await
+                crate::registry::all_packages(&client, endpoint.as_str(), pages(&mut sender)).await
             {
-                tracing::error!(error = &*e, "Unable to list all packages");
+                let _ = sender
+                    .send(Err(e.context("Unable to list all packages")))
+                    .await;
             }
         });
     } else {
         tokio::spawn(async move {
             for namespace in &namespaces {
+                if sender.is_closed() {
+                    return;
+                }
+
                 if let Err(e) = crate::registry::all_packages_in_namespace(
                     &client,
                     endpoint.as_str(),
                     namespace,
-                    &mut sender,
+                    pages(&mut sender),
                 )
                 .await
                 {
-                    tracing::error!(
-                        error = &*e,
-                        namespace = namespace.as_str(),
-                        "Unable to fetch a namespace's packages"
-                    );
+                    let e = e.context(format!(
+                        "Unable to fetch the packages in the \"{namespace}\" namespace"
+                    ));
+                    let _ = sender.send(Err(e)).await;
                 }
             }
 
             for user in &users {
+                if sender.is_closed() {
+                    return;
+                }
+
                 if let Err(e) = crate::registry::all_packages_by_user(
                     &client,
                     endpoint.as_str(),
                     user,
-                    &mut sender,
+                    pages(&mut sender),
                 )
                 .await
                 {
-                    tracing::error!(
-                        error = &*e,
-                        user = user.as_str(),
-                        "Unable to fetch a user's packages"
-                    );
+                    let e = e.context(format!("Unable to fetch the packages owned by \"{user}\""));
+                    let _ = sender.send(Err(e)).await;
                 }
             }
         });
     }
 
     receiver.map(move |page| {
-        page.into_iter()
+        let page = page?;
+        let test_cases = page
+            .into_iter()
             .filter(|pkg| blacklist.is_empty() || !blacklist.contains(&pkg.display_name))
             .flat_map(|pkg| {
                 if include_every_version {
@@ -147,10 +182,21 @@ fn discover_test_cases(
                     TestCase::latest(&hostname, pkg)
                 }
             })
-            .collect()
+            // We can't run the experiment without the artifact it asked for
+            .filter(|test_case| artifacts != Artifacts::Webc || test_case.webc_url().is_some())
+            .collect();
+        Ok(test_cases)
     })
 }
 
+/// Adapt a channel of discovery results into the sink of pages the registry
+/// helpers expect.
+fn pages(
+    sender: &mut Sender<Result<Vec<Package>, Error>>,
+) -> impl Sink<Vec<Package>, Error = SendError> + Unpin + '_ {
+    sender.with(|page| futures::future::ready(Ok::<_, SendError>(Ok(page))))
+}
+
 /// A package version that will be included in the experiment.
 #[derive(Debug, Clone, serde::Serialize, serde::Deserialize)]
 pub struct TestCase {
@@ -224,4 +270,21 @@ impl TestCase {
     pub fn display_name(&self) -> String {
         format!("{}/{}", self.namespace, self.package_name)
     }
+
+    /// Compare two [`TestCase`]s by namespace and package name, with the
+    /// newest version first.
+    pub(crate) fn cmp_canonical(&self, other: &TestCase) -> Ordering {
+        (&self.namespace, &self.package_name)
+            .cmp(&(&other.namespace, &other.package_name))
+            .then_with(|| compare_versions(other.version(), self.version()))
+    }
+}
+
+/// Compare two version numbers, falling back to a string comparison if they
+/// aren't valid semver.
+pub(crate) fn compare_versions(a: &str, b: &str) -> Ordering {
+    match (a.parse::<semver::Version>(), b.parse::<semver::Version>()) {
+        (Ok(a), Ok(b)) => a.cmp(&b),
+        _ => a.cmp(b),
+    }
 }
@@ -0,0 +1,315 @@
+//! Just enough of the `wasmer.toml` format to work out how to run a package
+//! from its unpacked tarball.
+
+use std::path::{Component, Path, PathBuf};
+
+use anyhow::{Context, Error};
+use indexmap::IndexMap;
+
+/// How to run one of a package's commands.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub(crate) struct Entrypoint {
+    /// The name of the command being run.
+    pub command: String,
+    /// The command's WebAssembly module, relative to the package directory.
+    pub module: PathBuf,
+    /// Arguments the package's author wants passed to the module before any
+    /// others.
+    pub main_args: Vec<String>,
+    /// Directories from the package which should be made available to the
+    /// guest, as `(guest path, path relative to the package directory)`.
+    pub mapped_dirs: Vec<(String, PathBuf)>,
+}
+
+/// Read the `wasmer.toml` in a package's directory and find the command to
+/// run.
+///
+/// The `command` is used if one is provided, otherwise we fall back to the
+/// package's entrypoint or its only command.
+pub(crate) async fn entrypoint(
+    package_dir: &Path,
+    command: Option<&str>,
+) -> Result<Entrypoint, Error> {
+    let path = package_dir.join("wasmer.toml");
+    let raw = tokio::fs::read_to_string(&path)
+        .await
+        .with_context(|| format!("Unable to read \"{}\"", path.display()))?;
+    let manifest: Manifest =
+        toml::from_str(&raw).with_context(|| format!("Unable to parse \"{}\"", path.display()))?;
+
+    manifest.entrypoint(command)
+}
+
+/// The `source` of every module in a manifest.
+pub(crate) fn module_sources(manifest: &str) -> Result<Vec<PathBuf>, Error> {
+    let manifest: Manifest = toml::from_str(manifest)?;
+    Ok(manifest.module.into_iter().map(|m| m.source).collect())
+}
+
+#[derive(Debug, Default, serde::Deserialize)]
+struct Manifest {
+    #[serde(default)]
+    package: Option<Package>,
+    #[serde(default)]
+    module: Vec<Module>,
+    #[serde(default)]
+    command: Vec<Command>,
+    #[serde(default)]
+    fs: IndexMap<String, PathBuf>,
+}
+
+#[derive(Debug, serde::Deserialize)]
+struct Package {
+    #[serde(default)]
+    entrypoint: Option<String>,
+}
+
+#[derive(Debug, serde::Deserialize)]
+struct Module {
+    name: String,
+    source: PathBuf,
+}
+
+#[derive(Debug, serde::Deserialize)]
+struct Command {
+    name: String,
+    module: String,
+    /// Older manifests pass arguments as a single string.
+    #[serde(default)]
+    main_args: Option<String>,
+    #[serde(default)]
+    annotations: Option<toml::Value>,
+}
+
+impl Command {
+    fn main_args(&self) -> Vec<String> {
+        let wasi_args = self
+            .annotations
+            .as_ref()
+            .and_then(|a| a.get("wasi"))
+            .and_then(|wasi| wasi.get("main-args"))
+            .and_then(|args| args.as_array());
+
+        match (wasi_args, &self.main_args) {
+            (Some(args), _) => args
+                .iter()
+                .filter_map(|arg| arg.as_str())
+                .map(String::from)
+                .collect(),
+            (None, Some(args)) => args.split_whitespace().map(String::from).collect(),
+            (None, None) => Vec::new(),
+        }
+    }
+}
+
+impl Manifest {
+    fn entrypoint(&self, command: Option<&str>) -> Result<Entrypoint, Error> {
+        let name = command.or_else(|| self.package.as_ref()?.entrypoint.as_deref());
+
+        let cmd = match name {
+            Some(name) => self
+                .command
+                .iter()
+                .find(|c| c.name == name)
+                .with_context(|| format!("The package doesn't have a \"{name}\" command"))?,
+            None => match self.command.as_slice() {
+                [cmd] => cmd,
+                [] => anyhow::bail!("The package doesn't have any commands"),
+                _ => anyhow::bail!(
+                    "The package has several commands and no entrypoint, so \"command\" needs to be set"
+                ),
+            },
+        };
+
+        // e.g. "wasmer/python:python"
+        anyhow::ensure!(
+            !cmd.module.contains(':'),
+            "The \"{}\" command uses a module from one of the package's dependencies (\"{}\")",
+            cmd.name,
+            cmd.module,
+        );
+
+        let module = self
+            .module
+            .iter()
+            .find(|m| m.name == cmd.module)
+            .with_context(|| {
+                format!(
+                    "The \"{}\" command uses the \"{}\" module, which doesn't exist",
+                    cmd.name, cmd.module,
+                )
+            })?;
+
+        anyhow::ensure!(
+            is_inside_package(&module.source),
+            "The \"{}\" module's source (\"{}\") is outside the package directory",
+            module.name,
+            module.source.display(),
+        );
+
+        for (guest, host) in &self.fs {
+            anyhow::ensure!(
+                is_inside_package(host),
+                "\"{}\" (mapped to \"{guest}\") is outside the package directory",
+                host.display(),
+            );
+        }
+
+        Ok(Entrypoint {
+            command: cmd.name.clone(),
+            module: module.source.clone(),
+            main_args: cmd.main_args(),
+            mapped_dirs: self
+                .fs
+                .iter()
+                .map(|(guest, host)| (guest.clone(), host.clone()))
+                .collect(),
+        })
+    }
+}
+
+/// Make sure a path from the manifest can't be used to reach files outside
+/// the package.
+fn is_inside_package(path: &Path) -> bool {
+    path.components()
+        .all(|c| matches!(c, Component::Normal(_) | Component::CurDir))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn parse(manifest: &str) -> Manifest {
+        toml::from_str(manifest).unwrap()
+    }
+
+    #[test]
+    fn use_the_only_command() {
+        let manifest = parse(
+            r#"
+            [package]
+            name = "wasmer/sha2"
+            version = "0.1.0"
+
+            [[module]]
+            name = "sha2"
+            source = "target/wasm32-wasi/release/sha2.wasm"
+
+            [[command]]
+            name = "sha2"
+            module = "sha2"
+            "#,
+        );
+
+        let entrypoint = manifest.entrypoint(None).unwrap();
+
+        assert_eq!(
+            entrypoint,
+            Entrypoint {
+                command: "sha2".to_string(),
+                module: PathBuf::from("target/wasm32-wasi/release/sha2.wasm"),
+                main_args: Vec::new(),
+                mapped_dirs: Vec::new(),
+            }
+        );
+    }
+
+    #[test]
+    fn entrypoint_picks_between_commands() {
+        let manifest = parse(
+            r#"
+            [package]
+            entrypoint = "python"
+
+            [[module]]
+            name = "python"
+            source = "python.wasm"
+
+            [[command]]
+            name = "pip"
+            module = "python"
+            main_args = "-m pip"
+
+            [[command]]
+            name = "python"
+            module = "python"
+            runner = "wasi"
+
+            [command.annotations.wasi]
+            main-args = ["/app/main.py"]
+
+            [fs]
+            "/app" = "src"
+            "#,
+        );
+
+        let entrypoint = manifest.entrypoint(None).unwrap();
+        assert_eq!(entrypoint.command, "python");
+        assert_eq!(entrypoint.main_args, ["/app/main.py"]);
+        assert_eq!(
+            entrypoint.mapped_dirs,
+            [("/app".to_string(), PathBuf::from("src"))]
+        );
+
+        // The experiment's "command" takes precedence
+        let pip = manifest.entrypoint(Some("pip")).unwrap();
+        assert_eq!(pip.command, "pip");
+        assert_eq!(pip.main_args, ["-m", "pip"]);
+    }
+
+    #[test]
+    fn ambiguous_commands_are_an_error() {
+        let manifest = parse(
+            r#"
+            [[module]]
+            name = "tools"
+            source = "tools.wasm"
+
+            [[command]]
+            name = "first"
+            module = "tools"
+
+            [[command]]
+            name = "second"
+            module = "tools"
+            "#,
+        );
+
+        assert!(manifest.entrypoint(None).is_err());
+        assert!(manifest.entrypoint(Some("third")).is_err());
+    }
+
+    #[test]
+    fn modules_must_be_inside_the_package() {
+        let manifest = parse(
+            r#"
+            [[module]]
+            name = "evil"
+            source = "../../evil.wasm"
+
+            [[command]]
+            name = "evil"
+            module = "evil"
+            "#,
+        );
+
+        assert!(manifest.entrypoint(None).is_err());
+
+        let manifest = parse(
+            r#"
+            [[module]]
+            name = "evil"
+            source = "evil.wasm"
+
+            [[command]]
+            name = "evil"
+            module = "evil"
+
+            [fs]
+            "/etc" = "/etc"
+            "#,
+        );
+
+        assert!(manifest.entrypoint(None).is_err());
+    }
+}
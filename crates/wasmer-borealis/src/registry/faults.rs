@@ -0,0 +1,66 @@
+//! Deliberately injected failures, so the code which recovers from a flaky
+//! registry (politeness pauses, failed fetches, partial results, etc.)
+//! actually gets exercised.
+//!
+//! Faults are disabled by default and should only be enabled in tests and
+//! staging environments.
+
+use std::{sync::Mutex, time::Duration};
+
+use anyhow::Error;
+use once_cell::sync::Lazy;
+use rand::Rng;
+
+static FAULTS: Lazy<Mutex<Faults>> = Lazy::new(Default::default);
+
+/// Failures to inject into requests sent to the registry.
+#[derive(Debug, Default, Clone, Copy, PartialEq)]
+pub struct Faults {
+    /// The fraction of downloads, between `0.0` and `1.0`, which will fail
+    /// before being sent.
+    pub download_failure_rate: f64,
+    /// An extra delay added to every query and download.
+    pub delay: Duration,
+}
+
+impl Faults {
+    fn is_empty(&self) -> bool {
+        self.download_failure_rate <= 0.0 && self.delay.is_zero()
+    }
+}
+
+/// Inject [`Faults`] into every request made by this process, returning the
+/// previous faults so they can be restored afterwards.
+pub fn set_faults(faults: Faults) -> Faults {
+    if !faults.is_empty() {
+        tracing::warn!(?faults, "Fault injection is enabled");
+    }
+
+    std::mem::replace(&mut *FAULTS.lock().unwrap(), faults)
+}
+
+/// The kinds of request that faults can be injected into.
+#[derive(Debug, Copy, Clone, PartialEq, Eq)]
+pub(crate) enum Request {
+    Query,
+    Download,
+}
+
+/// Apply any [`Faults`] relevant to a request, returning an error if the
+/// request should fail.
+pub(crate) async fn inject(request: Request) -> Result<(), Error> {
+    let faults = *FAULTS.lock().unwrap();
+
+    if !faults.delay.is_zero() {
+        tokio::time::sleep(faults.delay).await;
+    }
+
+    if request == Request::Download
+        && rand::thread_rng().gen::<f64>() < faults.download_failure_rate
+    {
+        tracing::debug!("Injecting a download failure");
+        anyhow::bail!("Injected download failure");
+    }
+
+    Ok(())
+}
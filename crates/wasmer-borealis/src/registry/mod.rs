@@ -1,8 +1,20 @@
+pub(crate) mod faults;
+pub(crate) mod politeness;
+
+use std::{fmt::Debug, time::Duration};
+
 use anyhow::{Context, Error};
 use cynic::{GraphQlError, GraphQlResponse, Operation, QueryBuilder};
 use futures::{Sink, SinkExt};
-use reqwest::Client;
-
+use reqwest::{
+    header::{HeaderMap, HeaderValue, RETRY_AFTER},
+    Client, StatusCode,
+};
+
+pub use self::{
+    faults::{set_faults, Faults},
+    politeness::{set_politeness, Politeness},
+};
 use crate::registry::queries::Variables;
 
 #[tracing::instrument(skip_all)]
@@ -17,15 +29,8 @@ where
 {
     let op = queries::GetAllPackages::build(());
 
-    let response: GraphQlResponse<queries::GetAllPackages> = client
-        .post(graphql_endpoint)
-        .header("Content-Type", "application/json")
-        .json(&op)
-        .send()
-        .await?
-        .error_for_status()?
-        .json()
-        .await?;
+    let response: GraphQlResponse<queries::GetAllPackages> =
+        send_query(client, graphql_endpoint, &op).await?;
 
     if let Some(errors) = response.errors {
         return Err(aggregate_errors(errors));
@@ -131,15 +136,7 @@ where
 
         tracing::debug!(offset, "Fetching a page of packages");
 
-        let response: GraphQlResponse<Q> = client
-            .post(graphql_endpoint)
-            .header("Content-Type", "application/json")
-            .json(&op)
-            .send()
-            .await?
-            .error_for_status()?
-            .json()
-            .await?;
+        let response: GraphQlResponse<Q> = send_query(client, graphql_endpoint, &op).await?;
 
         if let Some(errors) = response.errors {
             if !errors.is_empty() {
@@ -167,8 +164,174 @@ where
     Ok(())
 }
 
-fn aggregate_errors(_errors: Vec<GraphQlError>) -> Error {
-    todo!()
+/// Ask the registry which user the [`Client`] is authenticated as.
+///
+/// This returns `None` when the request was anonymous or the token wasn't
+/// accepted.
+#[tracing::instrument(skip_all)]
+pub async fn whoami(client: &Client, graphql_endpoint: &str) -> Result<Option<String>, Error> {
+    let op = queries::WhoAmI::build(());
+
+    let response: GraphQlResponse<queries::WhoAmI> =
+        send_query(client, graphql_endpoint, &op).await?;
+
+    if let Some(errors) = response.errors {
+        if !errors.is_empty() {
+            return Err(aggregate_errors(errors));
+        }
+    }
+
+    let username = response
+        .data
+        .and_then(|data| data.viewer)
+        .map(|viewer| viewer.username);
+
+    Ok(username)
+}
+
+/// How many times a rate-limited request is retried before giving up.
+const MAX_RATE_LIMIT_RETRIES: u32 = 5;
+/// The longest we are willing to wait when the registry says to back off.
+const MAX_RETRY_DELAY: Duration = Duration::from_secs(5 * 60);
+
+/// Send a GraphQL query to the registry, backing off and retrying whenever
+/// we get rate limited.
+async fn send_query<Q>(
+    client: &Client,
+    graphql_endpoint: &str,
+    op: &impl serde::Serialize,
+) -> Result<GraphQlResponse<Q>, Error>
+where
+    Q: serde::de::DeserializeOwned,
+{
+    let mut attempt = 0;
+
+    loop {
+        let permit = politeness::acquire(graphql_endpoint).await;
+        faults::inject(faults::Request::Query).await?;
+        let response = client
+            .post(graphql_endpoint)
+            .header("Content-Type", "application/json")
+            .json(op)
+            .send()
+            .await;
+        permit.record(is_success(&response));
+        let response = response?;
+
+        if response.status() == StatusCode::TOO_MANY_REQUESTS && attempt < MAX_RATE_LIMIT_RETRIES {
+            let delay = retry_after(&response)
+                .unwrap_or_else(|| Duration::from_secs(1 << attempt))
+                .min(MAX_RETRY_DELAY);
+            tracing::warn!(
+                attempt,
+                delay = ?delay,
+                "Rate limited by the registry, backing off",
+            );
+            tokio::time::sleep(delay).await;
+            attempt += 1;
+            continue;
+        }
+
+        let response = response.error_for_status()?.json().await?;
+        return Ok(response);
+    }
+}
+
+/// Did the host handle a request successfully?
+///
+/// Client errors are our fault rather than the host's, so only connection
+/// errors, server errors, and rate limiting count as failures.
+pub(crate) fn is_success(response: &Result<reqwest::Response, reqwest::Error>) -> bool {
+    match response {
+        Ok(r) => !r.status().is_server_error() && r.status() != StatusCode::TOO_MANY_REQUESTS,
+        Err(_) => false,
+    }
+}
+
+/// Parse the `Retry-After` header, if the registry sent one.
+///
+/// Only the "delay in seconds" form is supported. HTTP dates fall back to
+/// exponential backoff.
+fn retry_after(response: &reqwest::Response) -> Option<Duration> {
+    let value = response.headers().get(RETRY_AFTER)?.to_str().ok()?;
+    value.trim().parse().ok().map(Duration::from_secs)
+}
+
+fn aggregate_errors(errors: Vec<GraphQlError>) -> Error {
+    let messages: Vec<_> = errors.iter().map(|e| e.message.as_str()).collect();
+
+    match messages.as_slice() {
+        [] => Error::msg("The GraphQL query failed"),
+        [message] => Error::msg(message.to_string()),
+        _ => Error::msg(format!(
+            "The GraphQL query failed with {} errors: {}",
+            messages.len(),
+            messages.join("; ")
+        )),
+    }
+}
+
+/// The `User-Agent` sent with every request, before any
+/// [`ClientOptions::user_agent_suffix`].
+pub const USER_AGENT: &str = concat!(env!("CARGO_PKG_NAME"), "/", env!("CARGO_PKG_VERSION"));
+
+/// Settings for the HTTP client used to talk to the registry.
+#[derive(Default, Clone)]
+pub struct ClientOptions {
+    /// Authenticate with this token.
+    pub token: Option<String>,
+    /// Extra text appended to the `User-Agent` header (e.g. to identify a
+    /// particular CI pipeline).
+    pub user_agent_suffix: Option<String>,
+    /// How the registry's operators can get in touch (e.g. an email
+    /// address), sent in the `From` header.
+    pub contact: Option<String>,
+}
+
+impl Debug for ClientOptions {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let ClientOptions {
+            token,
+            user_agent_suffix,
+            contact,
+        } = self;
+
+        f.debug_struct("ClientOptions")
+            .field("token", &token.as_ref().map(|_| "[REDACTED]"))
+            .field("user_agent_suffix", user_agent_suffix)
+            .field("contact", contact)
+            .finish()
+    }
+}
+
+/// Create a HTTP client for talking to the registry.
+pub fn http_client(options: &ClientOptions) -> Result<Client, Error> {
+    let mut headers = HeaderMap::new();
+
+    let user_agent = match &options.user_agent_suffix {
+        Some(suffix) => format!("{USER_AGENT} {suffix}"),
+        None => USER_AGENT.to_string(),
+    };
+    let user_agent = HeaderValue::from_str(&user_agent)
+        .with_context(|| format!("\"{user_agent}\" isn't a valid User-Agent"))?;
+    headers.insert(reqwest::header::USER_AGENT, user_agent);
+
+    if let Some(contact) = &options.contact {
+        let from = HeaderValue::from_str(contact)
+            .with_context(|| format!("\"{contact}\" isn't a valid contact"))?;
+        headers.insert(reqwest::header::FROM, from);
+    }
+
+    if let Some(token) = &options.token {
+        let mut auth_header: HeaderValue = format!("bearer {token}").parse()?;
+        // Make sure the token never shows up in debug output
+        auth_header.set_sensitive(true);
+        headers.insert(reqwest::header::AUTHORIZATION, auth_header);
+    }
+
+    let client = Client::builder().default_headers(headers).build()?;
+
+    Ok(client)
 }
 
 #[cynic::schema_for_derives(
@@ -238,6 +401,11 @@ pub mod queries {
         pub id: cynic::Id,
         pub version: String,
         pub distribution: PackageDistribution,
+        /// This is always set by the registry, but results saved by older
+        /// versions of Borealis won't have it.
+        pub description: Option<String>,
+        pub repository: Option<String>,
+        pub homepage: Option<String>,
     }
 
     #[derive(cynic::QueryFragment, Debug, Clone, serde::Serialize)]
@@ -252,6 +420,18 @@ pub mod queries {
     pub struct GetAllPackages {
         pub packages: Option<PackageConnection>,
     }
+
+    #[derive(cynic::QueryFragment, Debug, Clone)]
+    #[cynic(graphql_type = "Query")]
+    pub struct WhoAmI {
+        pub viewer: Option<Viewer>,
+    }
+
+    #[derive(cynic::QueryFragment, Debug, Clone)]
+    #[cynic(graphql_type = "User")]
+    pub struct Viewer {
+        pub username: String,
+    }
 }
 
 #[allow(non_snake_case, non_camel_case_types)]
@@ -0,0 +1,233 @@
+//! Safeguards which stop Borealis from overwhelming a registry.
+//!
+//! Every request to a particular host goes through the same [`Throttle`], so
+//! limits apply across all queries and downloads in the process.
+//!
+//! All timing uses tokio's clock, so tests can control it with
+//! [`tokio::time::pause()`].
+
+use std::{
+    collections::HashMap,
+    sync::{Arc, Mutex},
+    time::Duration,
+};
+
+use once_cell::sync::Lazy;
+use tokio::{
+    sync::{OwnedSemaphorePermit, Semaphore},
+    time::Instant,
+};
+use url::Url;
+
+static THROTTLES: Lazy<Mutex<HashMap<String, Arc<Throttle>>>> = Lazy::new(Default::default);
+
+/// Limits on how hard Borealis will hit a single host.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct Politeness {
+    /// The maximum number of requests to start each second.
+    pub max_requests_per_second: f64,
+    /// The maximum number of requests that can be in flight at once.
+    pub max_concurrent_requests: usize,
+    /// Pause all requests to the host after this many requests in a row
+    /// fail (e.g. with a 5xx error).
+    pub max_consecutive_errors: u32,
+    /// How long to pause for once the host starts returning errors.
+    pub pause: Duration,
+}
+
+impl Default for Politeness {
+    fn default() -> Self {
+        Politeness {
+            max_requests_per_second: 10.0,
+            max_concurrent_requests: 8,
+            max_consecutive_errors: 5,
+            pause: Duration::from_secs(30),
+        }
+    }
+}
+
+/// Override the [`Politeness`] settings used for a particular host (e.g.
+/// `registry.wasmer.io`), returning the previous settings so they can be
+/// restored afterwards.
+pub fn set_politeness(host: &str, politeness: Politeness) -> Politeness {
+    let mut throttles = THROTTLES.lock().unwrap();
+    throttles
+        .insert(host.to_string(), Arc::new(Throttle::new(politeness)))
+        .map(|previous| previous.politeness)
+        .unwrap_or_default()
+}
+
+/// Wait until we are allowed to send a request to `url`.
+pub(crate) async fn acquire(url: &str) -> Permit {
+    let host = Url::parse(url)
+        .ok()
+        .and_then(|u| u.host_str().map(String::from))
+        .unwrap_or_default();
+
+    let throttle = THROTTLES
+        .lock()
+        .unwrap()
+        .entry(host.clone())
+        .or_insert_with(|| Arc::new(Throttle::new(Politeness::default())))
+        .clone();
+
+    throttle.acquire(host).await
+}
+
+#[derive(Debug)]
+struct Throttle {
+    politeness: Politeness,
+    semaphore: Arc<Semaphore>,
+    state: Mutex<State>,
+}
+
+#[derive(Debug)]
+struct State {
+    /// The earliest time the next request can be sent.
+    next_slot: Instant,
+    consecutive_errors: u32,
+    paused_until: Option<Instant>,
+}
+
+impl Throttle {
+    fn new(politeness: Politeness) -> Self {
+        Throttle {
+            politeness,
+            semaphore: Arc::new(Semaphore::new(politeness.max_concurrent_requests.max(1))),
+            state: Mutex::new(State {
+                next_slot: Instant::now(),
+                consecutive_errors: 0,
+                paused_until: None,
+            }),
+        }
+    }
+
+    async fn acquire(self: Arc<Self>, host: String) -> Permit {
+        let permit = Arc::clone(&self.semaphore)
+            .acquire_owned()
+            .await
+            .expect("The semaphore is never closed");
+
+        let delay = self.reserve_slot();
+        if !delay.is_zero() {
+            tracing::trace!(%host, ?delay, "Waiting before sending a request");
+            tokio::time::sleep(delay).await;
+        }
+
+        Permit {
+            host,
+            throttle: self,
+            _permit: permit,
+        }
+    }
+
+    fn interval(&self) -> Duration {
+        let rps = self.politeness.max_requests_per_second;
+
+        if rps.is_finite() && rps > 0.0 {
+            Duration::from_secs_f64(1.0 / rps)
+        } else {
+            Duration::ZERO
+        }
+    }
+
+    /// Reserve the next time slot, returning how long the caller needs to
+    /// wait for it.
+    fn reserve_slot(&self) -> Duration {
+        let mut state = self.state.lock().unwrap();
+        let now = Instant::now();
+
+        let mut start = state.next_slot.max(now);
+        if let Some(paused_until) = state.paused_until {
+            start = start.max(paused_until);
+        }
+        state.next_slot = start + self.interval();
+
+        start - now
+    }
+}
+
+/// Permission to send a single request, which should be held until the
+/// response has been read.
+#[derive(Debug)]
+pub(crate) struct Permit {
+    host: String,
+    throttle: Arc<Throttle>,
+    _permit: OwnedSemaphorePermit,
+}
+
+impl Permit {
+    /// Record whether the request succeeded, pausing all requests to the
+    /// host if it keeps failing.
+    pub fn record(&self, success: bool) {
+        let mut state = self.throttle.state.lock().unwrap();
+
+        if success {
+            state.consecutive_errors = 0;
+            return;
+        }
+
+        state.consecutive_errors += 1;
+
+        if state.consecutive_errors >= self.throttle.politeness.max_consecutive_errors {
+            let pause = self.throttle.politeness.pause;
+            tracing::warn!(
+                host = %self.host,
+                errors = state.consecutive_errors,
+                ?pause,
+                "The host keeps returning errors, pausing requests",
+            );
+            state.paused_until = Some(Instant::now() + pause);
+            state.consecutive_errors = 0;
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test(start_paused = true)]
+    async fn requests_are_spaced_out() {
+        let throttle = Throttle::new(Politeness {
+            max_requests_per_second: 2.0,
+            ..Default::default()
+        });
+
+        let delays: Vec<_> = (0..3).map(|_| throttle.reserve_slot()).collect();
+
+        assert_eq!(
+            delays,
+            [
+                Duration::ZERO,
+                Duration::from_millis(500),
+                Duration::from_millis(1000)
+            ]
+        );
+    }
+
+    #[tokio::test(start_paused = true)]
+    async fn repeated_errors_pause_the_host() {
+        let throttle = Arc::new(Throttle::new(Politeness {
+            max_requests_per_second: 0.0,
+            max_consecutive_errors: 2,
+            pause: Duration::from_secs(30),
+            ..Default::default()
+        }));
+
+        let permit = Arc::clone(&throttle).acquire(String::new()).await;
+        permit.record(false);
+        permit.record(true);
+        permit.record(false);
+        drop(permit);
+        assert_eq!(throttle.reserve_slot(), Duration::ZERO);
+
+        let permit = Arc::clone(&throttle).acquire(String::new()).await;
+        permit.record(false);
+        drop(permit);
+        assert_eq!(throttle.reserve_slot(), Duration::from_secs(30));
+
+        tokio::time::advance(Duration::from_secs(30)).await;
+        assert_eq!(throttle.reserve_slot(), Duration::ZERO);
+    }
+}
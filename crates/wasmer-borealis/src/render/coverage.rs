@@ -0,0 +1,347 @@
+use std::{collections::BTreeMap, io::Write};
+
+use anyhow::Error;
+use indexmap::IndexMap;
+
+use crate::{
+    config::Toolchain,
+    experiment::{Category, Outcome, Results},
+    registry::queries::Package,
+};
+
+/// How much of the registry a set of experiments has covered.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Coverage {
+    /// Each namespace on the registry, with the biggest gaps in coverage
+    /// first.
+    pub namespaces: Vec<NamespaceCoverage>,
+    /// The packages tested with each toolchain, including toolchains which
+    /// haven't been tested at all.
+    pub toolchains: BTreeMap<Toolchain, ToolchainCoverage>,
+}
+
+/// How many of a namespace's packages have been tested.
+#[derive(Debug, Clone, PartialEq)]
+pub struct NamespaceCoverage {
+    pub namespace: String,
+    /// The number of packages in this namespace on the registry.
+    pub packages: usize,
+    /// Packages which weren't part of any experiment.
+    pub untested: Vec<String>,
+}
+
+impl NamespaceCoverage {
+    pub fn tested(&self) -> usize {
+        self.packages - self.untested.len()
+    }
+}
+
+/// The packages built with a particular toolchain that have been tested.
+#[derive(Debug, Default, Copy, Clone, PartialEq, Eq)]
+pub struct ToolchainCoverage {
+    pub tested: usize,
+    /// Packages where every test case was a success.
+    pub passing: usize,
+}
+
+impl Coverage {
+    /// Compare the packages on the registry with the packages tested by
+    /// several experiments.
+    ///
+    /// A package counts as tested if any of its versions were run, so test
+    /// cases which couldn't be downloaded or set up don't count. The
+    /// registry doesn't know which toolchain a package was built with, so
+    /// toolchains only cover the packages that were tested.
+    pub fn new(packages: &[Package], results: &[Results]) -> Self {
+        // The toolchain and whether every test case passed, for each package
+        let mut tested: IndexMap<&str, (Option<Toolchain>, bool)> = IndexMap::new();
+
+        let reports = results.iter().flat_map(|r| &r.reports);
+        for report in reports.filter(|r| was_run(&r.outcome)) {
+            let (toolchain, passing) = tested
+                .entry(report.display_name.as_str())
+                .or_insert((None, true));
+            *toolchain = report.toolchain.or(*toolchain);
+            *passing &= report.outcome.category() == Category::Success;
+        }
+
+        let mut namespaces: IndexMap<&str, NamespaceCoverage> = IndexMap::new();
+        for pkg in packages {
+            let namespace =
+                namespaces
+                    .entry(pkg.namespace.as_str())
+                    .or_insert_with(|| NamespaceCoverage {
+                        namespace: pkg.namespace.clone(),
+                        packages: 0,
+                        untested: Vec::new(),
+                    });
+            namespace.packages += 1;
+            if !tested.contains_key(pkg.display_name.as_str()) {
+                namespace.untested.push(pkg.display_name.clone());
+            }
+        }
+
+        let mut namespaces: Vec<_> = namespaces.into_values().collect();
+        for namespace in &mut namespaces {
+            namespace.untested.sort();
+        }
+        // Least covered first, then the ones with the most untested packages
+        namespaces.sort_by(|a, b| {
+            let ratio = |n: &NamespaceCoverage| n.tested() as f64 / n.packages as f64;
+            ratio(a)
+                .total_cmp(&ratio(b))
+                .then_with(|| b.untested.len().cmp(&a.untested.len()))
+                .then_with(|| a.namespace.cmp(&b.namespace))
+        });
+
+        let mut toolchains: BTreeMap<Toolchain, ToolchainCoverage> = Toolchain::ALL
+            .iter()
+            .map(|&toolchain| (toolchain, ToolchainCoverage::default()))
+            .collect();
+        for (toolchain, passing) in tested.values() {
+            if let Some(toolchain) = toolchain {
+                let coverage = toolchains.entry(*toolchain).or_default();
+                coverage.tested += 1;
+                if *passing {
+                    coverage.passing += 1;
+                }
+            }
+        }
+
+        Coverage {
+            namespaces,
+            toolchains,
+        }
+    }
+}
+
+/// Did the `wasmer` CLI actually get a chance to run the package?
+fn was_run(outcome: &Outcome) -> bool {
+    match outcome {
+        Outcome::Completed { .. }
+        | Outcome::TimedOut { .. }
+        | Outcome::LimitExceeded { .. }
+        | Outcome::ClassificationFailed { .. } => true,
+        Outcome::FetchFailed { .. }
+        | Outcome::CorruptArtifact { .. }
+        | Outcome::SetupFailed { .. }
+        | Outcome::SpawnFailed { .. } => false,
+    }
+}
+
+/// Print a summary of which parts of the registry have (and haven't) been
+/// covered by experiments.
+pub fn coverage(coverage: &Coverage, mut dest: impl Write) -> Result<(), Error> {
+    let Coverage {
+        namespaces,
+        toolchains,
+    } = coverage;
+
+    let packages: usize = namespaces.iter().map(|n| n.packages).sum();
+    let tested: usize = namespaces.iter().map(|n| n.tested()).sum();
+    writeln!(
+        dest,
+        "Packages... {tested}/{packages} tested ({:.0}%)",
+        percent(tested, packages)
+    )?;
+
+    let untested: Vec<_> = namespaces
+        .iter()
+        .filter(|n| n.tested() == 0)
+        .map(|n| n.namespace.as_str())
+        .collect();
+    writeln!(
+        dest,
+        "Namespaces... {}/{} tested",
+        namespaces.len() - untested.len(),
+        namespaces.len()
+    )?;
+    if !untested.is_empty() {
+        writeln!(dest, "Untested namespaces... {}", untested.join(", "))?;
+    }
+
+    let untested_toolchains: Vec<_> = toolchains
+        .iter()
+        .filter(|(toolchain, c)| c.tested == 0 && **toolchain != Toolchain::Unknown)
+        .map(|(toolchain, _)| toolchain.as_str())
+        .collect();
+    if !untested_toolchains.is_empty() {
+        writeln!(
+            dest,
+            "Untested toolchains... {}",
+            untested_toolchains.join(", ")
+        )?;
+    }
+
+    writeln!(dest)?;
+    writeln!(dest, "Namespaces:")?;
+    for namespace in namespaces.iter().filter(|n| !n.untested.is_empty()) {
+        writeln!(
+            dest,
+            "  {}: {}/{} tested ({:.0}%), untested: {}",
+            namespace.namespace,
+            namespace.tested(),
+            namespace.packages,
+            percent(namespace.tested(), namespace.packages),
+            namespace.untested.join(", "),
+        )?;
+    }
+
+    writeln!(dest)?;
+    writeln!(dest, "Toolchains:")?;
+    for (toolchain, c) in toolchains.iter().filter(|(_, c)| c.tested > 0) {
+        writeln!(
+            dest,
+            "  {toolchain}: {} tested, {} passing",
+            c.tested, c.passing
+        )?;
+    }
+
+    Ok(())
+}
+
+fn percent(count: usize, total: usize) -> f64 {
+    if total == 0 {
+        0.0
+    } else {
+        count as f64 * 100.0 / total as f64
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use serde_json::{json, Value};
+
+    use super::*;
+
+    fn package(display_name: &str) -> Package {
+        let (namespace, package_name) = display_name.split_once('/').unwrap();
+        Package {
+            id: cynic::Id::new(display_name),
+            package_name: package_name.to_string(),
+            namespace: namespace.to_string(),
+            display_name: display_name.to_string(),
+            last_version: None,
+            versions: Vec::new(),
+        }
+    }
+
+    fn report(display_name: &str, toolchain: &str, outcome: Value) -> Value {
+        json!({
+            "display_name": display_name,
+            "package_version": {
+                "id": display_name,
+                "version": "1.0.0",
+                "distribution": {
+                    "downloadUrl": "https://example.com/package.tar.gz",
+                    "piritaDownloadUrl": null,
+                },
+                "description": null,
+                "repository": null,
+                "homepage": null,
+            },
+            "toolchain": toolchain,
+            "outcome": outcome,
+        })
+    }
+
+    fn completed(code: i32) -> Value {
+        json!({
+            "outcome": "completed",
+            "status": { "success": code == 0, "code": code },
+            "run_time": { "secs": 1, "nanos": 0 },
+            "base_dir": "/tmp/experiment",
+        })
+    }
+
+    fn results(reports: Vec<Value>) -> Results {
+        serde_json::from_value(json!({
+            "experiment": { "package": "wasmer/runner" },
+            "reports": reports,
+            "total_time": { "secs": 1, "nanos": 0 },
+            "experiment_dir": "/tmp/experiment",
+        }))
+        .unwrap()
+    }
+
+    #[test]
+    fn least_covered_namespaces_come_first() {
+        let packages = [
+            package("wasmer/python"),
+            package("wasmer/qjs"),
+            package("syrusakbary/cowsay"),
+        ];
+        let results = [results(vec![report("wasmer/python", "c", completed(0))])];
+
+        let coverage = Coverage::new(&packages, &results);
+
+        assert_eq!(
+            coverage.namespaces,
+            [
+                NamespaceCoverage {
+                    namespace: "syrusakbary".to_string(),
+                    packages: 1,
+                    untested: vec!["syrusakbary/cowsay".to_string()],
+                },
+                NamespaceCoverage {
+                    namespace: "wasmer".to_string(),
+                    packages: 2,
+                    untested: vec!["wasmer/qjs".to_string()],
+                },
+            ]
+        );
+    }
+
+    #[test]
+    fn packages_only_pass_if_every_test_case_passed() {
+        let packages = [package("wasmer/python"), package("wasmer/qjs")];
+        // The same packages, tested by two experiments
+        let results = [
+            results(vec![
+                report("wasmer/python", "c", completed(0)),
+                report("wasmer/qjs", "c", completed(0)),
+            ]),
+            results(vec![report("wasmer/qjs", "c", completed(1))]),
+        ];
+
+        let coverage = Coverage::new(&packages, &results);
+
+        assert_eq!(
+            coverage.toolchains[&Toolchain::C],
+            ToolchainCoverage {
+                tested: 2,
+                passing: 1,
+            }
+        );
+        assert_eq!(
+            coverage.toolchains[&Toolchain::Rust],
+            ToolchainCoverage::default()
+        );
+    }
+
+    #[test]
+    fn packages_which_never_ran_are_untested() {
+        let packages = [package("wasmer/python")];
+        let error = json!({ "error": "Oops", "detailed_error": "Oops", "causes": [] });
+        let results = [results(vec![
+            report(
+                "wasmer/python",
+                "c",
+                json!({ "outcome": "fetch-failed", "error": error }),
+            ),
+            report(
+                "wasmer/python",
+                "c",
+                json!({ "outcome": "setup-failed", "base_dir": "/tmp/experiment", "error": error }),
+            ),
+        ])];
+
+        let coverage = Coverage::new(&packages, &results);
+
+        assert_eq!(coverage.namespaces[0].untested, ["wasmer/python"]);
+        assert_eq!(
+            coverage.toolchains[&Toolchain::C],
+            ToolchainCoverage::default()
+        );
+    }
+}
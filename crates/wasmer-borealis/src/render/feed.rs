@@ -0,0 +1,174 @@
+use std::{collections::HashSet, io::Write, time::SystemTime};
+
+use anyhow::Error;
+use indexmap::IndexMap;
+
+use crate::experiment::{Category, Results};
+
+/// Something notable that happened between one experiment and the next.
+#[derive(Debug, Clone, PartialEq)]
+pub enum Event {
+    /// A namespace with packages that haven't been seen before.
+    NewNamespace { namespace: String },
+    /// The first time one of a package's versions was published as a webc.
+    FirstWebc { package: String, version: String },
+    /// A package which used to pass no longer does.
+    StartedFailing {
+        package: String,
+        version: String,
+        category: Category,
+    },
+}
+
+impl Event {
+    fn title(&self) -> String {
+        match self {
+            Event::NewNamespace { namespace } => format!("New namespace: {namespace}"),
+            Event::FirstWebc { package, version } => {
+                format!("{package}@{version} is the first version published as a webc")
+            }
+            Event::StartedFailing {
+                package,
+                version,
+                category: Category::Bug,
+            } => format!("{package}@{version} started hitting bugs"),
+            Event::StartedFailing {
+                package, version, ..
+            } => format!("{package}@{version} started failing"),
+        }
+    }
+
+    fn path(&self) -> &str {
+        match self {
+            Event::NewNamespace { namespace } => namespace,
+            Event::FirstWebc { package, .. } | Event::StartedFailing { package, .. } => package,
+        }
+    }
+}
+
+/// Find notable [`Event`]s across several runs of an experiment, oldest
+/// first.
+///
+/// Each event is paired with the index of the run it was found in. The first
+/// run is treated as a baseline, so it never generates any events.
+pub fn events<'a>(results: impl IntoIterator<Item = &'a Results>) -> Vec<(usize, Event)> {
+    let mut events = Vec::new();
+    let mut namespaces = HashSet::new();
+    let mut has_webc = HashSet::new();
+    let mut last_category: IndexMap<&str, Category> = IndexMap::new();
+
+    for (i, r) in results.into_iter().enumerate() {
+        let baseline = i == 0;
+        let mut seen = HashSet::new();
+
+        for report in &r.reports {
+            let package = report.display_name.as_str();
+            let version = &report.package_version.version;
+            let namespace = package.split_once('/').map_or(package, |(ns, _)| ns);
+
+            if namespaces.insert(namespace) && !baseline {
+                events.push((
+                    i,
+                    Event::NewNamespace {
+                        namespace: namespace.to_string(),
+                    },
+                ));
+            }
+
+            let webc = report
+                .package_version
+                .distribution
+                .pirita_download_url
+                .is_some();
+            if webc && has_webc.insert(package) && !baseline {
+                events.push((
+                    i,
+                    Event::FirstWebc {
+                        package: package.to_string(),
+                        version: version.clone(),
+                    },
+                ));
+            }
+
+            // Reports are sorted newest first, so only compare each package's
+            // latest version
+            if !seen.insert(package) {
+                continue;
+            }
+
+            let category = report.outcome.category();
+            let previous = last_category.insert(package, category);
+            if previous == Some(Category::Success) && category != Category::Success {
+                events.push((
+                    i,
+                    Event::StartedFailing {
+                        package: package.to_string(),
+                        version: version.clone(),
+                        category,
+                    },
+                ));
+            }
+        }
+    }
+
+    events
+}
+
+/// Write an RSS feed of the [`Event`]s across several runs of an
+/// experiment, where each run is paired with the time it finished.
+///
+/// Links point to each package or namespace on `registry` (e.g.
+/// `https://wasmer.io/`).
+pub fn rss(
+    results: &[(SystemTime, Results)],
+    registry: &str,
+    mut dest: impl Write,
+) -> Result<(), Error> {
+    let registry = registry.trim_end_matches('/');
+    let events = events(results.iter().map(|(_, r)| r));
+    let timestamps: Vec<SystemTime> = results.iter().map(|(t, _)| *t).collect();
+
+    writeln!(dest, r#"<?xml version="1.0" encoding="UTF-8"?>"#)?;
+    writeln!(dest, r#"<rss version="2.0">"#)?;
+    writeln!(dest, "<channel>")?;
+    writeln!(dest, "<title>Wasmer Borealis</title>")?;
+    writeln!(dest, "<link>{}</link>", escape(registry))?;
+    writeln!(
+        dest,
+        "<description>Notable changes to the packages on {}</description>",
+        escape(registry)
+    )?;
+    if let Some(latest) = timestamps.iter().max() {
+        writeln!(
+            dest,
+            "<lastBuildDate>{}</lastBuildDate>",
+            httpdate::fmt_http_date(*latest)
+        )?;
+    }
+
+    // Newest first
+    for (i, event) in events.iter().rev() {
+        let title = escape(&event.title());
+        let link = escape(&format!("{registry}/{}", event.path()));
+        let date = httpdate::fmt_http_date(timestamps[*i]);
+
+        writeln!(dest, "<item>")?;
+        writeln!(dest, "<title>{title}</title>")?;
+        writeln!(dest, "<link>{link}</link>")?;
+        writeln!(dest, r#"<guid isPermaLink="false">{title} ({date})</guid>"#)?;
+        writeln!(dest, "<pubDate>{date}</pubDate>")?;
+        writeln!(dest, "</item>")?;
+    }
+
+    writeln!(dest, "</channel>")?;
+    writeln!(dest, "</rss>")?;
+
+    Ok(())
+}
+
+fn escape(s: &str) -> String {
+    s.replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+        .replace('"', "&quot;")
+}
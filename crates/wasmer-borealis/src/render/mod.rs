@@ -1,15 +1,29 @@
-use std::io::Write;
+mod coverage;
+mod feed;
+
+use std::{collections::BTreeMap, io::Write};
 
 use anyhow::Error;
+use indexmap::IndexMap;
 use once_cell::sync::Lazy;
 
-use crate::experiment::{Report, Results};
+pub use self::{
+    coverage::{coverage, Coverage, NamespaceCoverage, ToolchainCoverage},
+    feed::{events, rss, Event},
+};
+use crate::{
+    config::Toolchain,
+    experiment::{Category, Report, Results},
+};
 
 static TEMPLATES: Lazy<minijinja::Environment<'static>> = Lazy::new(|| {
     let mut env = minijinja::Environment::new();
-    env.add_template("report", include_str!("report.html.jinja"))
+    // Note: the ".html" extension turns on auto-escaping, which matters
+    // because package metadata and triage notes can't be trusted
+    env.add_template("report.html", include_str!("report.html.jinja"))
         .unwrap();
     env.add_filter("file_url", file_url);
+    env.add_test("web_url", is_web_url);
     env
 });
 
@@ -19,13 +33,65 @@ fn file_url(path: String) -> String {
         .unwrap_or(path)
 }
 
+/// Is this a `http://` or `https://` URL that is safe to link to?
+fn is_web_url(value: String) -> bool {
+    url::Url::parse(&value).is_ok_and(|u| matches!(u.scheme(), "http" | "https"))
+}
+
 #[tracing::instrument(skip_all)]
 pub fn html(results: &Results) -> Result<String, Error> {
+    render_html(results, None)
+}
+
+/// Render a HTML report which doesn't depend on any other files, embedding
+/// each test case's stdout and stderr (truncated to `max_log_size` bytes).
+///
+/// This is useful when the report will be viewed on another machine (e.g.
+/// uploaded as a CI artifact).
+#[tracing::instrument(skip_all)]
+pub fn standalone_html(results: &Results, max_log_size: usize) -> Result<String, Error> {
+    let mut logs = IndexMap::new();
+
+    for report in &results.reports {
+        let Some(base_dir) = report.outcome.base_dir() else {
+            continue;
+        };
+        let mut files = IndexMap::new();
+
+        for name in ["stdout", "stderr"] {
+            let path = base_dir.join(name).with_extension("txt");
+            if let Ok(contents) = std::fs::read(&path) {
+                files.insert(name, truncate(&contents, max_log_size));
+            }
+        }
+
+        logs.insert(
+            format!("{}@{}", report.display_name, report.package_version.version),
+            files,
+        );
+    }
+
+    render_html(results, Some(logs))
+}
+
+fn render_html(
+    results: &Results,
+    logs: Option<IndexMap<String, IndexMap<&str, String>>>,
+) -> Result<String, Error> {
     let Results {
+        schema_version: _,
         experiment,
         reports,
         total_time,
+        finished_at: _,
         experiment_dir,
+        cache,
+        registry: _,
+        wasmer,
+        matrix,
+        host,
+        shuffle_seed: _,
+        cancelled,
     } = results;
 
     let ctx = minijinja::context! {
@@ -33,12 +99,31 @@ pub fn html(results: &Results) -> Result<String, Error> {
         reports => ReportCategories::new(reports),
         total_time => format!("{total_time:.1?}"),
         experiment_dir,
+        cache,
+        wasmer,
+        matrix,
+        host,
+        cancelled,
+        logs,
     };
 
-    let rendered = TEMPLATES.get_template("report")?.render(ctx)?;
+    let rendered = TEMPLATES.get_template("report.html")?.render(ctx)?;
     Ok(rendered)
 }
 
+fn truncate(contents: &[u8], max_size: usize) -> String {
+    if contents.len() <= max_size {
+        return String::from_utf8_lossy(contents).into_owned();
+    }
+
+    let mut truncated = String::from_utf8_lossy(&contents[..max_size]).into_owned();
+    truncated.push_str(&format!(
+        "\n... ({} bytes truncated)",
+        contents.len() - max_size
+    ));
+    truncated
+}
+
 #[derive(Debug, serde::Serialize)]
 struct ReportCategories<'a> {
     bugs: Vec<&'a Report>,
@@ -55,14 +140,10 @@ impl<'a> ReportCategories<'a> {
         let mut failures = Vec::new();
 
         for report in reports {
-            match &report.outcome {
-                crate::experiment::Outcome::Completed { status, .. } if status.success => {
-                    success.push(report);
-                }
-                crate::experiment::Outcome::Completed { .. } => failures.push(report),
-                crate::experiment::Outcome::FetchFailed { .. }
-                | crate::experiment::Outcome::SetupFailed { .. }
-                | crate::experiment::Outcome::SpawnFailed { .. } => bugs.push(report),
+            match report.outcome.category() {
+                Category::Success => success.push(report),
+                Category::Failure => failures.push(report),
+                Category::Bug => bugs.push(report),
             }
         }
 
@@ -91,11 +172,58 @@ impl<'a> ReportCategories<'a> {
     }
 }
 
+/// Render a shields.io-style SVG badge showing an experiment's pass rate.
+pub fn badge(results: &Results) -> String {
+    let total = results.reports.len();
+    let passed = results
+        .reports
+        .iter()
+        .filter(|r| r.outcome.category() == Category::Success)
+        .count();
+
+    let (message, colour) = if total == 0 {
+        ("no packages".to_string(), "#9f9f9f")
+    } else {
+        let rate = passed as f64 / total as f64;
+        let colour = match rate {
+            r if r >= 0.9 => "#4c1",
+            r if r >= 0.5 => "#dfb317",
+            _ => "#e05d44",
+        };
+        (format!("{:.0}% ({passed}/{total})", rate * 100.0), colour)
+    };
+
+    let label = "borealis";
+    // Roughly 7px per character at 11px Verdana, plus padding
+    let label_width = label.len() * 7 + 10;
+    let message_width = message.len() * 7 + 10;
+    let width = label_width + message_width;
+    let label_x = label_width / 2;
+    let message_x = label_width + message_width / 2;
+
+    format!(
+        r##"<svg xmlns="http://www.w3.org/2000/svg" width="{width}" height="20" role="img" aria-label="{label}: {message}">
+  <title>{label}: {message}</title>
+  <rect width="{label_width}" height="20" fill="#555"/>
+  <rect x="{label_width}" width="{message_width}" height="20" fill="{colour}"/>
+  <g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+    <text x="{label_x}" y="14">{label}</text>
+    <text x="{message_x}" y="14">{message}</text>
+  </g>
+</svg>
+"##
+    )
+}
+
 pub fn text(results: &Results, mut dest: impl Write) -> Result<(), Error> {
     let Results {
         experiment: _,
         reports,
         total_time,
+        cache,
+        wasmer,
+        matrix,
+        cancelled,
         ..
     } = results;
 
@@ -104,16 +232,245 @@ pub fn text(results: &Results, mut dest: impl Write) -> Result<(), Error> {
     let mut bugs = 0;
 
     for report in reports {
-        match &report.outcome {
-            crate::experiment::Outcome::Completed { status, .. } if status.success => success += 1,
-            crate::experiment::Outcome::Completed { .. } => failures += 1,
-            crate::experiment::Outcome::FetchFailed { .. }
-            | crate::experiment::Outcome::SetupFailed { .. }
-            | crate::experiment::Outcome::SpawnFailed { .. } => bugs += 1,
+        match report.outcome.category() {
+            Category::Success => success += 1,
+            Category::Failure => failures += 1,
+            Category::Bug => bugs += 1,
         }
     }
 
     writeln!(dest, "Experiment result... success: {success}, failures: {failures}, bugs: {bugs}. Finished in {total_time:?}")?;
 
+    // (passed, total) for each toolchain
+    let mut toolchains: BTreeMap<Toolchain, (usize, usize)> = BTreeMap::new();
+    for report in reports {
+        if let Some(toolchain) = report.toolchain {
+            let (passed, total) = toolchains.entry(toolchain).or_default();
+            if report.outcome.category() == Category::Success {
+                *passed += 1;
+            }
+            *total += 1;
+        }
+    }
+    if !toolchains.is_empty() {
+        let summary: Vec<_> = toolchains
+            .iter()
+            .map(|(toolchain, (passed, total))| format!("{toolchain}: {passed}/{total} passed"))
+            .collect();
+        writeln!(dest, "Toolchains... {}", summary.join(", "))?;
+    }
+
+    if *cancelled {
+        writeln!(
+            dest,
+            "Cancelled... only {} test cases were run",
+            reports.len()
+        )?;
+    }
+
+    if let Some(wasmer) = wasmer {
+        writeln!(dest, "Wasmer... {}", wasmer.version)?;
+    }
+
+    for (label, build) in matrix {
+        writeln!(dest, "Wasmer ({label})... {}", build.version)?;
+    }
+
+    if let Some(hit_rate) = cache.hit_rate() {
+        writeln!(
+            dest,
+            "Cache... hits: {}, misses: {} ({:.0}% hit rate), {} bytes downloaded",
+            cache.hits,
+            cache.misses,
+            hit_rate * 100.0,
+            cache.bytes_downloaded,
+        )?;
+    }
+
     Ok(())
 }
+
+/// The [`Category`] each package version fell into across several
+/// experiments (e.g. the same experiment run with different `wasmer`
+/// versions).
+///
+/// Experiments which were run with a `wasmer.matrix` get a column for each
+/// `wasmer` CLI in the matrix.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Matrix {
+    /// A label for each experiment.
+    pub columns: Vec<String>,
+    /// The category for each `(package, version)`, with one entry per column.
+    /// An entry will be `None` if the package version wasn't part of that
+    /// experiment.
+    pub rows: IndexMap<(String, String), Vec<Option<Category>>>,
+}
+
+impl Matrix {
+    pub fn new(results: &[Results]) -> Self {
+        let mut columns = Vec::new();
+        // The index of each experiment's first column
+        let mut offsets = Vec::new();
+
+        for (i, r) in results.iter().enumerate() {
+            offsets.push(columns.len());
+
+            if r.experiment.wasmer.matrix.is_empty() {
+                columns.push(match &r.wasmer {
+                    Some(build) => build.version.clone(),
+                    None => format!("#{}", i + 1),
+                });
+            } else {
+                columns.extend(r.experiment.wasmer.matrix.iter().map(|version| {
+                    let label = version.to_string();
+                    match r.matrix.get(&label) {
+                        Some(build) => build.version.clone(),
+                        None => label,
+                    }
+                }));
+            }
+        }
+
+        let mut rows: IndexMap<(String, String), Vec<Option<Category>>> = IndexMap::new();
+
+        for (r, offset) in results.iter().zip(offsets) {
+            for report in &r.reports {
+                let key = (
+                    report.display_name.clone(),
+                    report.package_version.version.clone(),
+                );
+                let column = offset
+                    + report
+                        .wasmer
+                        .as_ref()
+                        .and_then(|w| {
+                            r.experiment
+                                .wasmer
+                                .matrix
+                                .iter()
+                                .position(|v| v.to_string() == *w)
+                        })
+                        .unwrap_or_default();
+                let row = rows.entry(key).or_insert_with(|| vec![None; columns.len()]);
+                row[column] = Some(report.outcome.category());
+            }
+        }
+
+        rows.sort_keys();
+
+        Matrix { columns, rows }
+    }
+}
+
+pub fn matrix(results: &[Results], mut dest: impl Write) -> Result<(), Error> {
+    let Matrix { columns, rows } = Matrix::new(results);
+
+    let name_width = rows
+        .keys()
+        .map(|(name, version)| name.len() + version.len() + 1)
+        .chain(std::iter::once("package".len()))
+        .max()
+        .unwrap_or_default();
+
+    write!(dest, "{:name_width$}", "package")?;
+    for column in &columns {
+        write!(dest, "  {column}")?;
+    }
+    writeln!(dest)?;
+
+    for ((name, version), categories) in &rows {
+        write!(dest, "{:name_width$}", format!("{name}@{version}"))?;
+
+        for (column, category) in columns.iter().zip(categories) {
+            let symbol = match category {
+                Some(Category::Success) => "✔",
+                Some(Category::Failure) => "❌",
+                Some(Category::Bug) => "🐛",
+                None => "-",
+            };
+            write!(dest, "  {symbol:width$}", width = column.chars().count())?;
+        }
+
+        writeln!(dest)?;
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use serde_json::{json, Value};
+
+    use super::*;
+
+    /// The JSON for a [`Report`] whose test case exited successfully.
+    fn report(package_version: Value) -> Value {
+        json!({
+            "display_name": "wasmer/evil",
+            "package_version": package_version,
+            "outcome": {
+                "outcome": "completed",
+                "status": { "success": true, "code": 0 },
+                "run_time": { "secs": 1, "nanos": 0 },
+                "base_dir": "/tmp/experiment/wasmer/evil/1.0.0",
+            },
+        })
+    }
+
+    fn results(reports: Vec<Value>) -> Results {
+        serde_json::from_value(json!({
+            "experiment": { "package": "wasmer/runner" },
+            "reports": reports,
+            "total_time": { "secs": 1, "nanos": 0 },
+            "experiment_dir": "/tmp/experiment",
+        }))
+        .unwrap()
+    }
+
+    #[test]
+    fn package_metadata_is_escaped() {
+        let results = results(vec![report(json!({
+            "id": "evil@1.0.0",
+            "version": "1.0.0",
+            "distribution": {
+                "downloadUrl": "https://example.com/evil.tar.gz",
+                "piritaDownloadUrl": null,
+            },
+            "description": "<script>alert('description')</script>",
+            "repository": "javascript:alert(1)",
+            "homepage": "https://example.com/\"><script>alert('homepage')</script>",
+        }))]);
+
+        let rendered = html(&results).unwrap();
+
+        assert!(!rendered.contains("<script>alert"));
+        assert!(rendered.contains("&lt;script&gt;alert"));
+        assert!(!rendered.contains("href=\"javascript:"));
+    }
+
+    #[test]
+    fn triage_notes_are_escaped() {
+        let mut report = report(json!({
+            "id": "evil@1.0.0",
+            "version": "1.0.0",
+            "distribution": {
+                "downloadUrl": "https://example.com/evil.tar.gz",
+                "piritaDownloadUrl": null,
+            },
+            "description": null,
+            "repository": null,
+            "homepage": null,
+        }));
+        report["triage"] = json!({
+            "state": "bug-filed",
+            "assignee": "<img src=x onerror=alert('assignee')>",
+            "note": "<script>alert('note')</script>",
+        });
+
+        let rendered = html(&results(vec![report])).unwrap();
+
+        assert!(!rendered.contains("<img src=x"));
+        assert!(!rendered.contains("<script>alert"));
+        assert!(rendered.contains("&lt;script&gt;alert"));
+    }
+}
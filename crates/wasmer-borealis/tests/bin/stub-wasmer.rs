@@ -0,0 +1,107 @@
+//! A fake `wasmer` CLI used by the integration tests.
+//!
+//! `wasmer --version` prints a fake version, and `wasmer run <package> ... --
+//! <args>` treats each of the package's arguments as a directive:
+//!
+//! - `stdout=TEXT` and `stderr=TEXT` print a line
+//! - `fill-stdout=BYTES` writes that many bytes to stdout
+//! - `print-env` prints every environment variable as `NAME=value`
+//! - `print-guest-env` prints every `--env=NAME=value` flag it was given,
+//!   reading the value from its own environment for a bare `--env=NAME`
+//! - `print-args` prints every argument it was given
+//! - `sleep=MILLISECONDS` sleeps
+//! - `busy-loop` uses as much CPU as it can, forever
+//! - `exit=CODE` exits immediately
+//! - `fail-if-equal=A=B` exits with `1` if `A` and `B` are the same
+//! - `abort` kills the process (with `SIGABRT` on Unix)
+
+use std::{io::Write, process::ExitCode, time::Duration};
+
+fn main() -> ExitCode {
+    let args: Vec<String> = std::env::args().skip(1).collect();
+
+    match args.first().map(String::as_str) {
+        Some("--version") => {
+            println!("wasmer 0.0.0-stub");
+            println!("binary: stub-wasmer");
+            ExitCode::SUCCESS
+        }
+        Some("run") => run(&args[1..]),
+        _ => {
+            eprintln!("Unsupported arguments: {args:?}");
+            ExitCode::from(2)
+        }
+    }
+}
+
+fn run(args: &[String]) -> ExitCode {
+    let (flags, directives) = match args.iter().position(|arg| arg == "--") {
+        Some(index) => (&args[..index], &args[index + 1..]),
+        None => (args, &[][..]),
+    };
+
+    for directive in directives {
+        let (name, value) = directive
+            .split_once('=')
+            .unwrap_or((directive.as_str(), ""));
+
+        match name {
+            "stdout" => println!("{value}"),
+            "stderr" => eprintln!("{value}"),
+            "fill-stdout" => {
+                let bytes = value.parse().expect("Invalid byte count");
+                std::io::stdout()
+                    .lock()
+                    .write_all(&vec![b'x'; bytes])
+                    .unwrap();
+            }
+            "print-env" => {
+                let mut vars: Vec<_> = std::env::vars().collect();
+                vars.sort();
+                for (name, value) in vars {
+                    println!("{name}={value}");
+                }
+            }
+            "print-guest-env" => {
+                for var in flags.iter().filter_map(|f| f.strip_prefix("--env=")) {
+                    if var.contains('=') {
+                        println!("{var}");
+                    } else {
+                        let value = std::env::var(var).unwrap_or_default();
+                        println!("{var}={value}");
+                    }
+                }
+            }
+            "print-args" => {
+                for arg in std::env::args().skip(1) {
+                    println!("{arg}");
+                }
+            }
+            "sleep" => {
+                let ms = value.parse().expect("Invalid sleep duration");
+                std::thread::sleep(Duration::from_millis(ms));
+            }
+            "busy-loop" => loop {
+                std::hint::spin_loop();
+            },
+            "exit" => {
+                let code: u8 = value.parse().expect("Invalid exit code");
+                return ExitCode::from(code);
+            }
+            "fail-if-equal" => {
+                if let Some((a, b)) = value.split_once('=') {
+                    if a == b {
+                        return ExitCode::FAILURE;
+                    }
+                }
+            }
+            "abort" => std::process::abort(),
+            _ => {
+                eprintln!("Unknown directive: {directive}");
+                return ExitCode::from(2);
+            }
+        }
+    }
+
+    ExitCode::SUCCESS
+}
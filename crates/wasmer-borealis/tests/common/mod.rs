@@ -0,0 +1,129 @@
+//! Helpers shared by the integration tests.
+
+use std::{
+    net::{SocketAddr, TcpListener},
+    sync::Once,
+};
+
+use axum::{
+    extract::{Path as UrlPath, State},
+    routing::{get, post},
+    Json, Router,
+};
+use serde_json::{json, Value};
+
+/// Make sure the stub `wasmer` executable (see `tests/bin/stub-wasmer.rs`) is
+/// the first `wasmer` on `$PATH`.
+pub fn install_stub_wasmer() {
+    static INSTALL: Once = Once::new();
+
+    INSTALL.call_once(|| {
+        // Deliberately leaked so the stub outlives every test
+        let bin_dir = tempfile::tempdir().unwrap().into_path();
+        let wasmer = bin_dir.join(format!("wasmer{}", std::env::consts::EXE_SUFFIX));
+        std::fs::copy(stub_wasmer(), wasmer).unwrap();
+
+        let path = std::env::var_os("PATH").unwrap_or_default();
+        let path =
+            std::env::join_paths(std::iter::once(bin_dir).chain(std::env::split_paths(&path)))
+                .unwrap();
+        std::env::set_var("PATH", path);
+    });
+}
+
+/// The path to the stub `wasmer` executable.
+///
+/// The stub is only built when the `test-stub` feature is enabled.
+pub fn stub_wasmer() -> &'static str {
+    option_env!("CARGO_BIN_EXE_stub-wasmer").expect(
+        "The integration tests need the stub wasmer CLI (try `cargo test --features test-stub`)",
+    )
+}
+
+/// Start a HTTP server in the background which implements just enough of the
+/// registry's API for an experiment to run, returning its GraphQL endpoint.
+///
+/// Each package is published to the `fixtures` namespace with a single
+/// `1.0.0` version.
+pub fn start_fake_registry(packages: &'static [&'static str]) -> String {
+    let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+    listener.set_nonblocking(true).unwrap();
+    let addr = listener.local_addr().unwrap();
+
+    let app = Router::new()
+        .route("/graphql", post(graphql))
+        .route("/download/:name", get(download))
+        .with_state((addr, packages));
+
+    std::thread::spawn(move || {
+        tokio::runtime::Builder::new_current_thread()
+            .enable_all()
+            .build()
+            .unwrap()
+            .block_on(async move {
+                axum::Server::from_tcp(listener)
+                    .unwrap()
+                    .serve(app.into_make_service())
+                    .await
+                    .unwrap();
+            });
+    });
+
+    format!("http://{addr}/graphql")
+}
+
+async fn graphql(
+    State((addr, packages)): State<(SocketAddr, &'static [&'static str])>,
+    Json(body): Json<Value>,
+) -> Json<Value> {
+    let query = body["query"].as_str().unwrap_or_default();
+    let offset = body["variables"]["offset"].as_i64().unwrap_or_default();
+
+    if !query.contains("getNamespace") {
+        return Json(json!({ "errors": [{ "message": "Unsupported query" }] }));
+    }
+
+    let edges: Vec<_> = if body["variables"]["name"] == "fixtures" && offset == 0 {
+        packages
+            .iter()
+            .map(|name| json!({ "node": package(addr, name) }))
+            .collect()
+    } else {
+        Vec::new()
+    };
+
+    Json(json!({
+        "data": {
+            "getNamespace": {
+                "packages": { "edges": edges },
+            },
+        },
+    }))
+}
+
+fn package(addr: SocketAddr, name: &str) -> Value {
+    let version = json!({
+        "id": format!("{name}-1.0.0"),
+        "version": "1.0.0",
+        "distribution": {
+            "downloadUrl": format!("http://{addr}/download/{name}-1.0.0.tar.gz"),
+            "piritaDownloadUrl": null,
+        },
+        "description": format!("A package called {name}"),
+        "repository": null,
+        "homepage": null,
+    });
+
+    json!({
+        "id": name,
+        "packageName": name,
+        "namespace": "fixtures",
+        "displayName": format!("fixtures/{name}"),
+        "lastVersion": version,
+        "versions": [version],
+    })
+}
+
+async fn download(UrlPath(name): UrlPath<String>) -> Vec<u8> {
+    format!("Pretend this is {name}").into_bytes()
+}
@@ -0,0 +1,202 @@
+//! End-to-end tests which run experiments against a fake registry and a stub
+//! `wasmer` executable, so they don't need network access or a real Wasmer
+//! install.
+
+mod common;
+
+use serde_json::json;
+use wasmer_borealis::{
+    config::{Experiment, Toolchain},
+    experiment::{Category, ExperimentBuilder},
+};
+
+#[test]
+fn run_an_experiment_against_a_fake_registry() {
+    common::install_stub_wasmer();
+    let endpoint = common::start_fake_registry(&["passes", "fails"]);
+    let temp = tempfile::tempdir().unwrap();
+    let experiment_dir = temp.path().join("experiment");
+    let experiment: Experiment = serde_json::from_value(json!({
+        "package": "fixtures/runner",
+        "args": ["stdout=Running ${PKG_NAME}", "fail-if-equal=${PKG_NAME}=fails"],
+        "artifacts": "tarball",
+        "filters": {
+            "namespaces": ["fixtures"],
+        },
+    }))
+    .unwrap();
+
+    let results = ExperimentBuilder::new(experiment)
+        .with_endpoint(endpoint)
+        .unwrap()
+        .with_cache_dir(temp.path().join("cache"))
+        .with_experiment_dir(&experiment_dir)
+        .run()
+        .unwrap();
+
+    let outcomes: Vec<_> = results
+        .reports
+        .iter()
+        .map(|r| (r.display_name.as_str(), r.outcome.category()))
+        .collect();
+    assert_eq!(
+        outcomes,
+        [
+            ("fixtures/fails", Category::Failure),
+            ("fixtures/passes", Category::Success),
+        ]
+    );
+    assert_eq!(results.wasmer.unwrap().version, "wasmer 0.0.0-stub");
+    assert_eq!(results.cache.misses, 2);
+
+    let passes = &results.reports[1];
+    assert_eq!(
+        passes.package_version.description.as_deref(),
+        Some("A package called passes")
+    );
+    let stdout =
+        std::fs::read_to_string(passes.outcome.base_dir().unwrap().join("stdout.txt")).unwrap();
+    assert_eq!(stdout.trim(), "Running passes");
+
+    assert!(experiment_dir.join("results.json").exists());
+    assert!(experiment_dir.join("report.html").exists());
+    assert!(experiment_dir.join("badge.svg").exists());
+}
+
+#[test]
+fn dry_runs_list_test_cases_without_running_them() {
+    let endpoint = common::start_fake_registry(&["passes", "fails"]);
+    let temp = tempfile::tempdir().unwrap();
+    let experiment: Experiment = serde_json::from_value(json!({
+        "package": "fixtures/runner",
+        "artifacts": "tarball",
+        "filters": {
+            "namespaces": ["fixtures"],
+            "blacklist": ["fixtures/fails"],
+        },
+    }))
+    .unwrap();
+
+    let test_cases = ExperimentBuilder::new(experiment)
+        .with_endpoint(endpoint)
+        .unwrap()
+        .with_cache_dir(temp.path().join("cache"))
+        .with_experiment_dir(temp.path().join("experiment"))
+        .dry_run()
+        .unwrap();
+
+    let names: Vec<_> = test_cases
+        .iter()
+        .map(|t| format!("{}@{}", t.display_name(), t.version()))
+        .collect();
+    assert_eq!(names, ["fixtures/passes@1.0.0"]);
+    assert!(!temp.path().join("cache").exists());
+    assert!(!temp.path().join("experiment").exists());
+}
+
+#[test]
+fn dry_runs_fail_when_the_registry_is_unreachable() {
+    // Nothing will be listening on this port once the listener is dropped
+    let addr = std::net::TcpListener::bind("127.0.0.1:0")
+        .unwrap()
+        .local_addr()
+        .unwrap();
+    let experiment: Experiment = serde_json::from_value(json!({
+        "package": "fixtures/runner",
+        "filters": { "namespaces": ["fixtures"] },
+    }))
+    .unwrap();
+
+    let result = ExperimentBuilder::new(experiment)
+        .with_endpoint(format!("http://{addr}/graphql"))
+        .unwrap()
+        .dry_run();
+
+    assert!(result.is_err());
+}
+
+#[test]
+fn packages_built_with_other_toolchains_are_skipped() {
+    common::install_stub_wasmer();
+    let endpoint = common::start_fake_registry(&["example"]);
+    let temp = tempfile::tempdir().unwrap();
+
+    for (toolchain, expected) in [("rust", None), ("unknown", Some(Toolchain::Unknown))] {
+        let experiment: Experiment = serde_json::from_value(json!({
+            "package": "fixtures/runner",
+            "artifacts": "tarball",
+            "filters": {
+                "namespaces": ["fixtures"],
+                "toolchains": [toolchain],
+            },
+        }))
+        .unwrap();
+
+        let results = ExperimentBuilder::new(experiment)
+            .with_endpoint(&endpoint)
+            .unwrap()
+            .with_cache_dir(temp.path().join("cache"))
+            .with_experiment_dir(temp.path().join(toolchain))
+            .run()
+            .unwrap();
+
+        let toolchains: Vec<_> = results.reports.iter().map(|r| r.toolchain).collect();
+        assert_eq!(
+            toolchains,
+            expected.into_iter().map(Some).collect::<Vec<_>>()
+        );
+    }
+}
+
+#[test]
+fn each_package_is_run_with_every_wasmer_in_the_matrix() {
+    common::install_stub_wasmer();
+    let endpoint = common::start_fake_registry(&["example"]);
+    let temp = tempfile::tempdir().unwrap();
+    let matrix: Vec<String> = ["a", "b"]
+        .into_iter()
+        .map(|name| {
+            let dir = temp.path().join(name);
+            std::fs::create_dir_all(&dir).unwrap();
+            let wasmer = dir.join(format!("wasmer{}", std::env::consts::EXE_SUFFIX));
+            std::fs::copy(common::stub_wasmer(), &wasmer).unwrap();
+            wasmer.display().to_string()
+        })
+        .collect();
+    let experiment: Experiment = serde_json::from_value(json!({
+        "package": "fixtures/runner",
+        "artifacts": "tarball",
+        "filters": { "namespaces": ["fixtures"] },
+        "wasmer": { "args": [], "matrix": matrix },
+    }))
+    .unwrap();
+
+    let results = ExperimentBuilder::new(experiment)
+        .with_endpoint(&endpoint)
+        .unwrap()
+        .with_cache_dir(temp.path().join("cache"))
+        .with_experiment_dir(temp.path().join("experiment"))
+        .run()
+        .unwrap();
+
+    let runs: Vec<_> = results
+        .reports
+        .iter()
+        .map(|r| (r.display_name.as_str(), r.wasmer.clone()))
+        .collect();
+    assert_eq!(
+        runs,
+        [
+            ("fixtures/example", Some(matrix[0].clone())),
+            ("fixtures/example", Some(matrix[1].clone())),
+        ]
+    );
+    assert!(results
+        .reports
+        .iter()
+        .all(|r| r.outcome.category() == Category::Success));
+    assert_eq!(
+        results.matrix.keys().collect::<Vec<_>>(),
+        [&matrix[0], &matrix[1]]
+    );
+}
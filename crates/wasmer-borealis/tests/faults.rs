@@ -0,0 +1,66 @@
+//! Tests for fault injection.
+//!
+//! Faults apply to the whole process, so these live in their own test binary
+//! to avoid interfering with other tests.
+
+mod common;
+
+use std::time::Duration;
+
+use serde_json::json;
+use wasmer_borealis::{
+    config::Experiment,
+    experiment::{Category, ExperimentBuilder, Outcome},
+    registry::Faults,
+};
+
+#[test]
+fn failed_downloads_are_reported_as_bugs() {
+    common::install_stub_wasmer();
+    let endpoint = common::start_fake_registry(&["first", "second"]);
+    let temp = tempfile::tempdir().unwrap();
+    let experiment: Experiment = serde_json::from_value(json!({
+        "package": "fixtures/runner",
+        "args": ["stdout=Running ${PKG_NAME}"],
+        "artifacts": "tarball",
+        "filters": {
+            "namespaces": ["fixtures"],
+        },
+    }))
+    .unwrap();
+
+    let results = ExperimentBuilder::new(experiment.clone())
+        .with_endpoint(&endpoint)
+        .unwrap()
+        .with_cache_dir(temp.path().join("cache"))
+        .with_experiment_dir(temp.path().join("experiment"))
+        .with_faults(Faults {
+            download_failure_rate: 1.0,
+            delay: Duration::from_millis(10),
+        })
+        .run()
+        .unwrap();
+
+    assert_eq!(results.reports.len(), 2);
+    for report in &results.reports {
+        assert!(
+            matches!(report.outcome, Outcome::FetchFailed { .. }),
+            "{report:?}"
+        );
+        assert_eq!(report.outcome.category(), Category::Bug);
+    }
+    assert_eq!(results.cache.bytes_downloaded, 0);
+
+    // The faults should only apply to the experiment they were set for
+    let results = ExperimentBuilder::new(experiment)
+        .with_endpoint(&endpoint)
+        .unwrap()
+        .with_cache_dir(temp.path().join("cache-2"))
+        .with_experiment_dir(temp.path().join("experiment-2"))
+        .run()
+        .unwrap();
+
+    for report in &results.reports {
+        assert_eq!(report.outcome.category(), Category::Success, "{report:?}");
+    }
+}
@@ -0,0 +1,297 @@
+//! Contract tests for how the runner invokes the `wasmer` CLI and interprets
+//! what happens, using the stub in `tests/bin/stub-wasmer.rs`.
+
+mod common;
+
+use std::{
+    path::Path,
+    time::{Duration, Instant},
+};
+
+use serde_json::{json, Value};
+use tempfile::TempDir;
+use wasmer_borealis::{
+    config::Experiment,
+    experiment::{Category, ExperimentBuilder, Outcome, Report, Resource},
+};
+
+#[test]
+fn exit_codes_are_recorded() {
+    let (_temp, report) = run(json!({ "args": ["exit=42"] }));
+
+    match &report.outcome {
+        Outcome::Completed { status, .. } => {
+            assert!(!status.success);
+            assert_eq!(status.code, 42);
+        }
+        other => panic!("Unexpected outcome: {other:?}"),
+    }
+    assert_eq!(report.outcome.category(), Category::Failure);
+}
+
+#[test]
+fn output_is_captured() {
+    let (_temp, report) = run(json!({ "args": ["stdout=Hello", "stderr=World"] }));
+
+    assert_eq!(report.outcome.category(), Category::Success);
+    let base_dir = report.outcome.base_dir().unwrap();
+    assert_eq!(read(base_dir, "stdout.txt"), "Hello");
+    assert_eq!(read(base_dir, "stderr.txt"), "World");
+}
+
+#[test]
+fn only_whitelisted_host_variables_are_passed_through() {
+    std::env::set_var("BOREALIS_SHOULD_NOT_LEAK", "oops");
+    let (_temp, report) = run(json!({
+        "args": ["print-env"],
+        "wasmer": {
+            "args": [],
+            "env": { "RUST_LOG": "debug", "PACKAGE": "${PKG_NAMESPACE}/${PKG_NAME}" },
+        },
+    }));
+
+    let stdout = read(report.outcome.base_dir().unwrap(), "stdout.txt");
+    let names: Vec<_> = stdout
+        .lines()
+        .filter_map(|line| line.split_once('='))
+        .map(|(name, _)| name)
+        .collect();
+    assert!(names.contains(&"PATH"), "{stdout}");
+    assert!(!names.contains(&"BOREALIS_SHOULD_NOT_LEAK"), "{stdout}");
+    assert!(stdout.contains("RUST_LOG=debug"), "{stdout}");
+    assert!(stdout.contains("PACKAGE=fixtures/example"), "{stdout}");
+}
+
+#[test]
+fn guest_variables_are_passed_as_flags() {
+    let (_temp, report) = run(json!({
+        "args": ["print-guest-env"],
+        "env": { "GREETING": "Hello, ${PKG_NAME} v${PKG_VERSION}" },
+    }));
+
+    let stdout = read(report.outcome.base_dir().unwrap(), "stdout.txt");
+    assert_eq!(stdout, "GREETING=Hello, example v1.0.0");
+}
+
+#[test]
+fn secrets_are_not_passed_on_the_command_line() {
+    std::env::set_var("BOREALIS_TEST_SECRET", "hunter2");
+    let (_temp, report) = run(json!({
+        "args": ["print-guest-env", "print-args"],
+        "env": { "TOKEN": { "secret": "BOREALIS_TEST_SECRET" } },
+    }));
+
+    let stdout = read(report.outcome.base_dir().unwrap(), "stdout.txt");
+    let (guest_env, args) = stdout.split_once('\n').unwrap();
+    assert_eq!(guest_env, "TOKEN=hunter2");
+    assert!(!args.contains("hunter2"), "{args}");
+}
+
+#[test]
+fn abnormal_termination_is_a_failure() {
+    let (_temp, report) = run(json!({ "args": ["stdout=Before", "abort"] }));
+
+    match &report.outcome {
+        Outcome::Completed { status, .. } => assert!(!status.success),
+        other => panic!("Unexpected outcome: {other:?}"),
+    }
+    assert_eq!(report.outcome.category(), Category::Failure);
+    assert_eq!(
+        read(report.outcome.base_dir().unwrap(), "stdout.txt"),
+        "Before"
+    );
+}
+
+#[test]
+fn test_cases_which_take_too_long_are_killed() {
+    let (_temp, report) = run(json!({
+        "args": ["stdout=Sleeping", "sleep=60000", "stdout=Finished"],
+        "timeout": 60,
+        "overrides": { "fixtures/example": { "timeout": 1 } },
+    }));
+
+    match &report.outcome {
+        Outcome::TimedOut { timeout, .. } => assert_eq!(*timeout, Duration::from_secs(1)),
+        other => panic!("Unexpected outcome: {other:?}"),
+    }
+    assert_eq!(report.outcome.category(), Category::Failure);
+    assert_eq!(
+        read(report.outcome.base_dir().unwrap(), "stdout.txt"),
+        "Sleeping"
+    );
+}
+
+#[test]
+#[cfg(unix)]
+fn test_cases_which_use_too_much_cpu_are_killed() {
+    let (_temp, report) = run(json!({
+        "args": ["busy-loop"],
+        "limits": { "cpu-seconds": 1 },
+        "timeout": 60,
+    }));
+
+    match &report.outcome {
+        Outcome::LimitExceeded { resource, .. } => assert_eq!(*resource, Resource::Cpu),
+        other => panic!("Unexpected outcome: {other:?}"),
+    }
+    assert_eq!(report.outcome.category(), Category::Failure);
+}
+
+#[test]
+fn large_outputs_are_truncated() {
+    let (_temp, report) = run(json!({
+        "args": ["fill-stdout=1000000", "stderr=Done"],
+        "max-output-size": 1024,
+    }));
+
+    match &report.outcome {
+        Outcome::Completed { truncated, .. } => assert_eq!(truncated, &["stdout"]),
+        other => panic!("Unexpected outcome: {other:?}"),
+    }
+    assert_eq!(report.outcome.category(), Category::Success);
+    let base_dir = report.outcome.base_dir().unwrap();
+    assert_eq!(read(base_dir, "stdout.txt"), "x".repeat(1024));
+    assert_eq!(read(base_dir, "stderr.txt"), "Done");
+}
+
+#[test]
+fn unmet_expectations_fail_the_test_case() {
+    let (_temp, report) = run(json!({
+        "args": ["stdout=Hello, World!"],
+        "expect": {
+            "stdout": { "contains": ["Goodbye"], "regex": ["^Hello"] },
+        },
+    }));
+
+    match &report.outcome {
+        Outcome::Completed {
+            status,
+            unmet_expectations,
+            ..
+        } => {
+            assert!(status.success);
+            assert_eq!(
+                unmet_expectations.as_deref(),
+                Some(&[r#"stdout doesn't contain "Goodbye""#.to_string()][..])
+            );
+        }
+        other => panic!("Unexpected outcome: {other:?}"),
+    }
+    assert_eq!(report.outcome.category(), Category::Failure);
+}
+
+#[test]
+fn expected_exit_codes_pass() {
+    let (_temp, report) = run(json!({
+        "args": ["stderr=Usage: ...", "exit=2"],
+        "expect": {
+            "exit-code": 2,
+            "stderr": { "contains": ["Usage"] },
+        },
+    }));
+
+    assert_eq!(report.outcome.category(), Category::Success);
+}
+
+#[test]
+fn overrides_are_merged_with_the_experiment() {
+    let (_temp, report) = run(json!({
+        "args": ["exit=1"],
+        "env": { "FIRST": "first", "SECOND": "second" },
+        "overrides": {
+            "fixtures/other": { "args": ["exit=2"] },
+            "fixtures/example": {
+                "args": ["print-guest-env", "exit=3"],
+                "env": { "SECOND": "overridden" },
+                "expect": { "exit-code": 3 },
+            },
+        },
+    }));
+
+    assert_eq!(report.outcome.category(), Category::Success);
+    assert_eq!(
+        read(report.outcome.base_dir().unwrap(), "stdout.txt"),
+        "FIRST=first\nSECOND=overridden"
+    );
+}
+
+#[test]
+fn cancelling_an_experiment_stops_running_test_cases() {
+    common::install_stub_wasmer();
+    let endpoint = common::start_fake_registry(&["example"]);
+    let temp = tempfile::tempdir().unwrap();
+    let experiment_dir = temp.path().join("experiment");
+    let experiment: Experiment = serde_json::from_value(json!({
+        "package": "fixtures/runner",
+        "args": ["sleep=60000"],
+        "artifacts": "tarball",
+        "filters": { "namespaces": ["fixtures"] },
+    }))
+    .unwrap();
+
+    let start = Instant::now();
+    let handle = std::thread::spawn({
+        let cache_dir = temp.path().join("cache");
+        let experiment_dir = experiment_dir.clone();
+        move || {
+            ExperimentBuilder::new(experiment)
+                .with_endpoint(endpoint)
+                .unwrap()
+                .with_cache_dir(cache_dir)
+                .with_experiment_dir(experiment_dir)
+                .run()
+                .unwrap()
+        }
+    });
+    // Wait for the test case to start
+    let test_case_dir = experiment_dir.join("experiments/fixtures/example/1.0.0");
+    while !test_case_dir.join("stdout.txt").exists() {
+        assert!(start.elapsed() < Duration::from_secs(30), "Timed out");
+        std::thread::sleep(Duration::from_millis(50));
+    }
+    wasmer_borealis::experiment::cancel(&experiment_dir).unwrap();
+    let results = handle.join().unwrap();
+
+    assert!(results.cancelled);
+    assert!(results.reports.is_empty());
+    assert!(start.elapsed() < Duration::from_secs(30));
+    assert!(!experiment_dir.join("cancel").exists());
+}
+
+/// Run an experiment against a single `fixtures/example` package, using the
+/// provided fields to override the defaults.
+fn run(overrides: Value) -> (TempDir, Report) {
+    common::install_stub_wasmer();
+    let endpoint = common::start_fake_registry(&["example"]);
+    let temp = tempfile::tempdir().unwrap();
+
+    let mut experiment = json!({
+        "package": "fixtures/runner",
+        "artifacts": "tarball",
+        "filters": {
+            "namespaces": ["fixtures"],
+        },
+    });
+    for (key, value) in overrides.as_object().unwrap() {
+        experiment[key] = value.clone();
+    }
+    let experiment: Experiment = serde_json::from_value(experiment).unwrap();
+
+    let mut results = ExperimentBuilder::new(experiment)
+        .with_endpoint(endpoint)
+        .unwrap()
+        .with_cache_dir(temp.path().join("cache"))
+        .with_experiment_dir(temp.path().join("experiment"))
+        .run()
+        .unwrap();
+
+    assert_eq!(results.reports.len(), 1);
+    (temp, results.reports.remove(0))
+}
+
+fn read(base_dir: &Path, filename: &str) -> String {
+    std::fs::read_to_string(base_dir.join(filename))
+        .unwrap()
+        .trim()
+        .to_string()
+}